@@ -0,0 +1,134 @@
+//go:build !appengine
+// +build !appengine
+
+// Command gigcity serves the GDG Gigcity site without App Engine, storing its
+// data in a local BoltDB file.
+//
+// Run it from the project directory (or point -dir at it) so the templates and
+// assets under static/ can be found:
+//
+//	gigcity -addr :8080 -db gigcity.db -admin-password secret
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kynrai/gigcity-site/gigcity"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the site until it is shut down.  Errors are returned rather
+// than fatal so the deferred close of the database always runs
+func run() error {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dbPath := flag.String("db", "gigcity.db", "path to the BoltDB database file")
+	dir := flag.String("dir", ".", "project directory containing static/")
+	adminUser := flag.String("admin-user", "admin", "username for the admin area")
+	adminPass := flag.String("admin-password", os.Getenv("GIGCITY_ADMIN_PASSWORD"), "password for the admin area, the admin area is disabled when empty")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server to send email through, emails are only logged when empty")
+	smtpFrom := flag.String("smtp-from", "noreply@gdggigcity.com", "address emails are sent from")
+	smtpUser := flag.String("smtp-user", "", "username for the SMTP server, if it needs one")
+	smtpPass := flag.String("smtp-password", os.Getenv("GIGCITY_SMTP_PASSWORD"), "password for the SMTP server")
+	reportKey := flag.String("report-key", os.Getenv("GIGCITY_REPORT_KEY"), "base64 encoded 32 byte key code of conduct reports are encrypted with, reports are refused when empty")
+	dev := flag.Bool("dev", false, "reload templates from disk when they change, for working on the site")
+	flag.Parse()
+
+	// templates and assets are loaded relative to the project directory
+	if err := os.Chdir(*dir); err != nil {
+		return err
+	}
+
+	db, err := gigcity.OpenBolt(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *adminPass == "" {
+		log.Print("no admin password set, the admin area is disabled")
+	}
+
+	mailer := gigcity.LogMailer()
+	if *smtpAddr != "" {
+		var auth smtp.Auth
+		if *smtpUser != "" {
+			host, _, _ := net.SplitHostPort(*smtpAddr)
+			auth = smtp.PlainAuth("", *smtpUser, *smtpPass, host)
+		}
+		mailer = gigcity.SMTPMailer(*smtpAddr, *smtpFrom, auth)
+	} else {
+		log.Print("no SMTP server set, emails will only be logged")
+	}
+
+	key, err := gigcity.ParseReportKey(*reportKey)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		log.Print("no report key set, code of conduct reports are refused")
+	}
+
+	handler, err := gigcity.NewHandler(db, gigcity.BasicAuth(*adminUser, *adminPass), mailer, key, *dev)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: newMux(handler),
+	}
+
+	// shut down cleanly on SIGTERM/SIGINT, letting in flight requests finish
+	// before the database is closed
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		log.Print("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(done)
+	}()
+
+	log.Printf("listening on %s", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+
+	return nil
+}
+
+// newMux serves the static assets that app.yaml maps on App Engine, and hands
+// everything else to the site
+func newMux(site http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/static/img/", http.StripPrefix("/static/img/", http.FileServer(http.Dir("static/img"))))
+	for _, f := range []string{"/favicon.ico", "/robots.txt", "/highres-favicon.png"} {
+		f := f
+		mux.HandleFunc(f, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "static"+f)
+		})
+	}
+	mux.Handle("/", site)
+	return mux
+}
@@ -1,25 +1,14 @@
 package gigcity
 
 import (
-	"html/template"
 	"net/http"
-	"strings"
 )
 
 // Admin landing page
-func adminRootHandler(w http.ResponseWriter, r *http.Request) {
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/admin/overlay.html",
-		"static/admin/index.html",
-	))
-
-	if err := page.Execute(w, nil); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+func (s *site) adminRootHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
 		return
 	}
-}
 
-func getID(n string) string {
-	return strings.ToLower(strings.Replace(n, " ", "-", -1))
+	s.render(w, r, "admin/index", nil)
 }
@@ -0,0 +1,456 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Session is one talk or workshop on an Event's agenda
+type Session struct {
+	// ID is unique within the event, it is the session's anchor on the event
+	// page so it is kept when the session is renamed
+	ID string
+	// Title of the talk or workshop
+	Title string
+	// Abstract describes what the session covers
+	Abstract string `datastore:",noindex"`
+	// Room is where the session is held.  Sessions without one, like a
+	// keynote or lunch, are for everyone and span every room
+	Room string
+	// Start and End are stored in UTC and shown in the event's time zone
+	Start time.Time
+	End   time.Time
+	// SpeakerIDs lists who is presenting
+	SpeakerIDs []string
+	// Created is when the session was first saved
+	Created time.Time
+	// Updated is when the session was last changed
+	Updated time.Time
+}
+
+// sessionsByStart sorts sessions by start time, then by room
+type sessionsByStart []Session
+
+func (s sessionsByStart) Len() int      { return len(s) }
+func (s sessionsByStart) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sessionsByStart) Less(i, j int) bool {
+	if !s[i].Start.Equal(s[j].Start) {
+		return s[i].Start.Before(s[j].Start)
+	}
+
+	return s[i].Room < s[j].Room
+}
+
+// overlaps reports whether two sessions would be in the same place at the
+// same time.  A session without a room clashes with every other session
+func (ss Session) overlaps(other Session) bool {
+	if ss.Room != "" && other.Room != "" && ss.Room != other.Room {
+		return false
+	}
+
+	return ss.Start.Before(other.End) && other.Start.Before(ss.End)
+}
+
+// sessionSlug picks an ID for ss that no other session of the event has
+func sessionSlug(ss Session, sessions []Session) string {
+	taken := make(map[string]bool)
+	for _, other := range sessions {
+		taken[other.ID] = true
+	}
+
+	base := slugify(ss.Title)
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = base + "-" + strconv.Itoa(n)
+	}
+
+	return slug
+}
+
+// sessionFromValues builds a Session of e out of the named fields returned by
+// value, which are named after the add/edit form's inputs.  Times are read in
+// the event's time zone
+func (s *site) sessionFromValues(r *http.Request, e Event, value func(string) string) (Session, string) {
+	var ss Session
+	msg := tooLong(value, "session", lineField("title"), lineField("room"), textField("abstract"))
+	if msg != "" {
+		return ss, msg
+	}
+
+	ss.Title = value("title")
+	if ss.Title == "" {
+		return ss, "session title is required"
+	}
+
+	for _, t := range []struct {
+		field string
+		dst   *time.Time
+	}{
+		{"start", &ss.Start},
+		{"end", &ss.End},
+	} {
+		v := value(t.field)
+		if v == "" {
+			return ss, "session " + t.field + " time is required"
+		}
+
+		*t.dst, _, msg = s.parseFormTime(r, v, e.TimeZone, e.LocID)
+		if msg != "" {
+			return ss, "session " + t.field + " " + msg
+		}
+	}
+
+	if !ss.End.After(ss.Start) {
+		return ss, "session must end after it starts"
+	}
+
+	ss.Room = value("room")
+	ss.Abstract = value("abstract")
+	ss.SpeakerIDs, msg = s.speakerIDs(r, value("speakers"))
+	return ss, msg
+}
+
+// clash returns a message naming the first of sessions that ss overlaps, or
+// "" if it fits into the agenda
+func clash(e Event, ss Session, sessions []Session) string {
+	for _, other := range sessions {
+		if other.ID == ss.ID || !ss.overlaps(other) {
+			continue
+		}
+
+		where := "the same room"
+		if other.Room == "" || ss.Room == "" {
+			where = "a session for everyone"
+		}
+
+		return fmt.Sprintf("session overlaps %q (%s), which is in %s", other.Title, formatLocal(other.Start, e.TimeZone), where)
+	}
+
+	return ""
+}
+
+// agendaCell is a cell of the timetable.  Session is zero for an empty slot
+type agendaCell struct {
+	Session  Session
+	Speakers []Speaker
+	// Time is when the session runs, in the event's time zone
+	Time    string
+	Rowspan int
+	Colspan int
+}
+
+// agendaRow is a slot of the timetable, starting at Time
+type agendaRow struct {
+	Time  string
+	Cells []agendaCell
+}
+
+// agenda is an event's sessions laid out as a timetable, with a column per
+// room and a row for each slot between consecutive start or end times
+type agenda struct {
+	Rooms []string
+	Rows  []agendaRow
+}
+
+// buildAgenda lays out the sessions of e.  Sessions must not overlap, which
+// the admin pages make sure of.  speakers holds the speakers of every session
+// by ID
+func buildAgenda(e Event, sessions []Session, speakers map[string]Speaker) agenda {
+	var a agenda
+	if len(sessions) == 0 {
+		return a
+	}
+
+	sort.Sort(sessionsByStart(sessions))
+	column := make(map[string]int)
+	var bounds []time.Time
+	seen := make(map[int64]bool)
+	for _, ss := range sessions {
+		if _, ok := column[ss.Room]; !ok && ss.Room != "" {
+			column[ss.Room] = len(a.Rooms)
+			a.Rooms = append(a.Rooms, ss.Room)
+		}
+
+		for _, t := range []time.Time{ss.Start, ss.End} {
+			if !seen[t.Unix()] {
+				seen[t.Unix()] = true
+				bounds = append(bounds, t)
+			}
+		}
+	}
+	sort.Sort(timesAscending(bounds))
+
+	cols := len(a.Rooms)
+	if cols == 0 {
+		cols = 1
+	}
+
+	// multi day events show the day with each slot
+	zone := zoneOrDefault(e.TimeZone)
+	layout := clockLayout
+	const day = "2006-01-02"
+	if bounds[0].In(zone).Format(day) != bounds[len(bounds)-1].In(zone).Format(day) {
+		layout = "Mon " + clockLayout
+	}
+
+	slot := make(map[int64]int)
+	for i, t := range bounds {
+		slot[t.Unix()] = i
+	}
+
+	// place each session in the row it starts in, then mark the cells it
+	// covers so they are left out of the rows below
+	starts := make(map[[2]int]agendaCell)
+	covered := make(map[[2]int]bool)
+	for _, ss := range sessions {
+		cell := agendaCell{
+			Session: ss,
+			Time:    ss.Start.In(zone).Format(clockLayout) + " to " + ss.End.In(zone).Format(clockLayout),
+			Rowspan: slot[ss.End.Unix()] - slot[ss.Start.Unix()],
+			Colspan: 1,
+		}
+		for _, id := range ss.SpeakerIDs {
+			if sp, ok := speakers[id]; ok {
+				cell.Speakers = append(cell.Speakers, sp)
+			}
+		}
+
+		first := column[ss.Room]
+		if ss.Room == "" {
+			first, cell.Colspan = 0, cols
+		}
+
+		row := slot[ss.Start.Unix()]
+		starts[[2]int{row, first}] = cell
+		for r := row; r < row+cell.Rowspan; r++ {
+			for c := first; c < first+cell.Colspan; c++ {
+				covered[[2]int{r, c}] = true
+			}
+		}
+	}
+
+	for row := 0; row < len(bounds)-1; row++ {
+		ar := agendaRow{Time: bounds[row].In(zone).Format(layout)}
+		for c := 0; c < cols; c++ {
+			if cell, ok := starts[[2]int{row, c}]; ok {
+				ar.Cells = append(ar.Cells, cell)
+				c += cell.Colspan - 1
+			} else if !covered[[2]int{row, c}] {
+				ar.Cells = append(ar.Cells, agendaCell{Rowspan: 1, Colspan: 1})
+			}
+		}
+		a.Rows = append(a.Rows, ar)
+	}
+
+	return a
+}
+
+// timesAscending sorts times earliest first
+type timesAscending []time.Time
+
+func (t timesAscending) Len() int           { return len(t) }
+func (t timesAscending) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t timesAscending) Less(i, j int) bool { return t[i].Before(t[j]) }
+
+// eventAgenda fetches the sessions of e and their speakers, and lays them out
+func (s *site) eventAgenda(r *http.Request, e Event) (agenda, error) {
+	sessions, err := s.backend.Sessions(r).List(e.ID)
+	if err != nil {
+		return agenda{}, err
+	}
+
+	speakers := make(map[string]Speaker)
+	store := s.backend.Speakers(r)
+	for _, ss := range sessions {
+		for _, id := range ss.SpeakerIDs {
+			if _, ok := speakers[id]; ok {
+				continue
+			}
+
+			sp, err := store.Get(id)
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return agenda{}, err
+			}
+			speakers[id] = sp
+		}
+	}
+
+	return buildAgenda(e, sessions, speakers), nil
+}
+
+// sessionForm is what static/admin/add-session.html is rendered with
+type sessionForm struct {
+	Event    Event
+	Session  Session
+	Speakers []Speaker
+}
+
+// FormStart and FormEnd format the session's times for the form's inputs
+func (f sessionForm) FormStart() string { return formValueLocal(f.Session.Start, f.Event.TimeZone) }
+func (f sessionForm) FormEnd() string   { return formValueLocal(f.Session.End, f.Event.TimeZone) }
+
+// Local shows t in the event's time zone
+func (f sessionForm) Local(t time.Time) string { return formatLocal(t, f.Event.TimeZone) }
+
+// HasSpeaker reports whether the speaker with the given ID presents the
+// session
+func (f sessionForm) HasSpeaker(id string) bool {
+	for _, s := range f.Session.SpeakerIDs {
+		if s == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handles requests to /admin/events/:event/agenda.  GET lists the event's
+// sessions with a form for a new one, POST adds the session
+func (s *site) adminAgendaHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		sessionForm
+		Sessions []Session
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, ok := s.adminEvent(w, r)
+	if !ok {
+		return
+	}
+
+	store := s.backend.Sessions(r)
+	sessions, err := store.List(e.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method == "POST" {
+		ss, msg := s.sessionFromValues(r, e, formValue(r))
+		if msg == "" {
+			msg = clash(e, ss, sessions)
+		}
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, msg)
+			return
+		}
+
+		ss.ID = sessionSlug(ss, sessions)
+		ss.Created = time.Now().UTC()
+		ss.Updated = ss.Created
+		if err := store.Add(e.ID, ss); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/admin/events/"+e.ID+"/agenda", http.StatusFound)
+		return
+	}
+
+	speakers, err := s.backend.Speakers(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(speakersByName(speakers))
+
+	// a new session starts when the event does
+	form := sessionForm{Event: e, Session: Session{Start: e.Datetime}, Speakers: speakers}
+	s.render(w, r, "admin/agenda", Content{form, sessions})
+}
+
+// Handles requests to /admin/events/:event/agenda/:session/edit.  GET shows
+// the session form pre-filled with the stored session, POST writes the
+// changes back to it
+func (s *site) editSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, ok := s.adminEvent(w, r)
+	if !ok {
+		return
+	}
+
+	store := s.backend.Sessions(r)
+	old, err := store.Get(e.ID, r.URL.Query().Get(":session"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method == "POST" {
+		sessions, err := store.List(e.ID)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		ss, msg := s.sessionFromValues(r, e, formValue(r))
+		// keep the ID so links to the session's anchor keep working
+		ss.ID = old.ID
+		if msg == "" {
+			msg = clash(e, ss, sessions)
+		}
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, msg)
+			return
+		}
+
+		ss.Created = old.Created
+		ss.Updated = time.Now().UTC()
+		if err := store.Update(e.ID, ss); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/admin/events/"+e.ID+"/agenda", http.StatusFound)
+		return
+	}
+
+	speakers, err := s.backend.Speakers(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(speakersByName(speakers))
+
+	s.render(w, r, "admin/edit-session", sessionForm{e, old, speakers})
+}
+
+// Handles requests to /admin/events/:event/agenda/:session/delete
+func (s *site) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, ok := s.adminEvent(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.backend.Sessions(r).Delete(e.ID, r.URL.Query().Get(":session"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/events/"+e.ID+"/agenda", http.StatusFound)
+}
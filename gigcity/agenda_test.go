@@ -0,0 +1,86 @@
+package gigcity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClash(t *testing.T) {
+	e := Event{TimeZone: "Europe/London"}
+	sessions := []Session{
+		{ID: "keynote", Title: "Keynote", Start: at("2015-01-10T18:00"), End: at("2015-01-10T18:30")},
+		{ID: "go", Title: "Go", Room: "A", Start: at("2015-01-10T18:30"), End: at("2015-01-10T19:30")},
+	}
+
+	for _, tt := range []struct {
+		ss   Session
+		want string
+	}{
+		{Session{Room: "B", Start: at("2015-01-10T18:30"), End: at("2015-01-10T19:00")}, ""},
+		// back to back is fine
+		{Session{Room: "A", Start: at("2015-01-10T19:30"), End: at("2015-01-10T20:00")}, ""},
+		{Session{Room: "A", Start: at("2015-01-10T19:00"), End: at("2015-01-10T20:00")}, `"Go" (2015-01-10 6:30 PM GMT), which is in the same room`},
+		{Session{Room: "B", Start: at("2015-01-10T18:15"), End: at("2015-01-10T18:45")}, `"Keynote" (2015-01-10 6:00 PM GMT), which is in a session for everyone`},
+		{Session{Start: at("2015-01-10T19:00"), End: at("2015-01-10T19:15")}, `"Go"`},
+		// editing a session doesn't clash with itself
+		{Session{ID: "go", Room: "A", Start: at("2015-01-10T18:45"), End: at("2015-01-10T19:45")}, ""},
+	} {
+		got := clash(e, tt.ss, sessions)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("clash(%s to %s in %q) = %q, want %q", tt.ss.Start, tt.ss.End, tt.ss.Room, got, tt.want)
+		}
+	}
+}
+
+func TestSessionSlug(t *testing.T) {
+	sessions := []Session{{ID: "intro"}, {ID: "intro-2"}}
+	if got := sessionSlug(Session{Title: "Intro"}, sessions); got != "intro-3" {
+		t.Errorf("sessionSlug = %q, want intro-3", got)
+	}
+	if got := sessionSlug(Session{Title: "Lunch"}, sessions); got != "lunch" {
+		t.Errorf("sessionSlug = %q, want lunch", got)
+	}
+}
+
+func TestBuildAgenda(t *testing.T) {
+	e := Event{TimeZone: "Europe/London"}
+	if a := buildAgenda(e, nil, nil); len(a.Rows) != 0 {
+		t.Errorf("empty agenda has rows %+v", a.Rows)
+	}
+
+	a := buildAgenda(e, []Session{
+		{ID: "short", Room: "B", Start: at("2015-01-10T18:30"), End: at("2015-01-10T19:00"), SpeakerIDs: []string{"ada", "gone"}},
+		{ID: "long", Room: "A", Start: at("2015-01-10T18:30"), End: at("2015-01-10T19:30")},
+		{ID: "keynote", Start: at("2015-01-10T18:00"), End: at("2015-01-10T18:30")},
+	}, map[string]Speaker{"ada": {ID: "ada", Name: "Ada"}})
+
+	if fmt.Sprint(a.Rooms) != "[A B]" {
+		t.Errorf("rooms %v, want [A B]", a.Rooms)
+	}
+
+	var got []string
+	for _, row := range a.Rows {
+		var cells []string
+		for _, c := range row.Cells {
+			cells = append(cells, fmt.Sprintf("%s:%dx%d", c.Session.ID, c.Rowspan, c.Colspan))
+		}
+		got = append(got, row.Time+" "+strings.Join(cells, ","))
+	}
+	// the keynote spans both rooms, the long session two slots, and room B
+	// is empty once the short one ends
+	want := "[6:00 PM keynote:1x2 6:30 PM long:2x1,short:1x1 7:00 PM :1x1]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("agenda rows %v, want %s", got, want)
+	}
+
+	if speakers := a.Rows[1].Cells[1].Speakers; len(speakers) != 1 || speakers[0].Name != "Ada" {
+		t.Errorf("short session speakers %+v, want Ada only", speakers)
+	}
+
+	// a session running past midnight shows the day with each slot
+	a = buildAgenda(e, []Session{{ID: "late", Start: at("2015-01-10T23:30"), End: at("2015-01-11T00:30")}}, nil)
+	if a.Rows[0].Time != "Sat 11:30 PM" {
+		t.Errorf("multi day slot time %q, want Sat 11:30 PM", a.Rows[0].Time)
+	}
+}
@@ -0,0 +1,568 @@
+package gigcity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// apiPrefix is where the current version of the JSON API is mounted
+const apiPrefix = "/api/v1"
+
+const (
+	// defaultPageSize is how many records a list endpoint returns when the
+	// request doesn't set a limit
+	defaultPageSize = 20
+	// maxPageSize caps the limit a request may ask for
+	maxPageSize = 100
+)
+
+// apiLocation is a Location as exposed by the JSON API
+type apiLocation struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Details  string `json:"details,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+}
+
+// apiEvent is an Event as exposed by the JSON API
+type apiEvent struct {
+	ID           string       `json:"id"`
+	Title        string       `json:"title"`
+	URL          string       `json:"url"`
+	Start        *time.Time   `json:"start"`
+	TimeZone     string       `json:"timeZone"`
+	LocationID   string       `json:"locationId"`
+	Location     *apiLocation `json:"location,omitempty"`
+	Details      string       `json:"details"`
+	GooglePlus   string       `json:"googlePlus,omitempty"`
+	HangoutOnAir string       `json:"hangoutOnAir,omitempty"`
+	Capacity     int          `json:"capacity"`
+	SpeakerIDs   []string     `json:"speakerIds,omitempty"`
+	SponsorIDs   []string     `json:"sponsorIds,omitempty"`
+	TagIDs       []string     `json:"tagIds,omitempty"`
+	Sessions     []apiSession `json:"sessions,omitempty"`
+	Created      *time.Time   `json:"created,omitempty"`
+	Updated      *time.Time   `json:"updated,omitempty"`
+}
+
+// apiSession is a Session on an event's agenda as exposed by the JSON API
+type apiSession struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	URL        string     `json:"url"`
+	Abstract   string     `json:"abstract,omitempty"`
+	Room       string     `json:"room,omitempty"`
+	Start      *time.Time `json:"start"`
+	End        *time.Time `json:"end"`
+	SpeakerIDs []string   `json:"speakerIds,omitempty"`
+}
+
+// apiLearnEvent is a LearnEvent as exposed by the JSON API
+type apiLearnEvent struct {
+	ID         string       `json:"id"`
+	Title      string       `json:"title"`
+	URL        string       `json:"url"`
+	Start      *time.Time   `json:"start"`
+	TimeZone   string       `json:"timeZone"`
+	LocationID string       `json:"locationId"`
+	Location   *apiLocation `json:"location,omitempty"`
+	Details    string       `json:"details"`
+	TagIDs     []string     `json:"tagIds,omitempty"`
+	// Recurrence is set if the study group repeats, Start is then its first
+	// meeting and detail responses list every meeting in Occurrences
+	Recurrence  *apiRecurrence  `json:"recurrence,omitempty"`
+	Occurrences []apiOccurrence `json:"occurrences,omitempty"`
+	Created     *time.Time      `json:"created,omitempty"`
+	Updated     *time.Time      `json:"updated,omitempty"`
+}
+
+// apiRecurrence is a study group's Recurrence as exposed by the JSON API.
+// Weekdays are iCalendar codes like "TU", dates are YYYY-MM-DD
+type apiRecurrence struct {
+	Interval int      `json:"interval"`
+	Weekdays []string `json:"weekdays,omitempty"`
+	Until    string   `json:"until"`
+	Except   []string `json:"except,omitempty"`
+}
+
+// apiOccurrence is one meeting of a repeating study group
+type apiOccurrence struct {
+	Date      string     `json:"date"`
+	URL       string     `json:"url"`
+	Start     *time.Time `json:"start"`
+	Moved     bool       `json:"moved,omitempty"`
+	Cancelled bool       `json:"cancelled,omitempty"`
+}
+
+// apiTime returns nil for unset times so they are sent as null rather than
+// the year 1
+func apiTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	t = t.UTC()
+	return &t
+}
+
+func newAPILocation(l Location) *apiLocation {
+	return &apiLocation{
+		ID:       l.ID,
+		Name:     l.Name,
+		Address:  l.Address,
+		Details:  l.Details,
+		TimeZone: l.TimeZone,
+		Capacity: l.Capacity,
+	}
+}
+
+func newAPIEvent(r *http.Request, e Event) apiEvent {
+	return apiEvent{
+		ID:           e.ID,
+		Title:        e.Title,
+		URL:          baseURL(r) + "/events/" + e.ID,
+		Start:        apiTime(e.Datetime),
+		TimeZone:     e.TimeZone,
+		LocationID:   e.LocID,
+		Details:      e.Details,
+		GooglePlus:   e.GooglePlus,
+		HangoutOnAir: e.HoA,
+		Capacity:     e.Capacity,
+		SpeakerIDs:   e.SpeakerIDs,
+		SponsorIDs:   e.SponsorIDs,
+		TagIDs:       e.TagIDs,
+		Created:      apiTime(e.Created),
+		Updated:      apiTime(e.Updated),
+	}
+}
+
+func newAPILearnEvent(r *http.Request, l LearnEvent) apiLearnEvent {
+	group := apiLearnEvent{
+		ID:         l.ID,
+		Title:      l.Title,
+		URL:        baseURL(r) + "/learning/" + l.ID,
+		Start:      apiTime(l.Datetime),
+		TimeZone:   l.TimeZone,
+		LocationID: l.LocID,
+		Details:    l.Details,
+		TagIDs:     l.TagIDs,
+		Created:    apiTime(l.Created),
+		Updated:    apiTime(l.Updated),
+	}
+
+	if l.Repeats() {
+		rr := &apiRecurrence{Interval: l.Recurrence.Interval, Until: l.FormUntil()}
+		for _, d := range l.Recurrence.Weekdays {
+			rr.Weekdays = append(rr.Weekdays, weekdayCodes[d])
+		}
+		for _, d := range l.Recurrence.Except {
+			rr.Except = append(rr.Except, d.Format(dateLayout))
+		}
+		group.Recurrence = rr
+	}
+
+	return group
+}
+
+// apiEventDetail converts e and embeds its agenda and the location it is
+// held at
+func (s *site) apiEventDetail(r *http.Request, e Event) (apiEvent, error) {
+	event := newAPIEvent(r, e)
+	sessions, err := s.backend.Sessions(r).List(e.ID)
+	if err != nil {
+		return event, err
+	}
+
+	for _, ss := range sessions {
+		event.Sessions = append(event.Sessions, apiSession{
+			ID:         ss.ID,
+			Title:      ss.Title,
+			URL:        event.URL + "#session-" + ss.ID,
+			Abstract:   ss.Abstract,
+			Room:       ss.Room,
+			Start:      apiTime(ss.Start),
+			End:        apiTime(ss.End),
+			SpeakerIDs: ss.SpeakerIDs,
+		})
+	}
+
+	l, err := s.backend.Locations(r).Get(e.LocID)
+	if err == ErrNotFound {
+		return event, nil
+	}
+	if err != nil {
+		return event, err
+	}
+
+	event.Location = newAPILocation(l)
+	return event, nil
+}
+
+// apiLearnEventDetail converts l and embeds the location it meets at
+func (s *site) apiLearnEventDetail(r *http.Request, l LearnEvent) (apiLearnEvent, error) {
+	group := newAPILearnEvent(r, l)
+	if l.Repeats() {
+		for _, o := range l.Occurrences() {
+			group.Occurrences = append(group.Occurrences, apiOccurrence{
+				Date:      o.Date,
+				URL:       baseURL(r) + o.Link(),
+				Start:     apiTime(o.Datetime),
+				Moved:     o.Moved,
+				Cancelled: o.Cancelled,
+			})
+		}
+	}
+
+	loc, err := s.backend.Locations(r).Get(l.LocID)
+	if err == ErrNotFound {
+		return group, nil
+	}
+	if err != nil {
+		return group, err
+	}
+
+	group.Location = newAPILocation(loc)
+	return group, nil
+}
+
+// apiPage describes where a list response sits in the full result set
+type apiPage struct {
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+	Total  int    `json:"total"`
+	Next   string `json:"next,omitempty"`
+}
+
+// apiList is the envelope every list endpoint responds with
+type apiList struct {
+	Data   interface{} `json:"data"`
+	Paging apiPage     `json:"paging"`
+}
+
+// apiErrorBody is the envelope every error response is sent in
+type apiErrorBody struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// writeJSON sends v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// the body is never HTML, keep & in paging links readable
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logHandler("ERROR", "encoding API response failed: "+err.Error())
+		status = http.StatusInternalServerError
+		buf.Reset()
+		buf.WriteString(`{"error":{"status":500,"message":"internal server error"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	// reading is public, any site may call the API from a browser.  Writes
+	// are authenticated by bearer token rather than cookie, so this doesn't
+	// expose them
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// apiError sends an error in the API's JSON error shape, the JSON counterpart
+// to errorHandler
+func apiError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if status == http.StatusInternalServerError {
+		logHandler("ERROR", fmt.Sprintf("an internal server error occured when %s requested %s with error:\n%s", r.RemoteAddr, r.URL.Path, message))
+		// don't leak internals to API clients
+		message = "internal server error"
+	}
+
+	var body apiErrorBody
+	body.Error.Status = status
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+// parsePaging reads the offset and limit query parameters
+func parsePaging(q url.Values) (offset, limit int, msg string) {
+	offset, limit = 0, defaultPageSize
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, "offset must be a non-negative integer"
+		}
+		offset = n
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, 0, fmt.Sprintf("limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+
+	return offset, limit, ""
+}
+
+// parseAPITime reads a date range bound, either an RFC 3339 time or a plain
+// YYYY-MM-DD date in the chapter's time zone.  endOfDay moves a plain date to
+// the end of that day so a "to" date includes it
+func parseAPITime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", v, zoneOrDefault(""))
+	if err != nil {
+		return t, err
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// dateRange is an optional from (inclusive) and to (exclusive) filter
+type dateRange struct {
+	from, to time.Time
+}
+
+// parseDateRange reads the from and to query parameters
+func parseDateRange(q url.Values) (dateRange, string) {
+	var dr dateRange
+	var err error
+	if v := q.Get("from"); v != "" {
+		if dr.from, err = parseAPITime(v, false); err != nil {
+			return dr, "from must be an RFC 3339 time or a YYYY-MM-DD date"
+		}
+	}
+
+	if v := q.Get("to"); v != "" {
+		if dr.to, err = parseAPITime(v, true); err != nil {
+			return dr, "to must be an RFC 3339 time or a YYYY-MM-DD date"
+		}
+	}
+
+	return dr, ""
+}
+
+// contains reports whether t falls in the range
+func (dr dateRange) contains(t time.Time) bool {
+	if !dr.from.IsZero() && t.Before(dr.from) {
+		return false
+	}
+	if !dr.to.IsZero() && !t.Before(dr.to) {
+		return false
+	}
+
+	return true
+}
+
+// meets reports whether the study group has a meeting in the range
+func (dr dateRange) meets(l LearnEvent) bool {
+	for _, o := range l.Occurrences() {
+		if !o.Cancelled && dr.contains(o.Datetime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// page works out the slice bounds of the requested page out of total records
+// and fills in the paging details, including a link to the next page
+func page(r *http.Request, offset, limit, total int) (int, int, apiPage) {
+	p := apiPage{Offset: offset, Limit: limit, Total: total}
+	start, end := offset, offset+limit
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+
+	if end < total {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(end))
+		q.Set("limit", strconv.Itoa(limit))
+		// pat adds the route's parameters to the query, they don't belong in
+		// the link
+		for k := range q {
+			if len(k) > 0 && k[0] == ':' {
+				q.Del(k)
+			}
+		}
+		p.Next = baseURL(r) + r.URL.Path + "?" + q.Encode()
+	}
+
+	return start, end, p
+}
+
+// Handles requests to /api/v1/events
+func (s *site) apiEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, limit, msg := parsePaging(q)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	dr, msg := parseDateRange(q)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	events, err := s.backend.Events(r).List(0)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tag := q.Get("tag")
+	matched := make([]apiEvent, 0, len(events))
+	for _, e := range events {
+		if dr.contains(e.Datetime) && (tag == "" || e.HasTag(tag)) {
+			matched = append(matched, newAPIEvent(r, e))
+		}
+	}
+
+	start, end, p := page(r, offset, limit, len(matched))
+	writeJSON(w, http.StatusOK, apiList{matched[start:end], p})
+}
+
+// Handles requests to /api/v1/events/:event
+func (s *site) apiEventHandler(w http.ResponseWriter, r *http.Request) {
+	eventID := r.URL.Query().Get(":event")
+	e, err := s.backend.Events(r).Get(eventID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "Events", eventID, apiPrefix+"/events/", "") {
+			apiError(w, r, http.StatusNotFound, "event not found")
+		}
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event, err := s.apiEventDetail(r, e)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, event)
+}
+
+// Handles requests to /api/v1/learning
+func (s *site) apiLearningHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, limit, msg := parsePaging(q)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	dr, msg := parseDateRange(q)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	learn, err := s.backend.LearnEvents(r).List(0)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tag := q.Get("tag")
+	matched := make([]apiLearnEvent, 0, len(learn))
+	for _, l := range learn {
+		if dr.meets(l) && (tag == "" || l.HasTag(tag)) {
+			matched = append(matched, newAPILearnEvent(r, l))
+		}
+	}
+
+	start, end, p := page(r, offset, limit, len(matched))
+	writeJSON(w, http.StatusOK, apiList{matched[start:end], p})
+}
+
+// Handles requests to /api/v1/learning/:event
+func (s *site) apiLearnEventHandler(w http.ResponseWriter, r *http.Request) {
+	groupID := r.URL.Query().Get(":event")
+	l, err := s.backend.LearnEvents(r).Get(groupID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "LearnEvent", groupID, apiPrefix+"/learning/", "") {
+			apiError(w, r, http.StatusNotFound, "study group not found")
+		}
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	group, err := s.apiLearnEventDetail(r, l)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, group)
+}
+
+// Handles requests to /api/v1/locations
+func (s *site) apiLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, msg := parsePaging(r.URL.Query())
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	locations, err := s.backend.Locations(r).List(0)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	all := make([]*apiLocation, 0, len(locations))
+	for _, l := range locations {
+		all = append(all, newAPILocation(l))
+	}
+
+	start, end, p := page(r, offset, limit, len(all))
+	writeJSON(w, http.StatusOK, apiList{all[start:end], p})
+}
+
+// Handles requests to /api/v1/locations/:location
+func (s *site) apiLocationHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := s.backend.Locations(r).Get(r.URL.Query().Get(":location"))
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "location not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPILocation(l))
+}
+
+// Handles any other request under /api/, so API clients always get JSON back
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	apiError(w, r, http.StatusNotFound, "no such API endpoint")
+}
@@ -0,0 +1,81 @@
+package gigcity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// getJSON fetches an API path and decodes the response into v
+func (ts *testServer) getJSON(t *testing.T, path string, v interface{}) int {
+	t.Helper()
+	resp, body := ts.request(t, "GET", path, nil, false)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("GET %s sent %q", path, ct)
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("GET %s: %v in %s", path, err, body)
+	}
+
+	return resp.StatusCode
+}
+
+func TestAPIEvents(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.Backend.Locations(nil).Add(Location{ID: "town-hall", Name: "Town Hall", Address: "1 High Street"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		e := Event{ID: fmt.Sprintf("go-night-%d", i), Title: "Go Night", LocID: "town-hall", Datetime: at(fmt.Sprintf("2015-03-0%dT23:30", i))}
+		if err := ts.Backend.Events(nil).Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list struct {
+		Data   []apiEvent
+		Paging apiPage
+	}
+	if status := ts.getJSON(t, "/api/v1/events?limit=2", &list); status != http.StatusOK {
+		t.Fatalf("list status %d", status)
+	}
+	if len(list.Data) != 2 || list.Data[0].ID != "go-night-3" || list.Paging.Total != 3 {
+		t.Errorf("first page = %+v", list)
+	}
+	if want := ts.URL + "/api/v1/events?limit=2&offset=2"; list.Paging.Next != want {
+		t.Errorf("next page %q, want %q", list.Paging.Next, want)
+	}
+
+	list.Data = nil
+	ts.getJSON(t, "/api/v1/events?from=2015-03-02&to=2015-03-02", &list)
+	// 23:30 UTC is still the evening of the same day in New York
+	if len(list.Data) != 1 || list.Data[0].ID != "go-night-2" {
+		t.Errorf("events on 2015-03-02 = %+v", list.Data)
+	}
+
+	var e apiEvent
+	if status := ts.getJSON(t, "/api/v1/events/go-night-1", &e); status != http.StatusOK {
+		t.Fatalf("detail status %d", status)
+	}
+	if e.Location == nil || e.Location.Address != "1 High Street" || e.URL != ts.URL+"/events/go-night-1" {
+		t.Errorf("detail = %+v", e)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ts := newTestServer(t)
+	for path, status := range map[string]int{
+		"/api/v1/events/nope":      http.StatusNotFound,
+		"/api/v1/nope":             http.StatusNotFound,
+		"/api/v1/events?limit=0":   http.StatusBadRequest,
+		"/api/v1/events?offset=-1": http.StatusBadRequest,
+		"/api/v1/learning?from=x":  http.StatusBadRequest,
+	} {
+		var body apiErrorBody
+		if got := ts.getJSON(t, path, &body); got != status || body.Error.Status != status || body.Error.Message == "" {
+			t.Errorf("GET %s = %d %+v, want a %d error", path, got, body, status)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package gigcity
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxAPIBody caps the size of a JSON request body
+const maxAPIBody = 1 << 20
+
+// apiEventInput is the body of an event create or update request.  Start is
+// either a YYYY-MM-DDTHH:MM time in TimeZone, like the admin form takes, or
+// an RFC 3339 time.  Leaving out Capacity uses the location's.  SpeakerIDs,
+// SponsorIDs and TagIDs must name existing speakers, sponsors and topics
+type apiEventInput struct {
+	Title        string   `json:"title"`
+	Start        string   `json:"start"`
+	TimeZone     string   `json:"timeZone"`
+	LocationID   string   `json:"locationId"`
+	Details      string   `json:"details"`
+	GooglePlus   string   `json:"googlePlus"`
+	HangoutOnAir string   `json:"hangoutOnAir"`
+	Capacity     *int     `json:"capacity"`
+	SpeakerIDs   []string `json:"speakerIds"`
+	SponsorIDs   []string `json:"sponsorIds"`
+	TagIDs       []string `json:"tagIds"`
+}
+
+// value maps the admin form's field names onto the input, so the form's
+// validation rules can be applied to it
+func (in apiEventInput) value(name string) string {
+	return map[string]string{
+		"title":    in.Title,
+		"date":     in.Start,
+		"timezone": in.TimeZone,
+		"location": in.LocationID,
+		"details":  in.Details,
+		"gplus":    in.GooglePlus,
+		"hoa":      in.HangoutOnAir,
+		"capacity": optionalInt(in.Capacity),
+		"speakers": strings.Join(in.SpeakerIDs, ","),
+		"sponsors": strings.Join(in.SponsorIDs, ","),
+		"tags":     strings.Join(in.TagIDs, ","),
+	}[name]
+}
+
+// apiLearnEventInput is the body of a study group create or update request,
+// Start is read the same way as for events.  Leaving out Recurrence makes a
+// study group that meets once
+type apiLearnEventInput struct {
+	Title      string         `json:"title"`
+	Start      string         `json:"start"`
+	TimeZone   string         `json:"timeZone"`
+	LocationID string         `json:"locationId"`
+	Details    string         `json:"details"`
+	TagIDs     []string       `json:"tagIds"`
+	Recurrence *apiRecurrence `json:"recurrence"`
+}
+
+func (in apiLearnEventInput) value(name string) string {
+	values := map[string]string{
+		"title":    in.Title,
+		"date":     in.Start,
+		"timezone": in.TimeZone,
+		"location": in.LocationID,
+		"details":  in.Details,
+		"tags":     strings.Join(in.TagIDs, ","),
+	}
+	if rr := in.Recurrence; rr != nil {
+		values["repeat"] = strconv.Itoa(rr.Interval)
+		values["weekdays"] = strings.Join(rr.Weekdays, ",")
+		values["until"] = rr.Until
+		values["except"] = strings.Join(rr.Except, ",")
+	}
+
+	return values[name]
+}
+
+// apiLocationInput is the body of a location create or update request
+type apiLocationInput struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Details  string `json:"details"`
+	TimeZone string `json:"timeZone"`
+	Capacity *int   `json:"capacity"`
+}
+
+func (in apiLocationInput) value(name string) string {
+	return map[string]string{
+		"name":     in.Name,
+		"address":  in.Address,
+		"details":  in.Details,
+		"timezone": in.TimeZone,
+		"capacity": optionalInt(in.Capacity),
+	}[name]
+}
+
+// optionalInt formats n as a form value would carry it, blank if it was left
+// out
+func optionalInt(n *int) string {
+	if n == nil {
+		return ""
+	}
+
+	return strconv.Itoa(*n)
+}
+
+// decodeJSON reads the request body into v.  If it isn't valid JSON an error
+// is sent and false returned
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody)).Decode(v)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, "request body must be a JSON object: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+// Handles POST requests to /api/v1/events
+func (s *site) apiCreateEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	var in apiEventInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	g, msg := s.eventFromValues(r, in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	g, err := s.createEvent(r, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event, err := s.apiEventDetail(r, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", baseURL(r)+apiPrefix+"/events/"+g.ID)
+	writeJSON(w, http.StatusCreated, event)
+}
+
+// Handles PUT requests to /api/v1/events/:event, replacing the whole event.
+// The event's ID changes if its title does, the response says where it is now
+func (s *site) apiUpdateEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	e, err := s.backend.Events(r).Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "event not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var in apiEventInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	g, msg := s.eventFromValues(r, in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	g, err = s.updateEvent(r, e, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event, err := s.apiEventDetail(r, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, event)
+}
+
+// Handles DELETE requests to /api/v1/events/:event
+func (s *site) apiDeleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	eventID := r.URL.Query().Get(":event")
+	err := s.backend.Events(r).Delete(eventID)
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "event not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.unindex(r, "Events", eventID)
+	if err := s.dropRedirects(r, "Events", eventID); err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST requests to /api/v1/learning
+func (s *site) apiCreateLearnEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	var in apiLearnEventInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	l, msg := s.learnEventFromValues(r, in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	l, err := s.createLearnEvent(r, l)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	group, err := s.apiLearnEventDetail(r, l)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", baseURL(r)+apiPrefix+"/learning/"+l.ID)
+	writeJSON(w, http.StatusCreated, group)
+}
+
+// Handles PUT requests to /api/v1/learning/:event, replacing the whole study
+// group.  Its ID changes if its title does, the response says where it is now
+func (s *site) apiUpdateLearnEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	l, err := s.backend.LearnEvents(r).Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "study group not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var in apiLearnEventInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	g, msg := s.learnEventFromValues(r, in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	g, err = s.updateLearnEvent(r, l, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	group, err := s.apiLearnEventDetail(r, g)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, group)
+}
+
+// Handles DELETE requests to /api/v1/learning/:event
+func (s *site) apiDeleteLearnEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	groupID := r.URL.Query().Get(":event")
+	err := s.backend.LearnEvents(r).Delete(groupID)
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "study group not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.unindex(r, "LearnEvent", groupID)
+	if err := s.dropRedirects(r, "LearnEvent", groupID); err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST requests to /api/v1/locations
+func (s *site) apiCreateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	var in apiLocationInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	loc, msg := locationFromValues(in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	loc, err := s.createLocation(r, loc)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Location", baseURL(r)+apiPrefix+"/locations/"+loc.ID)
+	writeJSON(w, http.StatusCreated, newAPILocation(loc))
+}
+
+// Handles PUT requests to /api/v1/locations/:location.  Unlike events, a
+// location keeps its ID when renamed
+func (s *site) apiUpdateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	locID := r.URL.Query().Get(":location")
+	store := s.backend.Locations(r)
+	if _, err := store.Get(locID); err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "location not found")
+		return
+	} else if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var in apiLocationInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+
+	loc, msg := locationFromValues(in.value)
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	loc.ID = locID
+	if err := store.Update(locID, loc); err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.index(r, locationDoc(loc))
+	writeJSON(w, http.StatusOK, newAPILocation(loc))
+}
+
+// Handles DELETE requests to /api/v1/locations/:location.  Locations still in
+// use can't be deleted, they have to be merged from the admin area instead
+func (s *site) apiDeleteLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireToken(w, r) {
+		return
+	}
+
+	locID := r.URL.Query().Get(":location")
+	refs, err := s.locationReferences(r, locID)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if refs.InUse() {
+		apiError(w, r, http.StatusConflict, "location is still in use")
+		return
+	}
+
+	err = s.backend.Locations(r).Delete(locID)
+	if err == ErrNotFound {
+		apiError(w, r, http.StatusNotFound, "location not found")
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.unindex(r, "Locations", locID)
+	w.WriteHeader(http.StatusNoContent)
+}
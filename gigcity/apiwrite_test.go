@@ -0,0 +1,180 @@
+package gigcity
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sendJSON sends body to an API path with token as its bearer token, if
+// given, and returns the response status and body
+func (ts *testServer) sendJSON(t *testing.T, method, path, token, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+// addToken makes the owner an admin organizer and issues them an API token
+// straight into the store
+func (ts *testServer) addToken(t *testing.T) (APIToken, string) {
+	t.Helper()
+	if err := ts.Backend.Organizers(nil).Add(Organizer{ID: "owner", Name: "Owner", Email: testOwner, Admin: true}); err != nil && err != ErrExists {
+		t.Fatal(err)
+	}
+	at, token, err := newAPIToken("script", testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Backend.Tokens(nil).Add(at); err != nil {
+		t.Fatal(err)
+	}
+
+	return at, token
+}
+
+func TestAPIWriteNeedsToken(t *testing.T) {
+	ts := newTestServer(t)
+	at, token := ts.addToken(t)
+	body := `{"name": "Town Hall", "address": "1 High Street"}`
+
+	for _, bad := range []string{"", "nope", at.ID + ".nope", token + "x"} {
+		if status, _ := ts.sendJSON(t, "POST", "/api/v1/locations", bad, body); status != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want %d", bad, status, http.StatusUnauthorized)
+		}
+	}
+	if _, err := ts.Backend.Locations(nil).Get("town-hall"); err != ErrNotFound {
+		t.Fatalf("location saved without a valid token: %v", err)
+	}
+
+	if status, _ := ts.sendJSON(t, "POST", "/api/v1/locations", token, body); status != http.StatusCreated {
+		t.Fatalf("create with a token: status %d", status)
+	}
+
+	if resp := ts.submit(t, "/admin/tokens", "/admin/tokens/"+at.ID+"/revoke", nil); resp.StatusCode != http.StatusFound {
+		t.Fatalf("revoke status %d", resp.StatusCode)
+	}
+	if status, _ := ts.sendJSON(t, "DELETE", "/api/v1/locations/town-hall", token, ""); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIWriteEvent(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.addToken(t)
+	if err := ts.Backend.Locations(nil).Add(Location{ID: "town-hall", Name: "Town Hall", Address: "1 High Street"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, body := ts.sendJSON(t, "POST", "/api/v1/events", token, `{"title": "Go Night", "start": "nope", "locationId": "town-hall"}`); status != http.StatusBadRequest {
+		t.Errorf("bad start: status %d %s", status, body)
+	}
+	if status, body := ts.sendJSON(t, "POST", "/api/v1/events", token, `{"title": `); status != http.StatusBadRequest {
+		t.Errorf("bad JSON: status %d %s", status, body)
+	}
+
+	status, body := ts.sendJSON(t, "POST", "/api/v1/events", token,
+		`{"title": "Go Night", "start": "2015-03-04T18:30", "timeZone": "America/New_York", "locationId": "town-hall", "googlePlus": "https://plus.google.com/events/1", "details": "Talks"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create status %d %s", status, body)
+	}
+
+	var e apiEvent
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "go-night" || e.Start == nil || !e.Start.Equal(at("2015-03-04T23:30")) {
+		t.Errorf("created %+v", e)
+	}
+
+	status, body = ts.sendJSON(t, "PUT", "/api/v1/events/go-night", token,
+		`{"title": "Go Night Two", "start": "2015-03-04T23:30:00Z", "locationId": "town-hall", "googlePlus": "https://plus.google.com/events/1", "details": "Talks"}`)
+	if status != http.StatusOK {
+		t.Fatalf("update status %d %s", status, body)
+	}
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "go-night-two" || e.TimeZone != "America/New_York" {
+		t.Errorf("updated %+v, want it renamed in the default time zone", e)
+	}
+
+	if status, _ := ts.sendJSON(t, "DELETE", "/api/v1/events/go-night-two", token, ""); status != http.StatusNoContent {
+		t.Errorf("delete status %d", status)
+	}
+	if status, _ := ts.sendJSON(t, "DELETE", "/api/v1/events/go-night-two", token, ""); status != http.StatusNotFound {
+		t.Errorf("second delete status %d", status)
+	}
+}
+
+func TestTooLong(t *testing.T) {
+	form := map[string]string{
+		// characters are counted, not bytes
+		"title":   strings.Repeat("é", maxLineLen),
+		"details": strings.Repeat("a", maxTextLen),
+	}
+	value := func(name string) string { return form[name] }
+	if msg := tooLong(value, "event", lineField("title"), textField("details")); msg != "" {
+		t.Errorf("text at the limits refused: %s", msg)
+	}
+
+	form["details"] += "a"
+	want := "event details is 10001 characters long, it can be at most 10000"
+	if msg := tooLong(value, "event", lineField("title"), textField("details")); msg != want {
+		t.Errorf("tooLong = %q, want %q", msg, want)
+	}
+}
+
+func TestTokenOwnerLosesAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	at, token := ts.addToken(t)
+	body := `{"name": "Town Hall", "address": "1 High Street"}`
+
+	store := ts.Backend.Organizers(nil)
+	o, err := store.Get("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Admin = false
+	if err := store.Update(o.ID, o); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.sendJSON(t, "POST", "/api/v1/locations", token, body); status != http.StatusUnauthorized {
+		t.Errorf("owner without admin access: status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	o.Admin = true
+	if err := store.Update(o.ID, o); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.sendJSON(t, "POST", "/api/v1/locations", token, body); status != http.StatusCreated {
+		t.Fatalf("owner with admin access again: status %d", status)
+	}
+
+	if resp := ts.submit(t, "/admin/organizers", "/admin/organizers/owner/delete", nil); resp.StatusCode != http.StatusFound {
+		t.Fatalf("deleting the organizer = %d", resp.StatusCode)
+	}
+	if _, err := ts.Backend.Tokens(nil).Get(at.ID); err != ErrNotFound {
+		t.Errorf("token kept after its owner was deleted: %v", err)
+	}
+}
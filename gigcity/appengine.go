@@ -0,0 +1,79 @@
+//go:build appengine
+// +build appengine
+
+package gigcity
+
+import (
+	"net/http"
+	"os"
+
+	"appengine"
+	"appengine/mail"
+	"appengine/user"
+)
+
+// Under appengine our code runs as a package, not a binary.  Due to this
+// define the routes during package initilization.  Normally this wourd happen
+// with in main(), see cmd/gigcity for the standalone server
+func init() {
+	// the report key is an app setting, see README.md
+	reportKey, err := ParseReportKey(os.Getenv("GIGCITY_REPORT_KEY"))
+	if err != nil {
+		panic(err)
+	}
+
+	h, err := NewHandler(datastoreBackend{}, appengineAuth{}, appengineMailer{}, reportKey, appengine.IsDevAppServer())
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/", h)
+}
+
+// appengineAuth signs admins in with their Google account through the App
+// Engine users API
+type appengineAuth struct{}
+
+func (appengineAuth) User(r *http.Request) string {
+	// get user information if one is logged in
+	u := user.Current(appengine.NewContext(r))
+	if u == nil {
+		return ""
+	}
+
+	return u.Email
+}
+
+// Owner is true for the app's project admins
+func (appengineAuth) Owner(r *http.Request) bool {
+	return user.IsAdmin(appengine.NewContext(r))
+}
+
+func (appengineAuth) Challenge(w http.ResponseWriter, r *http.Request) {
+	// the person that made the request is anonymous, redirect them to the login
+	// page
+	url, err := user.LoginURL(appengine.NewContext(r), r.URL.String())
+	if err != nil {
+		// was unable to get a login URL, so die with a 500 error
+		logHandler("ERROR", "getting a login URL failed: "+err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// set a return URL for when authentication succeeds
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusFound)
+}
+
+// appengineMailer sends email through the App Engine mail API
+type appengineMailer struct{}
+
+func (appengineMailer) Send(r *http.Request, to, subject, body string) error {
+	c := appengine.NewContext(r)
+	// App Engine only sends mail from addresses it knows belong to the app
+	return mail.Send(c, &mail.Message{
+		Sender:  "GDG Gigcity <noreply@" + appengine.AppID(c) + ".appspotmail.com>",
+		To:      []string{to},
+		Subject: subject,
+		Body:    body,
+	})
+}
@@ -0,0 +1,178 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// listPageSize is how many events or study groups are listed per page
+const listPageSize = 12
+
+// archiveEpoch is where the archives start.  Records dated before it, like
+// ones with no date at all, are left out rather than stretching the years
+// back to year 1
+var archiveEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// startOfToday is midnight today in the chapter's time zone.  Anything from
+// then on is upcoming, so the day's meetup stays listed while it is on
+func startOfToday() time.Time {
+	now := time.Now().In(zoneOrDefault(defaultTimeZone))
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// upcomingQuery asks for the page of upcoming records named by r's cursor
+// parameter, soonest first, filed under tag if it is set
+func upcomingQuery(r *http.Request, tag Tag) RangeQuery {
+	return RangeQuery{From: startOfToday(), Limit: listPageSize, Cursor: r.URL.Query().Get("cursor"), Tag: tag.ID}
+}
+
+// listPage is what the upcoming lists and static/archive.html are rendered
+// with
+type listPage struct {
+	// Path is where the records are listed, like "/events"
+	Path string
+	// Noun names the records, like "events"
+	Noun  string
+	Items interface{}
+	// Next is the cursor of the next page, "" if this is the last
+	Next string
+	// Tag is the topic an upcoming list is filtered by, if any, and Tags are
+	// the topics it can be filtered by
+	Tag  Tag
+	Tags []Tag
+	// Year and Month narrow an archive, zero for all of them
+	Year  int
+	Month time.Month
+	// Years are those there are records from, newest first
+	Years  []int
+	Months []time.Month
+}
+
+// archiveQuery reads the year, month and cursor parameters of an archive
+// page into a query for past records since archiveEpoch, newest first.  first
+// is when the oldest archived record is, used to list the years to browse.
+// If a parameter is invalid the returned message says which
+func archiveQuery(r *http.Request, first time.Time) (listPage, RangeQuery, string) {
+	today := startOfToday()
+	zone := today.Location()
+	var p listPage
+	rq := RangeQuery{From: archiveEpoch, To: today, Desc: true, Limit: listPageSize, Cursor: r.URL.Query().Get("cursor")}
+
+	// a record from before the epoch would list every year back to it
+	if !first.IsZero() && !first.Before(archiveEpoch) {
+		for y := today.Year(); y >= first.In(zone).Year(); y-- {
+			p.Years = append(p.Years, y)
+		}
+	}
+
+	v := r.URL.Query().Get("year")
+	if v == "" {
+		return p, rq, ""
+	}
+
+	var err error
+	if p.Year, err = strconv.Atoi(v); err != nil || p.Year < archiveEpoch.Year() || p.Year > today.Year() {
+		return p, rq, fmt.Sprintf("year must be from %d to %d", archiveEpoch.Year(), today.Year())
+	}
+
+	for m := time.January; m <= time.December; m++ {
+		p.Months = append(p.Months, m)
+	}
+
+	rq.From = time.Date(p.Year, time.January, 1, 0, 0, 0, 0, zone)
+	to := rq.From.AddDate(1, 0, 0)
+	if v := r.URL.Query().Get("month"); v != "" {
+		m, err := strconv.Atoi(v)
+		if err != nil || m < 1 || m > 12 {
+			return p, rq, "month must be a number from 1 to 12"
+		}
+
+		p.Month = time.Month(m)
+		rq.From = time.Date(p.Year, p.Month, 1, 0, 0, 0, 0, zone)
+		to = rq.From.AddDate(0, 1, 0)
+	}
+
+	if to.Before(rq.To) {
+		rq.To = to
+	}
+
+	return p, rq, ""
+}
+
+// renderArchive shows an archive page
+func (s *site) renderArchive(w http.ResponseWriter, r *http.Request, p listPage) {
+	s.render(w, r, "archive", p)
+}
+
+// rangeError replies to a failed Range, a cursor that has been tampered
+// with is the visitor's fault rather than ours
+func (s *site) rangeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrBadCursor {
+		s.errorHandler(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+}
+
+// Handles requests for /events/archive, past events by year and month
+func (s *site) eventArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	events := s.backend.Events(r)
+	oldest, _, err := events.Range(RangeQuery{From: archiveEpoch, Limit: 1})
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var first time.Time
+	if len(oldest) > 0 {
+		first = oldest[0].Datetime
+	}
+
+	p, rq, msg := archiveQuery(r, first)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	past, next, err := events.Range(rq)
+	if err != nil {
+		s.rangeError(w, r, err)
+		return
+	}
+
+	p.Path, p.Noun, p.Items, p.Next = "/events", "events", past, next
+	s.renderArchive(w, r, p)
+}
+
+// Handles requests for /learning/archive, past study groups by year and month
+func (s *site) learningArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	learn := s.backend.LearnEvents(r)
+	oldest, _, err := learn.Range(RangeQuery{From: archiveEpoch, Limit: 1})
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var first time.Time
+	if len(oldest) > 0 {
+		first = oldest[0].Datetime
+	}
+
+	p, rq, msg := archiveQuery(r, first)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	past, next, err := learn.Range(rq)
+	if err != nil {
+		s.rangeError(w, r, err)
+		return
+	}
+
+	p.Path, p.Noun, p.Items, p.Next = "/learning", "study groups", past, next
+	s.renderArchive(w, r, p)
+}
@@ -0,0 +1,54 @@
+package gigcity
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	ts := newTestServer(t)
+	for _, e := range []Event{
+		{ID: "last-year", Title: "Old Go Night", Datetime: at("2015-03-04T23:30")},
+		{ID: "next-week", Title: "New Go Night", Datetime: time.Now().AddDate(0, 0, 7)},
+		{ID: "undated", Title: "Undated Go Night"},
+	} {
+		if err := ts.Backend.Events(nil).Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path      string
+		status    int
+		has, lack string
+	}{
+		{"/events", http.StatusOK, "/events/next-week", "/events/last-year"},
+		{"/events/archive", http.StatusOK, "/events/last-year", "/events/next-week"},
+		{"/events/archive", http.StatusOK, "/events/archive?year=2015", "/events/archive?year=1999"},
+		{"/events/archive", http.StatusOK, "", "/events/undated"},
+		{"/events/archive?year=2015", http.StatusOK, "/events/last-year", ""},
+		{"/events/archive?year=2015&month=3", http.StatusOK, "/events/last-year", ""},
+		{"/events/archive?year=2015&month=4", http.StatusOK, "", "/events/last-year"},
+		{"/events/archive?year=2014", http.StatusOK, "", "/events/last-year"},
+		{"/events/archive?year=x", http.StatusBadRequest, "", ""},
+		{"/events/archive?year=1", http.StatusBadRequest, "", ""},
+		{"/events/archive?year=3000", http.StatusBadRequest, "", ""},
+		{"/events/archive?year=2015&month=13", http.StatusBadRequest, "", ""},
+		{"/events/archive?cursor=nope", http.StatusBadRequest, "", ""},
+		{"/learning/archive", http.StatusOK, "", ""},
+	} {
+		resp, body := ts.request(t, "GET", tt.path, nil, false)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.has != "" && !strings.Contains(body, `href="`+tt.has+`"`) {
+			t.Errorf("%s doesn't link to %s", tt.path, tt.has)
+		}
+		if tt.lack != "" && strings.Contains(body, `href="`+tt.lack+`"`) {
+			t.Errorf("%s links to %s", tt.path, tt.lack)
+		}
+	}
+}
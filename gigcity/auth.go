@@ -0,0 +1,91 @@
+package gigcity
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+// Authenticator decides who is signed in to the admin area
+type Authenticator interface {
+	// User returns the identity (normally an email address) of the signed in
+	// admin, or "" if the request is anonymous
+	User(r *http.Request) string
+	// Owner reports whether the signed in user owns the deployment.  Owners
+	// are always let into the admin area, so they can set up the organizers
+	// and can't be locked out by them
+	Owner(r *http.Request) bool
+	// Challenge asks an anonymous visitor to sign in
+	Challenge(w http.ResponseWriter, r *http.Request)
+}
+
+// requireAdmin reports whether the request came from a signed in admin, that
+// is an owner or an organizer with admin access.  If not, the visitor is asked
+// to sign in, or turned away if they already have, and the caller should stop
+// handling the request.  Requests that change anything must also pass
+// checkCSRF
+func (s *site) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user := s.auth.User(r)
+	if user == "" {
+		s.auth.Challenge(w, r)
+		return false
+	}
+
+	if s.auth.Owner(r) {
+		return checkCSRF(w, r)
+	}
+
+	admin, err := s.adminOrganizer(r, user)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if admin {
+		return checkCSRF(w, r)
+	}
+
+	logHandler("WARN", fmt.Sprintf("%s is not an organizer with admin access, refused %s", user, r.URL.Path))
+	http.Error(w, "You are signed in as "+user+", who is not an organizer with admin access.", http.StatusForbidden)
+	return false
+}
+
+// BasicAuth returns an Authenticator that accepts a single admin account over
+// HTTP basic auth, who is the owner.  An empty password locks the admin area
+// entirely
+func BasicAuth(username, password string) Authenticator {
+	return basicAuth{username, password}
+}
+
+type basicAuth struct {
+	username, password string
+}
+
+func (a basicAuth) User(r *http.Request) string {
+	if a.password == "" {
+		return ""
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+
+	// compare in constant time so the credentials can't be guessed by timing
+	// the response
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+	if !userOK || !passOK {
+		return ""
+	}
+
+	return username
+}
+
+func (a basicAuth) Owner(r *http.Request) bool {
+	return a.User(r) != ""
+}
+
+func (a basicAuth) Challenge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="GDG Gigcity admin"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
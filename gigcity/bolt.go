@@ -0,0 +1,125 @@
+//go:build !appengine
+// +build !appengine
+
+package gigcity
+
+import (
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// BoltBackend is a Backend stored in a local BoltDB file, used by the
+// standalone server
+type BoltBackend struct {
+	kvBackend
+	db *bolt.DB
+}
+
+// OpenBolt opens (creating if needed) the BoltDB file at path
+func OpenBolt(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltBackend{kvBackend{boltKV{db}, new(sync.Mutex)}, db}, nil
+}
+
+// Close releases the database file
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltKV implements kv with one BoltDB bucket per entity kind
+type boltKV struct {
+	db *bolt.DB
+}
+
+func (k boltKV) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := k.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		// bolt values are only valid for the life of the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+
+	return value, err
+}
+
+func (k boltKV) Put(bucket, key string, value []byte) error {
+	return k.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (k boltKV) PutNew(bucket, key string, value []byte) error {
+	return k.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		if b.Get([]byte(key)) != nil {
+			return ErrExists
+		}
+
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (k boltKV) Delete(bucket, key string) error {
+	return k.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+func (k boltKV) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	// copy the records out first, fn may want to write to the database and
+	// bolt doesn't allow that while a read transaction is open
+	var keys []string
+	var values [][]byte
+	err := k.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, append([]byte(nil), v...))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
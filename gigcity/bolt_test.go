@@ -0,0 +1,40 @@
+//go:build !appengine
+// +build !appengine
+
+package gigcity
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltKeepsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gigcity.db")
+	b, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Events(nil).Add(Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-03-04T18:30")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	e, err := b.Events(nil).Get("go-night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Title != "Go Night" {
+		t.Errorf("reopened database has %+v", e)
+	}
+	if _, err := b.Events(nil).Get("nope"); err != ErrNotFound {
+		t.Errorf("Get of a missing event = %v, want ErrNotFound", err)
+	}
+}
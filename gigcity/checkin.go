@@ -0,0 +1,389 @@
+package gigcity
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// ticketSecret names the SecretStore key tickets are signed with
+const ticketSecret = "tickets"
+
+// ticketCode returns the code in the QR ticket for RSVP v at e, the RSVP's ID
+// and a signature over it joined by a dot.  The signature ties the ticket to
+// the event, so a ticket can't be used at another one
+func (s *site) ticketCode(r *http.Request, e Event, v RSVP) (string, error) {
+	sig, err := s.ticketSignature(r, e, v.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return v.ID + "." + sig, nil
+}
+
+func (s *site) ticketSignature(r *http.Request, e Event, rsvpID string) (string, error) {
+	key, err := s.backend.Secrets(r).Key(ticketSecret)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(e.CalendarUID() + "/" + rsvpID))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// verifyTicket checks a scanned ticket code for e, returning the ID of the
+// RSVP it was issued for.  ok is false if the code is malformed, forged or
+// for another event
+func (s *site) verifyTicket(r *http.Request, e Event, code string) (rsvpID string, ok bool, err error) {
+	parts := strings.SplitN(strings.TrimSpace(code), ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false, nil
+	}
+
+	want, err := s.ticketSignature(r, e, parts[0])
+	if err != nil {
+		return "", false, err
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(parts[1])), []byte(want)) {
+		return "", false, nil
+	}
+
+	return parts[0], true, nil
+}
+
+// qrSVG draws text as a QR code, for inlining in a page
+func qrSVG(text string) (template.HTML, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	// scanners need a blank border four modules wide around the code
+	const quiet = 4
+	size := code.Size + 2*quiet
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="256" height="256" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+
+	return template.HTML(svg.String()), nil
+}
+
+// ticketURL is the absolute link to an attendee's QR ticket
+func ticketURL(r *http.Request, eventID, rsvpID string) string {
+	return rsvpURL(r, eventID, rsvpID) + "/ticket"
+}
+
+// sendTicket emails a visitor the link to their ticket once their seat is
+// confirmed
+func (s *site) sendTicket(r *http.Request, e Event, v RSVP) error {
+	body := fmt.Sprintf(`Hi %s,
+
+Your seat at %s on %s is confirmed.
+
+Your ticket is at the link below.  Please have its QR code ready on your
+phone or printed out when you arrive, it makes checking in quicker:
+
+%s
+
+If you can no longer make it, please give your seat up here so someone on
+the waitlist can have it:
+
+%s
+
+GDG Gigcity
+`, v.Name, e.Title, e.When(), ticketURL(r, e.ID, v.ID), rsvpURL(r, e.ID, v.ID))
+
+	return s.mail.Send(r, v.Email, "Your ticket for "+e.Title, body)
+}
+
+// Handles requests to /events/:event/rsvp/:rsvp/ticket.  Only RSVPs holding a
+// confirmed seat have a ticket, anyone else is sent to their RSVP page
+func (s *site) ticketHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Event Event
+		RSVP  RSVP
+		Code  string
+		QR    template.HTML
+	}
+
+	rsvpID := r.URL.Query().Get(":rsvp")
+	e, ok := s.rsvpEvent(w, r, "/rsvp/"+rsvpID+"/ticket")
+	if !ok {
+		return
+	}
+
+	v, err := s.backend.RSVPs(r).Get(e.ID, rsvpID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if v.Status != rsvpConfirmed || v.Waitlisted {
+		http.Redirect(w, r, "/events/"+e.ID+"/rsvp/"+v.ID, http.StatusFound)
+		return
+	}
+
+	code, err := s.ticketCode(r, e, v)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	img, err := qrSVG(code)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "ticket", Content{e, v, code, img})
+}
+
+// checkinCounts is how many people have arrived out of those expected, the
+// check-in page polls for it
+type checkinCounts struct {
+	CheckedIn int `json:"checkedIn"`
+	Expected  int `json:"expected"`
+	WalkIns   int `json:"walkIns"`
+}
+
+func countCheckins(rsvps []RSVP) checkinCounts {
+	var c checkinCounts
+	for _, v := range rsvps {
+		if !v.Active() {
+			continue
+		}
+
+		if v.Holding() && !v.Waitlisted {
+			c.Expected++
+		}
+		if !v.CheckedIn.IsZero() {
+			c.CheckedIn++
+		}
+		if v.WalkIn {
+			c.WalkIns++
+		}
+	}
+
+	return c
+}
+
+// checkinRow is an RSVP on the check-in page, with its arrival time in the
+// event's time zone
+type checkinRow struct {
+	RSVP
+	Arrived string
+}
+
+// rsvpsByCheckIn sorts RSVPs most recently arrived first
+type rsvpsByCheckIn []RSVP
+
+func (v rsvpsByCheckIn) Len() int           { return len(v) }
+func (v rsvpsByCheckIn) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v rsvpsByCheckIn) Less(i, j int) bool { return v[i].CheckedIn.After(v[j].CheckedIn) }
+
+// checkIn marks the RSVP with the given ID at e as arrived.  force lets an
+// organizer admit someone still on the waitlist, who then takes a seat.  The
+// returned message says what happened, it is an error message if ok is false
+func (s *site) checkIn(r *http.Request, e Event, rsvpID string, force bool) (msg string, ok bool, err error) {
+	err = s.backend.RSVPs(r).Atomically(e.ID, func(store RSVPStore) error {
+		v, err := store.Get(e.ID, rsvpID)
+		if err == ErrNotFound {
+			msg, ok = "No RSVP was found for that ticket.", false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !v.Active():
+			msg, ok = v.Name+"'s RSVP was cancelled, register them as a walk-in instead.", false
+			return nil
+		case !v.CheckedIn.IsZero():
+			msg = fmt.Sprintf("%s already checked in at %s.", v.Name, v.CheckedIn.In(zoneOrDefault(e.TimeZone)).Format(clockLayout))
+			ok = false
+			return nil
+		case v.Waitlisted && !force:
+			msg, ok = v.Name+" is still on the waitlist.", false
+			return nil
+		}
+
+		v.Waitlisted = false
+		v.CheckedIn = time.Now().UTC()
+		v.Updated = v.CheckedIn
+		msg, ok = v.Name+" is checked in.", true
+		return store.Update(e.ID, v)
+	})
+
+	return msg, ok, err
+}
+
+// walkIn registers someone who turned up without an RSVP and checks them in
+func (s *site) walkIn(r *http.Request, e Event, name, email string) error {
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	v := RSVP{
+		ID:        id,
+		Name:      name,
+		Email:     email,
+		Status:    rsvpConfirmed,
+		WalkIn:    true,
+		CheckedIn: now,
+		Created:   now,
+		Updated:   now,
+	}
+
+	return s.backend.RSVPs(r).Atomically(e.ID, func(store RSVPStore) error {
+		return store.Add(e.ID, v)
+	})
+}
+
+// Handles requests to /admin/events/:event/checkin.  GET shows the page, with
+// attendees matching ?q= if a name was searched for.  POST checks someone in
+// by a scanned ticket, by the RSVP ID picked from a search or as a walk-in
+func (s *site) checkinHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Event   Event
+		Counts  checkinCounts
+		Query   string
+		Results []checkinRow
+		Recent  []checkinRow
+		Message string
+		Error   string
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, ok := s.adminEvent(w, r)
+	if !ok {
+		return
+	}
+
+	context := Content{Event: e, Query: strings.TrimSpace(r.FormValue("q"))}
+	if r.Method == "POST" {
+		var msg string
+		var err error
+		ok := true
+		switch {
+		case r.FormValue("ticket") != "":
+			var rsvpID string
+			rsvpID, ok, err = s.verifyTicket(r, e, r.FormValue("ticket"))
+			if err == nil && !ok {
+				msg = "That isn't a valid ticket for this event."
+			} else if err == nil {
+				msg, ok, err = s.checkIn(r, e, rsvpID, false)
+			}
+		case r.FormValue("rsvp") != "":
+			msg, ok, err = s.checkIn(r, e, r.FormValue("rsvp"), r.FormValue("force") != "")
+		default:
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				msg, ok = "A walk-in needs a name.", false
+				break
+			}
+
+			err = s.walkIn(r, e, name, strings.TrimSpace(r.FormValue("email")))
+			msg = name + " is registered as a walk-in and checked in."
+		}
+
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if ok {
+			context.Message = msg
+		} else {
+			context.Error = msg
+		}
+	}
+
+	rsvps, err := s.backend.RSVPs(r).List(e.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	context.Counts = countCheckins(rsvps)
+
+	row := func(v RSVP) checkinRow {
+		arrived := ""
+		if !v.CheckedIn.IsZero() {
+			arrived = v.CheckedIn.In(zoneOrDefault(e.TimeZone)).Format(clockLayout)
+		}
+		return checkinRow{v, arrived}
+	}
+
+	if context.Query != "" {
+		q := strings.ToLower(context.Query)
+		for _, v := range rsvps {
+			if v.Active() && (strings.Contains(strings.ToLower(v.Name), q) || strings.Contains(strings.ToLower(v.Email), q)) {
+				context.Results = append(context.Results, row(v))
+			}
+		}
+	}
+
+	sort.Sort(rsvpsByCheckIn(rsvps))
+	for _, v := range rsvps {
+		if v.CheckedIn.IsZero() || len(context.Recent) == 10 {
+			break
+		}
+		context.Recent = append(context.Recent, row(v))
+	}
+
+	s.render(w, r, "admin/checkin", context)
+}
+
+// Handles requests to /admin/events/:event/checkin/count, polled by the
+// check-in page so every door shows the same count
+func (s *site) checkinCountHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, ok := s.adminEvent(w, r)
+	if !ok {
+		return
+	}
+
+	rsvps, err := s.backend.RSVPs(r).List(e.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(countCheckins(rsvps)); err != nil {
+		logHandler("ERROR", "writing check-in count failed: "+err.Error())
+	}
+}
@@ -0,0 +1,67 @@
+package gigcity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyTicket(t *testing.T) {
+	s := &site{backend: newMemoryBackend()}
+	e := Event{ID: "go-night", UID: "events-go-night@example.com"}
+	code, err := s.ticketCode(nil, e, RSVP{ID: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, sig := code[:strings.Index(code, ".")], code[strings.Index(code, ".")+1:]
+	if id != "abc123" {
+		t.Fatalf("ticket code %q doesn't start with the RSVP's ID", code)
+	}
+
+	for _, tt := range []struct {
+		name, code string
+		ok         bool
+	}{
+		{"issued", code, true},
+		{"scanned with white space", " " + code + "\n", true},
+		{"upper case", id + "." + strings.ToUpper(sig), true},
+		{"another RSVP", "abc124." + sig, false},
+		{"tampered", id + "." + strings.Repeat("0", len(sig)), false},
+		{"truncated", id + "." + sig[:len(sig)-1], false},
+		{"no signature", id, false},
+		{"no ID", "." + sig, false},
+		{"empty", "", false},
+	} {
+		got, ok, err := s.verifyTicket(nil, e, tt.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok || (ok && got != id) {
+			t.Errorf("%s ticket: verifyTicket = %q, %v, want ok %v", tt.name, got, ok, tt.ok)
+		}
+	}
+
+	// tickets are tied to the event, and renaming it keeps its UID
+	if _, ok, _ := s.verifyTicket(nil, Event{ID: "other", UID: "events-other@example.com"}, code); ok {
+		t.Error("ticket was accepted at another event")
+	}
+	if _, ok, _ := s.verifyTicket(nil, Event{ID: "go-night-renamed", UID: e.UID}, code); !ok {
+		t.Error("ticket was refused after the event was renamed")
+	}
+
+	// and to the site's secret key
+	other := &site{backend: newMemoryBackend()}
+	if _, ok, _ := other.verifyTicket(nil, e, code); ok {
+		t.Error("ticket was accepted by a site with another key")
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	svg, err := qrSVG("abc123.0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(svg), "<svg ") || !strings.HasSuffix(string(svg), "</svg>") {
+		t.Errorf("qrSVG gave %q", svg)
+	}
+}
@@ -0,0 +1,94 @@
+package gigcity
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// csrfCookie holds the browser's CSRF token for the admin area.  It has no
+	// expiry, so a new token is started with every browser session
+	csrfCookie = "gigcity_csrf"
+	// csrfParam is the form field, or with "X-" in front the header, admin
+	// forms send the token back in
+	csrfParam = "csrf-token"
+)
+
+// csrfToken returns the browser's CSRF token, starting a new one if it
+// doesn't have one yet
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return c.Value, nil
+	}
+
+	token, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/admin",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+	return token, nil
+}
+
+// csrfField returns the hidden input admin forms carry token in, for the
+// csrfField template function
+func csrfField(token string) func() template.HTML {
+	return func() template.HTML {
+		return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfParam, token))
+	}
+}
+
+// sameOrigin reports whether r says it was sent from one of the site's own
+// pages.  Browsers send Origin with every POST, Referer is checked when it is
+// stripped; a request with neither is left to the token check
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	if from == "" {
+		return true
+	}
+
+	u, err := url.Parse(from)
+	return err == nil && u.Host == r.Host
+}
+
+// checkCSRF reports whether a request that changes anything came from the
+// admin area's own forms, rather than another site posting with a signed in
+// admin's credentials.  If not, it is refused and the caller should stop
+// handling the request.  Reads are always let through
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+
+	if !sameOrigin(r) {
+		logHandler("WARN", fmt.Sprintf("refused %s to %s from another site", r.Method, r.URL.Path))
+		http.Error(w, "The request came from another site.", http.StatusForbidden)
+		return false
+	}
+
+	sent := r.Header.Get("X-" + csrfParam)
+	if sent == "" {
+		sent = r.FormValue(csrfParam)
+	}
+
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(c.Value)) != 1 {
+		logHandler("WARN", fmt.Sprintf("refused %s to %s without a valid CSRF token", r.Method, r.URL.Path))
+		http.Error(w, "The form has expired, go back, reload the page and try again.", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,1439 @@
+//go:build appengine
+// +build appengine
+
+package gigcity
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/search"
+)
+
+// datastoreBackend stores records in the App Engine datastore
+type datastoreBackend struct{}
+
+func (datastoreBackend) Events(r *http.Request) EventStore {
+	return datastoreEvents{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) LearnEvents(r *http.Request) LearnEventStore {
+	return datastoreLearnEvents{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Locations(r *http.Request) LocationStore {
+	return datastoreLocations{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Speakers(r *http.Request) SpeakerStore {
+	return datastoreSpeakers{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Sponsors(r *http.Request) SponsorStore {
+	return datastoreSponsors{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Tags(r *http.Request) TagStore {
+	return datastoreTags{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Organizers(r *http.Request) OrganizerStore {
+	return datastoreOrganizers{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Redirects(r *http.Request) RedirectStore {
+	return datastoreRedirects{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Tokens(r *http.Request) TokenStore {
+	return datastoreTokens{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) RSVPs(r *http.Request) RSVPStore {
+	return datastoreRSVPs{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Sessions(r *http.Request) SessionStore {
+	return datastoreSessions{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Reports(r *http.Request) ReportStore {
+	return datastoreReports{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Audit(r *http.Request) AuditStore {
+	return datastoreAudit{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Search(r *http.Request) SearchIndex {
+	return datastoreSearch{appengine.NewContext(r)}
+}
+
+func (datastoreBackend) Secrets(r *http.Request) SecretStore {
+	return datastoreSecrets{appengine.NewContext(r)}
+}
+
+// Fetches the next index key out of the datastore for the Events entity
+func eventList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Events", "default_eventlist", 0, nil)
+}
+
+func learnList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "LearnEvent", "default_learneventlist", 0, nil)
+}
+
+// Fetches the next key out of the datastore for the Locations entity
+func locationList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Locations", "default_locationlist", 0, nil)
+}
+
+func speakerList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Speakers", "default_speakerlist", 0, nil)
+}
+
+func sponsorList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Sponsors", "default_sponsorlist", 0, nil)
+}
+
+func tagList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Tags", "default_taglist", 0, nil)
+}
+
+func organizerList(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Organizers", "default_organizerlist", 0, nil)
+}
+
+// getByID runs q, which should be filtered on ID, and loads the match into
+// dst.  Returns ErrNotFound if nothing matched, or ErrDuplicateID if more
+// than one record did
+func getByID(c appengine.Context, q *datastore.Query, dst interface{}) (*datastore.Key, error) {
+	var key *datastore.Key
+	t := q.Limit(2).Run(c)
+	for {
+		k, err := t.Next(dst)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			return nil, ErrDuplicateID
+		}
+
+		key = k
+	}
+
+	if key == nil {
+		return nil, ErrNotFound
+	}
+
+	return key, nil
+}
+
+// idTaken reports whether a record of kind in parent's entity group has the
+// given ID.  It is an ancestor query, so it can run inside a transaction
+func idTaken(c appengine.Context, kind string, parent *datastore.Key, id string) (bool, error) {
+	n, err := datastore.NewQuery(kind).Ancestor(parent).Filter("ID =", id).KeysOnly().Count(c)
+	return n > 0, err
+}
+
+// addUnique saves src, the new record of kind with the given ID, under
+// parent.  Checking the ID is free and saving share a transaction, so two
+// requests can't both claim it.  saved, if not nil, is run in the transaction
+// with the new key, to write the record's child entities
+func addUnique(c appengine.Context, kind string, parent *datastore.Key, id string, src interface{}, saved func(tc appengine.Context, key *datastore.Key) error) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		taken, err := idTaken(tc, kind, parent, id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrExists
+		}
+
+		key, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, kind, parent), src)
+		if err != nil || saved == nil {
+			return err
+		}
+
+		return saved(tc, key)
+	}, nil)
+}
+
+// updateUnique overwrites the record of kind with ID id under parent with src,
+// whose ID is newID.  Like addUnique, a rename onto a taken ID is refused with
+// ErrExists in the same transaction as the write, and saved is run in it
+func updateUnique(c appengine.Context, kind string, parent *datastore.Key, id, newID string, src interface{}, saved func(tc appengine.Context, key *datastore.Key) error) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		keys, err := datastore.NewQuery(kind).Ancestor(parent).Filter("ID =", id).KeysOnly().GetAll(tc, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return ErrNotFound
+		}
+		if len(keys) > 1 {
+			return ErrDuplicateID
+		}
+
+		if newID != id {
+			taken, err := idTaken(tc, kind, parent, newID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrExists
+			}
+		}
+
+		// write back to the same key so the record keeps its place, and its
+		// child entities
+		key, err := datastore.Put(tc, keys[0], src)
+		if err != nil || saved == nil {
+			return err
+		}
+
+		return saved(tc, key)
+	}, nil)
+}
+
+type datastoreEvents struct {
+	c appengine.Context
+}
+
+func (s datastoreEvents) List(limit int) ([]Event, error) {
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Order("-Datetime")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var events []Event
+	if _, err := q.GetAll(s.c, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s datastoreEvents) Range(q RangeQuery) ([]Event, string, error) {
+	dq, err := rangeQuery(datastore.NewQuery("Events").Ancestor(eventList(s.c)), q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var events []Event
+	next, err := runRange(s.c, dq, q.Limit, func(t *datastore.Iterator) error {
+		var e Event
+		if _, err := t.Next(&e); err != nil {
+			return err
+		}
+
+		events = append(events, e)
+		return nil
+	})
+	return events, next, err
+}
+
+// rangeQuery narrows q, a query on a kind with a Datetime property, to the
+// page rq asks for.  One more record than the page holds is asked for, so
+// runRange can tell whether there is a next page
+func rangeQuery(q *datastore.Query, rq RangeQuery) (*datastore.Query, error) {
+	if rq.Tag != "" {
+		q = q.Filter("TagIDs =", rq.Tag)
+	}
+	if !rq.From.IsZero() {
+		q = q.Filter("Datetime >=", rq.From)
+	}
+	if !rq.To.IsZero() {
+		q = q.Filter("Datetime <", rq.To)
+	}
+
+	if rq.Desc {
+		q = q.Order("-Datetime")
+	} else {
+		q = q.Order("Datetime")
+	}
+
+	if rq.Cursor != "" {
+		c, err := datastore.DecodeCursor(rq.Cursor)
+		if err != nil {
+			return nil, ErrBadCursor
+		}
+		q = q.Start(c)
+	}
+
+	return q.Limit(rq.Limit + 1), nil
+}
+
+// runRange calls next for up to limit records of q, then returns the cursor
+// after them if q has any more
+func runRange(c appengine.Context, q *datastore.Query, limit int, next func(*datastore.Iterator) error) (string, error) {
+	t := q.Run(c)
+	for i := 0; i < limit; i++ {
+		err := next(t)
+		if err == datastore.Done {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return "", err
+	}
+
+	var peek datastore.PropertyList
+	if _, err := t.Next(&peek); err == datastore.Done {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return cursor.String(), nil
+}
+
+func (s datastoreEvents) Get(id string) (Event, error) {
+	var e Event
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &e)
+	return e, err
+}
+
+func (s datastoreEvents) Add(e Event) error {
+	return addUnique(s.c, "Events", eventList(s.c), e.ID, &e, nil)
+}
+
+// key looks up the datastore key of the event with the given ID
+func (s datastoreEvents) key(id string) (*datastore.Key, error) {
+	var e Event
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &e)
+}
+
+func (s datastoreEvents) Update(id string, e Event) error {
+	return updateUnique(s.c, "Events", eventList(s.c), id, e.ID, &e, nil)
+}
+
+func (s datastoreEvents) Delete(id string) error {
+	// take the event's RSVPs and sessions with it, in one transaction so an
+	// RSVP can't be left behind without its event
+	return datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		key, err := datastoreEvents{tc}.key(id)
+		if err != nil {
+			return err
+		}
+
+		for _, kind := range []string{"RSVP", "Session"} {
+			children, err := datastore.NewQuery(kind).Ancestor(key).KeysOnly().GetAll(tc, nil)
+			if err != nil {
+				return err
+			}
+			if err := deleteKeys(tc, children); err != nil {
+				return err
+			}
+		}
+
+		return datastore.Delete(tc, key)
+	}, nil)
+}
+
+func (s datastoreEvents) ByLocation(locID string) ([]Event, error) {
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("LocID =", locID)
+	var events []Event
+	if _, err := q.GetAll(s.c, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// BySpeaker relies on an equality filter on a list property matching any of
+// its values
+func (s datastoreEvents) BySpeaker(speakerID string) ([]Event, error) {
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("SpeakerIDs =", speakerID)
+	var events []Event
+	if _, err := q.GetAll(s.c, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s datastoreEvents) BySponsor(sponsorID string) ([]Event, error) {
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("SponsorIDs =", sponsorID)
+	var events []Event
+	if _, err := q.GetAll(s.c, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s datastoreEvents) ByTag(tagID string) ([]Event, error) {
+	q := datastore.NewQuery("Events").Ancestor(eventList(s.c)).Filter("TagIDs =", tagID)
+	var events []Event
+	if _, err := q.GetAll(s.c, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+type datastoreLearnEvents struct {
+	c appengine.Context
+}
+
+func (s datastoreLearnEvents) List(limit int) ([]LearnEvent, error) {
+	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var learn []LearnEvent
+	if _, err := q.GetAll(s.c, &learn); err != nil {
+		return nil, err
+	}
+
+	return learn, nil
+}
+
+// datastoreMeeting is a meeting of a study group, stored as a child of the
+// study group's entity whenever it is saved, so Range can page through
+// meetings with a cursor like it does events.  Cancelled meetings aren't
+// stored
+type datastoreMeeting struct {
+	// Date names the meeting, see Occurrence.Date
+	Date     string
+	Datetime time.Time
+	TagIDs   []string
+}
+
+// putMeetings replaces the stored meetings of l, whose entity is key.  It
+// runs in the transaction saving l
+func putMeetings(c appengine.Context, key *datastore.Key, l LearnEvent) error {
+	old, err := datastore.NewQuery("Meeting").Ancestor(key).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	var keys []*datastore.Key
+	var meetings []datastoreMeeting
+	kept := make(map[int64]bool)
+	for i, o := range l.Occurrences() {
+		if o.Cancelled {
+			continue
+		}
+
+		keys = append(keys, datastore.NewKey(c, "Meeting", "", int64(i+1), key))
+		meetings = append(meetings, datastoreMeeting{Date: o.Date, Datetime: o.Datetime, TagIDs: l.TagIDs})
+		kept[int64(i+1)] = true
+	}
+
+	// meetings that are written again are overwritten, the rest are deleted
+	var gone []*datastore.Key
+	for _, k := range old {
+		if !kept[k.IntID()] {
+			gone = append(gone, k)
+		}
+	}
+
+	for len(keys) > 0 {
+		n := batch(len(keys))
+		if _, err := datastore.PutMulti(c, keys[:n], meetings[:n]); err != nil {
+			return err
+		}
+		keys, meetings = keys[n:], meetings[n:]
+	}
+
+	return deleteKeys(c, gone)
+}
+
+// batch is how many of n entities the next PutMulti or DeleteMulti may take
+func batch(n int) int {
+	const maxBatch = 500
+	if n > maxBatch {
+		return maxBatch
+	}
+
+	return n
+}
+
+// deleteKeys deletes every entity in keys, in batches
+func deleteKeys(c appengine.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := batch(len(keys))
+		if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// Range queries the stored meetings a page at a time, then fetches their
+// study groups to fill them in
+func (s datastoreLearnEvents) Range(q RangeQuery) ([]Occurrence, string, error) {
+	dq, err := rangeQuery(datastore.NewQuery("Meeting").Ancestor(learnList(s.c)), q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var dates []string
+	var groups []*datastore.Key
+	next, err := runRange(s.c, dq, q.Limit, func(t *datastore.Iterator) error {
+		var m datastoreMeeting
+		key, err := t.Next(&m)
+		if err != nil {
+			return err
+		}
+
+		dates = append(dates, m.Date)
+		groups = append(groups, key.Parent())
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	learn := make([]LearnEvent, len(groups))
+	if err := datastore.GetMulti(s.c, groups, learn); err != nil {
+		return nil, "", err
+	}
+
+	var occurrences []Occurrence
+	for i, l := range learn {
+		if dates[i] == "" {
+			occurrences = append(occurrences, Occurrence{LearnEvent: l})
+			continue
+		}
+
+		o, err := l.Occurrence(dates[i])
+		if err != nil {
+			// the study group changed since the query ran
+			continue
+		}
+		occurrences = append(occurrences, o)
+	}
+
+	return occurrences, next, nil
+}
+
+func (s datastoreLearnEvents) Get(id string) (LearnEvent, error) {
+	var l LearnEvent
+	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &l)
+	return l, err
+}
+
+func (s datastoreLearnEvents) Add(l LearnEvent) error {
+	return addUnique(s.c, "LearnEvent", learnList(s.c), l.ID, &l, func(tc appengine.Context, key *datastore.Key) error {
+		return putMeetings(tc, key, l)
+	})
+}
+
+// key looks up the datastore key of the study group with the given ID
+func (s datastoreLearnEvents) key(id string) (*datastore.Key, error) {
+	var l LearnEvent
+	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &l)
+}
+
+func (s datastoreLearnEvents) Update(id string, l LearnEvent) error {
+	return updateUnique(s.c, "LearnEvent", learnList(s.c), id, l.ID, &l, func(tc appengine.Context, key *datastore.Key) error {
+		return putMeetings(tc, key, l)
+	})
+}
+
+func (s datastoreLearnEvents) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	// the study group goes with its meetings
+	return datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		meetings, err := datastore.NewQuery("Meeting").Ancestor(key).KeysOnly().GetAll(tc, nil)
+		if err != nil {
+			return err
+		}
+
+		return deleteKeys(tc, append(meetings, key))
+	}, nil)
+}
+
+func (s datastoreLearnEvents) ByLocation(locID string) ([]LearnEvent, error) {
+	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(s.c)).Filter("LocID =", locID)
+	var learn []LearnEvent
+	if _, err := q.GetAll(s.c, &learn); err != nil {
+		return nil, err
+	}
+
+	return learn, nil
+}
+
+func (s datastoreLearnEvents) ByTag(tagID string) ([]LearnEvent, error) {
+	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(s.c)).Filter("TagIDs =", tagID)
+	var learn []LearnEvent
+	if _, err := q.GetAll(s.c, &learn); err != nil {
+		return nil, err
+	}
+
+	return learn, nil
+}
+
+type datastoreLocations struct {
+	c appengine.Context
+}
+
+func (s datastoreLocations) List(limit int) ([]Location, error) {
+	q := datastore.NewQuery("Locations").Ancestor(locationList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var locations []Location
+	if _, err := q.GetAll(s.c, &locations); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
+
+func (s datastoreLocations) Get(id string) (Location, error) {
+	var l Location
+	q := datastore.NewQuery("Locations").Ancestor(locationList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &l)
+	return l, err
+}
+
+func (s datastoreLocations) Add(l Location) error {
+	return addUnique(s.c, "Locations", locationList(s.c), l.ID, &l, nil)
+}
+
+// key looks up the datastore key of the location with the given ID
+func (s datastoreLocations) key(id string) (*datastore.Key, error) {
+	var l Location
+	q := datastore.NewQuery("Locations").Ancestor(locationList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &l)
+}
+
+func (s datastoreLocations) Update(id string, l Location) error {
+	return updateUnique(s.c, "Locations", locationList(s.c), id, l.ID, &l, nil)
+}
+
+func (s datastoreLocations) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+type datastoreSpeakers struct {
+	c appengine.Context
+}
+
+func (s datastoreSpeakers) List(limit int) ([]Speaker, error) {
+	q := datastore.NewQuery("Speakers").Ancestor(speakerList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var speakers []Speaker
+	if _, err := q.GetAll(s.c, &speakers); err != nil {
+		return nil, err
+	}
+
+	return speakers, nil
+}
+
+func (s datastoreSpeakers) Get(id string) (Speaker, error) {
+	var sp Speaker
+	q := datastore.NewQuery("Speakers").Ancestor(speakerList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &sp)
+	return sp, err
+}
+
+func (s datastoreSpeakers) Add(sp Speaker) error {
+	return addUnique(s.c, "Speakers", speakerList(s.c), sp.ID, &sp, nil)
+}
+
+// key looks up the datastore key of the speaker with the given ID
+func (s datastoreSpeakers) key(id string) (*datastore.Key, error) {
+	var sp Speaker
+	q := datastore.NewQuery("Speakers").Ancestor(speakerList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &sp)
+}
+
+func (s datastoreSpeakers) Update(id string, sp Speaker) error {
+	return updateUnique(s.c, "Speakers", speakerList(s.c), id, sp.ID, &sp, nil)
+}
+
+func (s datastoreSpeakers) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+type datastoreSponsors struct {
+	c appengine.Context
+}
+
+func (s datastoreSponsors) List(limit int) ([]Sponsor, error) {
+	q := datastore.NewQuery("Sponsors").Ancestor(sponsorList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var sponsors []Sponsor
+	if _, err := q.GetAll(s.c, &sponsors); err != nil {
+		return nil, err
+	}
+
+	return sponsors, nil
+}
+
+func (s datastoreSponsors) Get(id string) (Sponsor, error) {
+	var sp Sponsor
+	q := datastore.NewQuery("Sponsors").Ancestor(sponsorList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &sp)
+	return sp, err
+}
+
+func (s datastoreSponsors) Add(sp Sponsor) error {
+	return addUnique(s.c, "Sponsors", sponsorList(s.c), sp.ID, &sp, nil)
+}
+
+// key looks up the datastore key of the sponsor with the given ID
+func (s datastoreSponsors) key(id string) (*datastore.Key, error) {
+	var sp Sponsor
+	q := datastore.NewQuery("Sponsors").Ancestor(sponsorList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &sp)
+}
+
+func (s datastoreSponsors) Update(id string, sp Sponsor) error {
+	return updateUnique(s.c, "Sponsors", sponsorList(s.c), id, sp.ID, &sp, nil)
+}
+
+func (s datastoreSponsors) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+type datastoreTags struct {
+	c appengine.Context
+}
+
+func (s datastoreTags) List(limit int) ([]Tag, error) {
+	q := datastore.NewQuery("Tags").Ancestor(tagList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var tags []Tag
+	if _, err := q.GetAll(s.c, &tags); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (s datastoreTags) Get(id string) (Tag, error) {
+	var t Tag
+	q := datastore.NewQuery("Tags").Ancestor(tagList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &t)
+	return t, err
+}
+
+func (s datastoreTags) Add(t Tag) error {
+	return addUnique(s.c, "Tags", tagList(s.c), t.ID, &t, nil)
+}
+
+// key looks up the datastore key of the tag with the given ID
+func (s datastoreTags) key(id string) (*datastore.Key, error) {
+	var t Tag
+	q := datastore.NewQuery("Tags").Ancestor(tagList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &t)
+}
+
+func (s datastoreTags) Update(id string, t Tag) error {
+	return updateUnique(s.c, "Tags", tagList(s.c), id, t.ID, &t, nil)
+}
+
+func (s datastoreTags) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+type datastoreOrganizers struct {
+	c appengine.Context
+}
+
+func (s datastoreOrganizers) List(limit int) ([]Organizer, error) {
+	q := datastore.NewQuery("Organizers").Ancestor(organizerList(s.c))
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	var organizers []Organizer
+	if _, err := q.GetAll(s.c, &organizers); err != nil {
+		return nil, err
+	}
+
+	return organizers, nil
+}
+
+func (s datastoreOrganizers) Get(id string) (Organizer, error) {
+	var o Organizer
+	q := datastore.NewQuery("Organizers").Ancestor(organizerList(s.c)).Filter("ID =", id)
+	_, err := getByID(s.c, q, &o)
+	return o, err
+}
+
+func (s datastoreOrganizers) Add(o Organizer) error {
+	return addUnique(s.c, "Organizers", organizerList(s.c), o.ID, &o, nil)
+}
+
+// key looks up the datastore key of the organizer with the given ID
+func (s datastoreOrganizers) key(id string) (*datastore.Key, error) {
+	var o Organizer
+	q := datastore.NewQuery("Organizers").Ancestor(organizerList(s.c)).Filter("ID =", id)
+	return getByID(s.c, q, &o)
+}
+
+func (s datastoreOrganizers) Update(id string, o Organizer) error {
+	return updateUnique(s.c, "Organizers", organizerList(s.c), id, o.ID, &o, nil)
+}
+
+func (s datastoreOrganizers) Delete(id string) error {
+	key, err := s.key(id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+// slugRedirect is how a RedirectStore entry is saved in the datastore
+type slugRedirect struct {
+	Kind string
+	Old  string
+	Slug string
+}
+
+type datastoreRedirects struct {
+	c appengine.Context
+}
+
+// key names the redirect after its kind and old slug so it can be fetched
+// directly, without an eventually consistent query
+func (s datastoreRedirects) key(kind, old string) *datastore.Key {
+	return datastore.NewKey(s.c, "SlugRedirect", kind+"/"+old, 0, nil)
+}
+
+func (s datastoreRedirects) Lookup(kind, old string) (string, error) {
+	var sr slugRedirect
+	err := datastore.Get(s.c, s.key(kind, old), &sr)
+	if err == datastore.ErrNoSuchEntity {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return sr.Slug, nil
+}
+
+func (s datastoreRedirects) Add(kind, old, slug string) error {
+	_, err := datastore.Put(s.c, s.key(kind, old), &slugRedirect{kind, old, slug})
+	return err
+}
+
+func (s datastoreRedirects) Remove(kind, old string) error {
+	return datastore.Delete(s.c, s.key(kind, old))
+}
+
+func (s datastoreRedirects) Renamed(kind, slug string) ([]string, error) {
+	var redirects []slugRedirect
+	q := datastore.NewQuery("SlugRedirect").Filter("Kind =", kind).Filter("Slug =", slug)
+	if _, err := q.GetAll(s.c, &redirects); err != nil {
+		return nil, err
+	}
+
+	olds := make([]string, len(redirects))
+	for i, sr := range redirects {
+		olds[i] = sr.Old
+	}
+
+	return olds, nil
+}
+
+type datastoreTokens struct {
+	c appengine.Context
+}
+
+// key names the token after its ID so it can be fetched directly.  A query
+// could still find a token for a while after it has been revoked
+func (s datastoreTokens) key(id string) *datastore.Key {
+	return datastore.NewKey(s.c, "APIToken", id, 0, nil)
+}
+
+func (s datastoreTokens) List() ([]APIToken, error) {
+	var tokens []APIToken
+	if _, err := datastore.NewQuery("APIToken").Order("Created").GetAll(s.c, &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (s datastoreTokens) Get(id string) (APIToken, error) {
+	var t APIToken
+	err := datastore.Get(s.c, s.key(id), &t)
+	if err == datastore.ErrNoSuchEntity {
+		return t, ErrNotFound
+	}
+
+	return t, err
+}
+
+func (s datastoreTokens) Add(t APIToken) error {
+	_, err := datastore.Put(s.c, s.key(t.ID), &t)
+	return err
+}
+
+func (s datastoreTokens) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, s.key(id))
+}
+
+// datastoreRSVPs stores RSVPs as children of their event's entity, which
+// keeps its key when the event is renamed
+type datastoreRSVPs struct {
+	c appengine.Context
+}
+
+// key returns the key of the RSVP with the given ID under the event with the
+// given ID
+func (s datastoreRSVPs) key(eventID, id string) (*datastore.Key, error) {
+	parent, err := datastoreEvents{s.c}.key(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	return datastore.NewKey(s.c, "RSVP", id, 0, parent), nil
+}
+
+func (s datastoreRSVPs) List(eventID string) ([]RSVP, error) {
+	parent, err := datastoreEvents{s.c}.key(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsvps []RSVP
+	if _, err := datastore.NewQuery("RSVP").Ancestor(parent).GetAll(s.c, &rsvps); err != nil {
+		return nil, err
+	}
+
+	// sorted here rather than in the query so no composite index is needed
+	sort.Stable(rsvpsByCreated(rsvps))
+	return rsvps, nil
+}
+
+func (s datastoreRSVPs) Get(eventID, id string) (RSVP, error) {
+	var v RSVP
+	key, err := s.key(eventID, id)
+	if err != nil {
+		return v, err
+	}
+
+	err = datastore.Get(s.c, key, &v)
+	if err == datastore.ErrNoSuchEntity {
+		return v, ErrNotFound
+	}
+
+	return v, err
+}
+
+func (s datastoreRSVPs) Add(eventID string, v RSVP) error {
+	key, err := s.key(eventID, v.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(s.c, key, &v)
+	return err
+}
+
+func (s datastoreRSVPs) Update(eventID string, v RSVP) error {
+	if _, err := s.Get(eventID, v.ID); err != nil {
+		return err
+	}
+
+	return s.Add(eventID, v)
+}
+
+// Atomically runs fn in a transaction.  Events and their RSVPs all sit under
+// eventList, so they form one entity group the transaction can query
+func (s datastoreRSVPs) Atomically(eventID string, fn func(RSVPStore) error) error {
+	return datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		return fn(datastoreRSVPs{tc})
+	}, nil)
+}
+
+// datastoreSessions stores sessions as children of their event's entity, like
+// RSVPs
+type datastoreSessions struct {
+	c appengine.Context
+}
+
+// key returns the key of the session with the given ID under the event with
+// the given ID
+func (s datastoreSessions) key(eventID, id string) (*datastore.Key, error) {
+	parent, err := datastoreEvents{s.c}.key(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	return datastore.NewKey(s.c, "Session", id, 0, parent), nil
+}
+
+func (s datastoreSessions) List(eventID string) ([]Session, error) {
+	parent, err := datastoreEvents{s.c}.key(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	if _, err := datastore.NewQuery("Session").Ancestor(parent).GetAll(s.c, &sessions); err != nil {
+		return nil, err
+	}
+
+	sort.Stable(sessionsByStart(sessions))
+	return sessions, nil
+}
+
+func (s datastoreSessions) Get(eventID, id string) (Session, error) {
+	var ss Session
+	key, err := s.key(eventID, id)
+	if err != nil {
+		return ss, err
+	}
+
+	err = datastore.Get(s.c, key, &ss)
+	if err == datastore.ErrNoSuchEntity {
+		return ss, ErrNotFound
+	}
+
+	return ss, err
+}
+
+func (s datastoreSessions) Add(eventID string, ss Session) error {
+	key, err := s.key(eventID, ss.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(s.c, key, &ss)
+	return err
+}
+
+func (s datastoreSessions) Update(eventID string, ss Session) error {
+	if _, err := s.Get(eventID, ss.ID); err != nil {
+		return err
+	}
+
+	return s.Add(eventID, ss)
+}
+
+func (s datastoreSessions) Delete(eventID, id string) error {
+	if _, err := s.Get(eventID, id); err != nil {
+		return err
+	}
+
+	key, err := s.key(eventID, id)
+	if err != nil {
+		return err
+	}
+
+	return datastore.Delete(s.c, key)
+}
+
+// BySpeaker looks up the event of each matching session through its parent
+// key, since the event's ID isn't stored on the session
+func (s datastoreSessions) BySpeaker(speakerID string) (map[string][]Session, error) {
+	var sessions []Session
+	q := datastore.NewQuery("Session").Ancestor(eventList(s.c)).Filter("SpeakerIDs =", speakerID)
+	keys, err := q.GetAll(s.c, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(map[string][]Session)
+	for i, key := range keys {
+		var e Event
+		if err := datastore.Get(s.c, key.Parent(), &e); err != nil {
+			return nil, err
+		}
+
+		matched[e.ID] = append(matched[e.ID], sessions[i])
+	}
+
+	return matched, nil
+}
+
+// secretKey is how a SecretStore key is saved in the datastore
+type secretKey struct {
+	Value []byte `datastore:",noindex"`
+}
+
+// datastoreReports names each report's entity after its ID, so Modify can
+// read and write it in a single entity group transaction
+type datastoreReports struct {
+	c appengine.Context
+}
+
+func (s datastoreReports) key(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "Report", id, 0, nil)
+}
+
+func (s datastoreReports) List() ([]Report, error) {
+	var reports []Report
+	if _, err := datastore.NewQuery("Report").GetAll(s.c, &reports); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+func (s datastoreReports) Get(id string) (Report, error) {
+	var rep Report
+	err := datastore.Get(s.c, s.key(s.c, id), &rep)
+	if err == datastore.ErrNoSuchEntity {
+		return rep, ErrNotFound
+	}
+
+	return rep, err
+}
+
+func (s datastoreReports) Add(rep Report) error {
+	_, err := datastore.Put(s.c, s.key(s.c, rep.ID), &rep)
+	return err
+}
+
+func (s datastoreReports) Modify(id string, fn func(*Report) error) error {
+	return datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		key := s.key(tc, id)
+		var rep Report
+		err := datastore.Get(tc, key, &rep)
+		if err == datastore.ErrNoSuchEntity {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(&rep); err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, key, &rep)
+		return err
+	}, nil)
+}
+
+// datastoreAudit stores entries as AuditEntry entities with generated IDs
+type datastoreAudit struct {
+	c appengine.Context
+}
+
+func (s datastoreAudit) List() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if _, err := datastore.NewQuery("AuditEntry").Order("At").GetAll(s.c, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s datastoreAudit) Add(e AuditEntry) error {
+	_, err := datastore.Put(s.c, datastore.NewIncompleteKey(s.c, "AuditEntry", nil), &e)
+	return err
+}
+
+type datastoreSecrets struct {
+	c appengine.Context
+}
+
+func (s datastoreSecrets) Key(name string) ([]byte, error) {
+	var k secretKey
+	// in a transaction so two instances asking at once agree on one key
+	err := datastore.RunInTransaction(s.c, func(tc appengine.Context) error {
+		key := datastore.NewKey(tc, "Secret", name, 0, nil)
+		err := datastore.Get(tc, key, &k)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if k.Value, err = newSecretKey(); err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(tc, key, &k)
+		return err
+	}, nil)
+
+	return k.Value, err
+}
+
+// searchIndexName is the App Engine search index documents are kept in
+const searchIndexName = "records"
+
+// searchEntry is a SearchDoc as the App Engine search API stores it.  Kind, ID
+// and When are atoms so they are only matched whole, rather than as words
+type searchEntry struct {
+	Kind  search.Atom
+	ID    search.Atom
+	Title string
+	Body  string
+	// When is the RFC 3339 Datetime, "" if it is zero
+	When search.Atom
+}
+
+// datastoreSearch uses the App Engine search API, which does its own ranking
+type datastoreSearch struct {
+	c appengine.Context
+}
+
+func (s datastoreSearch) Put(doc SearchDoc) error {
+	idx, err := search.Open(searchIndexName)
+	if err != nil {
+		return err
+	}
+
+	entry := searchEntry{Kind: search.Atom(doc.Kind), ID: search.Atom(doc.ID), Title: doc.Title, Body: doc.Body}
+	if !doc.Datetime.IsZero() {
+		entry.When = search.Atom(doc.Datetime.UTC().Format(time.RFC3339))
+	}
+
+	_, err = idx.Put(s.c, searchKey(doc.Kind, doc.ID), &entry)
+	return err
+}
+
+func (s datastoreSearch) Delete(kind, id string) error {
+	idx, err := search.Open(searchIndexName)
+	if err != nil {
+		return err
+	}
+
+	return idx.Delete(s.c, searchKey(kind, id))
+}
+
+func (s datastoreSearch) Search(terms []string, limit int) ([]SearchDoc, error) {
+	idx, err := search.Open(searchIndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	// quoted so the words are never read as query operators, a space between
+	// them means all of them must match
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + t + `"`
+	}
+
+	opts := &search.SearchOptions{
+		Limit: limit,
+		Sort:  &search.SortOptions{Scorer: search.MatchScorer},
+	}
+
+	var docs []SearchDoc
+	for t := idx.Search(s.c, strings.Join(quoted, " "), opts); ; {
+		var entry searchEntry
+		_, err := t.Next(&entry)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		doc := SearchDoc{Kind: string(entry.Kind), ID: string(entry.ID), Title: entry.Title, Body: entry.Body}
+		if entry.When != "" {
+			doc.Datetime, _ = time.Parse(time.RFC3339, string(entry.When))
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// MigrateDatetimes converts Events and LearnEvent entities saved with a string
+// Datetime.  Entities are loaded as raw property lists since they can't be
+// loaded into the current structs until they have been converted
+func (datastoreBackend) MigrateDatetimes(r *http.Request) (migrationResult, error) {
+	var res migrationResult
+	c := appengine.NewContext(r)
+	for kind, parent := range map[string]*datastore.Key{
+		"Events":     eventList(c),
+		"LearnEvent": learnList(c),
+	} {
+		var entities []datastore.PropertyList
+		keys, err := datastore.NewQuery(kind).Ancestor(parent).GetAll(c, &entities)
+		if err != nil {
+			return res, err
+		}
+
+		for i, props := range entities {
+			converted, ok := migrateProperties(props)
+			if converted == nil {
+				continue
+			}
+
+			if _, err := datastore.Put(c, keys[i], &converted); err != nil {
+				return res, err
+			}
+
+			if ok {
+				res.Converted++
+			} else {
+				res.Unparsed++
+			}
+		}
+	}
+
+	// study groups saved before their meetings were stored aren't listed
+	// until they are
+	var learn []LearnEvent
+	keys, err := datastore.NewQuery("LearnEvent").Ancestor(learnList(c)).GetAll(c, &learn)
+	if err != nil {
+		return res, err
+	}
+
+	for i, l := range learn {
+		err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			return putMeetings(tc, keys[i], l)
+		}, nil)
+		if err != nil {
+			return res, err
+		}
+		res.Meetings++
+	}
+
+	return res, nil
+}
+
+// migrateProperties converts the string Datetime in props, returning nil if
+// there was nothing to convert.  ok is false if the old value couldn't be
+// parsed
+func migrateProperties(props datastore.PropertyList) (datastore.PropertyList, bool) {
+	dt, details := -1, -1
+	for i, p := range props {
+		switch p.Name {
+		case "Datetime":
+			dt = i
+		case "Details":
+			details = i
+		}
+	}
+
+	old, isString := "", false
+	if dt >= 0 {
+		old, isString = props[dt].Value.(string)
+	}
+	if !isString {
+		return nil, false
+	}
+
+	var oldDetails string
+	if details >= 0 {
+		oldDetails, _ = props[details].Value.(string)
+	}
+
+	t, zone, newDetails, ok := convertLegacyDatetime(old, oldDetails)
+	converted := append(datastore.PropertyList(nil), props...)
+	converted[dt].Value = t
+	converted = append(converted, datastore.Property{Name: "TimeZone", Value: zone})
+	if details >= 0 {
+		converted[details].Value = newDetails
+		converted[details].NoIndex = true
+	} else {
+		converted = append(converted, datastore.Property{Name: "Details", Value: newDetails, NoIndex: true})
+	}
+
+	return converted, ok
+}
+
+// MigrateSlugs gives every Events, LearnEvent and Locations entity that
+// shares its ID with a later one a new ID from reslug.  The last entity with
+// an ID keeps it, being the one its pages used to show
+func (datastoreBackend) MigrateSlugs(r *http.Request, reslug func(v interface{}) error) ([]interface{}, error) {
+	c := appengine.NewContext(r)
+	var events []Event
+	var learn []LearnEvent
+	var locations []Location
+	var renamed []interface{}
+	for _, k := range []struct {
+		kind   string
+		parent *datastore.Key
+		dst    interface{}
+		// record returns the ID of the ith entity loaded into dst, and a
+		// pointer to it
+		record func(i int) (string, interface{})
+	}{
+		{"Events", eventList(c), &events, func(i int) (string, interface{}) { return events[i].ID, &events[i] }},
+		{"LearnEvent", learnList(c), &learn, func(i int) (string, interface{}) { return learn[i].ID, &learn[i] }},
+		{"Locations", locationList(c), &locations, func(i int) (string, interface{}) { return locations[i].ID, &locations[i] }},
+	} {
+		keys, err := datastore.NewQuery(k.kind).Ancestor(k.parent).GetAll(c, k.dst)
+		if err != nil {
+			return renamed, err
+		}
+
+		last := make(map[string]int)
+		for i := range keys {
+			id, _ := k.record(i)
+			last[id] = i
+		}
+
+		for i, key := range keys {
+			id, v := k.record(i)
+			if last[id] == i {
+				continue
+			}
+
+			if err := reslug(v); err != nil {
+				return renamed, err
+			}
+			if _, err := datastore.Put(c, key, v); err != nil {
+				return renamed, err
+			}
+			renamed = append(renamed, v)
+		}
+	}
+
+	return renamed, nil
+}
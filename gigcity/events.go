@@ -2,13 +2,11 @@ package gigcity
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/user"
+	"unicode/utf8"
 )
 
 // Event contains details about GDG events, used when preforming read/write ops
@@ -16,127 +14,304 @@ import (
 type Event struct {
 	// ID is the unique ID (URI) for the event
 	ID string
+	// UID is the event's iCalendar UID, unlike ID it never changes
+	UID string
 	// Title of the event
 	Title string
-	// Datetime of the event, sent from the browser in YYYY-MM-DDTHH:MM
-	// format
-	Datetime string
+	// Datetime of the event, stored in UTC
+	Datetime time.Time
+	// TimeZone is the IANA name of the time zone the event is held in, like
+	// America/New_York
+	TimeZone string
 	// LocID is the location the event is being held
 	LocID string
 	// GooglePlus is the URL to the Google+ event page
 	GooglePlus string
 	// The details about the event
-	Details string
+	Details string `datastore:",noindex"`
 	// HoA is the Hangouts on Air link
 	HoA string
+	// Capacity is how many seats there are, zero means there is no limit
+	Capacity int
+	// SpeakerIDs lists who is giving talks, in running order
+	SpeakerIDs []string
+	// SponsorIDs lists the sponsors backing the event
+	SponsorIDs []string
+	// TagIDs lists the topics the event is filed under
+	TagIDs []string
+	// Created is when the event was first saved
+	Created time.Time
+	// Updated is when the event was last changed
+	Updated time.Time
+}
+
+// When formats the event's date and time in its own time zone
+func (e Event) When() string {
+	return formatLocal(e.Datetime, e.TimeZone)
+}
+
+// Link is the path of the event's page
+func (e Event) Link() string {
+	return "/events/" + e.ID
 }
 
-// Fetches the next index key out of the datastore for the Events entity
-func eventList(c appengine.Context) *datastore.Key {
-	return datastore.NewKey(c, "Events", "default_eventlist", 0, nil)
+// FormDatetime formats the event's date and time for the admin form
+func (e Event) FormDatetime() string {
+	return formValueLocal(e.Datetime, e.TimeZone)
 }
 
-// Handles requests to /events
-func eventHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// query the Events entity in the datastore
-	q := datastore.NewQuery("Events").Ancestor(eventList(c)).Order("-Datetime").Limit(10)
-	// create a slice of Event with a capacity of 10 items
-	events := make([]Event, 0, 10)
-	// store the results into the events slice
-	if _, err := q.GetAll(c, &events); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+// Handles requests to /events, upcoming events soonest first
+func (s *site) eventHandler(w http.ResponseWriter, r *http.Request) {
+	tag, tags, ok := s.listingTags(w, r)
+	if !ok {
 		return
 	}
 
-	// loop through events, changing events.Datetime from YYYY-MM-DDTHH:MM
-	// to YYYY-MM-DD HH:MM
-	for key, event := range events {
-		t, err := time.Parse("2006-01-02T15:04", event.Datetime)
-		if err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
+	events, next, err := s.backend.Events(r).Range(upcomingQuery(r, tag))
+	if err != nil {
+		s.rangeError(w, r, err)
+		return
+	}
+
+	p := listPage{Path: "/events", Noun: "events", Items: events, Next: next, Tag: tag, Tags: tags}
+	s.render(w, r, "events", p)
+}
+
+// eventFromForm builds an Event out of the submitted add/edit form.  If a
+// required field is missing or invalid the returned message says which
+func (s *site) eventFromForm(r *http.Request) (Event, string) {
+	return s.eventFromValues(r, formValue(r))
+}
+
+// Limits on the length of submitted text, in characters.  The API and the
+// Markdown fields take any length, so they are checked on the server.  Single
+// line fields stay well under the 1500 bytes the datastore can index, the
+// longer text fields aren't indexed
+const (
+	maxLineLen = 300
+	maxTextLen = 10000
+)
+
+// fieldLimit is the most characters a named form field may hold
+type fieldLimit struct {
+	field string
+	max   int
+}
+
+// lineField limits a single line field, like a title or a link
+func lineField(field string) fieldLimit {
+	return fieldLimit{field, maxLineLen}
+}
+
+// textField limits a field of Markdown text, like details or a bio
+func textField(field string) fieldLimit {
+	return fieldLimit{field, maxTextLen}
+}
 
-		events[key].Datetime = t.Format("2006-01-02 03:04 PM")
+// tooLong checks the named fields returned by value against their limits.
+// If one is too long the returned message says which
+func tooLong(value func(string) string, noun string, limits ...fieldLimit) string {
+	for _, l := range limits {
+		if n := utf8.RuneCountInString(value(l.field)); n > l.max {
+			return fmt.Sprintf("%s %s is %d characters long, it can be at most %d", noun, l.field, n, l.max)
+		}
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/events.html",
-	))
+	return ""
+}
 
-	if err := page.Execute(w, events); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
-		return
+// formValue returns a getter for the fields of r's form.  Speakers, sponsors
+// and topics are picked from multiple selects, which send one value per
+// choice, so they are joined into the comma separated lists the validation
+// rules expect
+func formValue(r *http.Request) func(string) string {
+	return func(name string) string {
+		if name == "speakers" || name == "sponsors" || name == "tags" || name == "weekdays" {
+			r.ParseForm()
+			return strings.Join(r.Form[name], ",")
+		}
+
+		return r.FormValue(name)
 	}
 }
 
-// Admin page to add new event information to the datastore
-func addEventHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// get user information if one is logged in
-	u := user.Current(c)
-	if u == nil {
-		// the person that made the request is anonymous, redirect them to the login
-		// page
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			// was unable to get a login URL, so die with a 500 error
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
+// eventFromValues builds an Event out of the named fields returned by value,
+// which are named after the add/edit form's inputs.  It holds the validation
+// rules shared by the form and the API
+func (s *site) eventFromValues(r *http.Request, value func(string) string) (Event, string) {
+	var g Event
+	msg := tooLong(value, "event", lineField("title"), lineField("location"), lineField("timezone"),
+		lineField("gplus"), lineField("hoa"), textField("details"))
+	if msg != "" {
+		return g, msg
+	}
+
+	g.Title = value("title")
+	if g.Title == "" {
+		return g, "event title is required"
+	}
+
+	date := value("date")
+	if date == "" {
+		return g, "event date and time is required"
+	}
+
+	g.LocID = value("location")
+	if g.LocID == "" {
+		return g, "event location is required"
+	}
+
+	g.Datetime, g.TimeZone, msg = s.parseFormTime(r, date, value("timezone"), g.LocID)
+	if msg != "" {
+		return g, "event " + msg
+	}
+
+	// a blank capacity is taken from the location
+	if v := value("capacity"); v != "" {
+		if g.Capacity, msg = parseCapacity(v); msg != "" {
+			return g, "event " + msg
 		}
-		// set a return URL for when authentication succeeds
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
+	} else if l, err := s.backend.Locations(r).Get(g.LocID); err == nil {
+		g.Capacity = l.Capacity
+	}
+
+	// Google+ is gone, visitors RSVP on the site now
+	g.GooglePlus = value("gplus")
+
+	g.Details = value("details")
+	if g.Details == "" {
+		return g, "Event details is required"
+	}
+
+	g.HoA = value("hoa")
+
+	g.SpeakerIDs, msg = s.speakerIDs(r, value("speakers"))
+	if msg != "" {
+		return g, msg
+	}
+
+	g.SponsorIDs, msg = s.sponsorIDs(r, value("sponsors"))
+	if msg != "" {
+		return g, msg
+	}
+
+	g.TagIDs, msg = s.tagIDs(r, value("tags"))
+	return g, msg
+}
+
+// renderEventForm shows the add/edit event form pre-filled with e.  A blank e
+// gives an empty form for a new event
+func (s *site) renderEventForm(w http.ResponseWriter, r *http.Request, e Event) {
+	type Content struct {
+		Event
+		// Speakers are the speakers that can be picked
+		Speakers []Speaker
+		// Sponsors are the sponsors that can be picked, partners included
+		Sponsors []Sponsor
+		// Tags are the topics that can be picked
+		Tags []Tag
+	}
+
+	speakers, err := s.backend.Speakers(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	sort.Sort(speakersByName(speakers))
 
-	// check the request method
-	if r.Method == "POST" {
-		// handle post requests
-		var g Event
-		g.Title = r.FormValue("title")
-		if g.Title == "" {
-			errorHandler(w, r, http.StatusBadRequest, "event title is required")
-			return
-		}
+	sponsors, err := s.backend.Sponsors(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(sponsorsByTier(sponsors))
 
-		g.Datetime = r.FormValue("date")
-		if g.Datetime == "" {
-			errorHandler(w, r, http.StatusBadRequest, "event date and time is required")
-			return
-		}
+	tags, err := s.listTags(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		g.LocID = r.FormValue("location")
-		if g.LocID == "" {
-			errorHandler(w, r, http.StatusBadRequest, "event location is required")
-			return
-		}
+	s.render(w, r, "admin/add-event", Content{e, speakers, sponsors, tags})
+}
 
-		g.GooglePlus = r.FormValue("gplus")
-		if g.GooglePlus == "" {
-			errorHandler(w, r, http.StatusBadRequest, "Google+ event page is required")
-			return
+// createEvent gives a validated new event its ID, UID and timestamps, then
+// stores it
+func (s *site) createEvent(r *http.Request, g Event) (Event, error) {
+	g.UID = newUID()
+	g.Created = time.Now().UTC()
+	g.Updated = g.Created
+	var err error
+	g.ID, err = claimSlug(func() (string, error) {
+		return s.eventSlug(r, g, "")
+	}, func(slug string) error {
+		g.ID = slug
+		return s.backend.Events(r).Add(g)
+	})
+	if err != nil {
+		return g, err
+	}
+
+	s.index(r, eventDoc(g))
+	return g, nil
+}
+
+// updateEvent overwrites the stored event e with the validated changes in g
+func (s *site) updateEvent(r *http.Request, e, g Event) (Event, error) {
+	// only move the event to a new slug if the title really changed, the old
+	// slug is kept as a redirect
+	g.UID = e.CalendarUID()
+	g.Created = e.Created
+	g.Updated = time.Now().UTC()
+	var err error
+	g.ID, err = claimSlug(func() (string, error) {
+		if slugify(g.Title) == slugify(e.Title) {
+			return e.ID, nil
 		}
+		return s.eventSlug(r, g, e.ID)
+	}, func(slug string) error {
+		g.ID = slug
+		return s.backend.Events(r).Update(e.ID, g)
+	})
+	if err != nil {
+		return g, err
+	}
+
+	if err := s.renameSlug(r, "Events", e.ID, g.ID); err != nil {
+		return g, err
+	}
+
+	if g.ID != e.ID {
+		s.unindex(r, "Events", e.ID)
+	}
+	s.index(r, eventDoc(g))
+
+	// a bigger room seats people off the waitlist
+	if g.Capacity == e.Capacity {
+		return g, nil
+	}
 
-		g.Details = r.FormValue("details")
-		if g.Details == "" {
-			errorHandler(w, r, http.StatusBadRequest, "Event details is required")
+	return g, s.fillSeats(r, g)
+}
+
+// Admin page to add new event information to the datastore
+func (s *site) addEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	// check the request method
+	if r.Method == "POST" {
+		// handle post requests
+		g, msg := s.eventFromForm(r)
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, msg)
 			return
 		}
 
-		g.HoA = r.FormValue("hoa")
-		g.ID = getID(g.Title)
-
-		// get the next available index key
-		key := datastore.NewIncompleteKey(c, "Events", eventList(c))
-		// write the data to the datastore
-		_, err := datastore.Put(c, key, &g)
-		if err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		// write the data to the backend
+		if _, err := s.createEvent(r, g); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 
@@ -144,82 +319,176 @@ func addEventHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/events", http.StatusFound)
 	} else if r.Method == "GET" {
 		// handle get requests
-		page := template.Must(template.ParseFiles(
-			"static/_base.html",
-			"static/admin/overlay.html",
-			"static/admin/add-event.html",
-		))
-
-		if err := page.Execute(w, nil); err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
+		s.renderEventForm(w, r, Event{})
 	} else {
 		fmt.Fprint(w, r.Method)
 	}
 }
 
+// Handles requests to /admin/events, listing every event with its admin
+// actions
+func (s *site) adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	events, err := s.backend.Events(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "admin/events", events)
+}
+
+// Handles requests to /admin/events/:event/edit.  GET shows the event form
+// pre-filled with the stored event, POST writes the changes back to it
+func (s *site) editEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	eventID := r.URL.Query().Get(":event")
+	e, err := s.backend.Events(r).Get(eventID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderEventForm(w, r, e)
+		return
+	}
+
+	g, msg := s.eventFromForm(r)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	g, err = s.updateEvent(r, e, g)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/events/"+g.ID, http.StatusFound)
+}
+
+// adminEvent fetches the event named in the URL for an admin page.  If it
+// can't, an error page is sent and ok is false
+func (s *site) adminEvent(w http.ResponseWriter, r *http.Request) (e Event, ok bool) {
+	e, err := s.backend.Events(r).Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return e, false
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return e, false
+	}
+
+	return e, true
+}
+
+// Handles requests to /admin/events/:event/delete
+func (s *site) deleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	eventID := r.URL.Query().Get(":event")
+	err := s.backend.Events(r).Delete(eventID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.unindex(r, "Events", eventID)
+	if err := s.dropRedirects(r, "Events", eventID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/events", http.StatusFound)
+}
+
 // geteventhandler handles requests for /events/:event
-func getEventHandler(w http.ResponseWriter, r *http.Request) {
+func (s *site) getEventHandler(w http.ResponseWriter, r *http.Request) {
 	type Content struct {
 		EventDetails Event
 		LocDetails   Location
+		Speakers     []Speaker
+		Sponsors     []sponsorTier
+		Agenda       agenda
+		Seats        seats
+		Tags         []Tag
 	}
 
 	var context Content
-	c := appengine.NewContext(r)
 	eventID := r.URL.Query().Get(":event")
 	if eventID == "" {
-		errorHandler(w, r, http.StatusInternalServerError, "no event ID found in URL")
+		s.errorHandler(w, r, http.StatusInternalServerError, "no event ID found in URL")
 		return
 	}
-q := datastore.NewQuery("Events").Filter("ID =", eventID)
-	t := q.Run(c)
-	for {
-		var e Event
-		_, err := t.Next(&e)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			c.Errorf("fetching event details failed: %v", err)
-			break
-		}
 
-		// format the datestamp
-		t, err := time.Parse("2006-01-02T15:04", e.Datetime)
-		if err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
+	e, err := s.backend.Events(r).Get(eventID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "Events", eventID, "/events/", "") {
+			s.errorHandler(w, r, http.StatusNotFound, "")
 		}
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context.EventDetails = e
 
-		e.Datetime = t.Format("2006-01-02 3:04 PM")
-		context.EventDetails = e
+	context.LocDetails, err = s.backend.Locations(r).Get(e.LocID)
+	if err != nil && err != ErrNotFound {
+		logHandler("ERROR", fmt.Sprintf("fetching location details failed: %v", err))
 	}
 
-	q = datastore.NewQuery("Locations").Filter("ID =", context.EventDetails.LocID)
-	t = q.Run(c)
-	for {
-		var l Location
-		_, err := t.Next(&l)
-		if err == datastore.Done {
-			break
-		}
-		if err != nil {
-			c.Errorf("fetching location details failed: %v", err)
-			break
-		}
+	context.Speakers, err = s.eventSpeakers(r, e)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		context.LocDetails = l
+	context.Sponsors, err = s.eventSponsors(r, e)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/view-event.html",
-	))
+	context.Agenda, err = s.eventAgenda(r, e)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	if err := page.Execute(w, context); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	context.Tags, err = s.recordTags(r, e.TagIDs)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	rsvps, err := s.backend.RSVPs(r).List(e.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	context.Seats = countSeats(e, rsvps)
+
+	s.render(w, r, "view-event", context)
 }
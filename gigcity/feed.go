@@ -0,0 +1,320 @@
+package gigcity
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// feedSize is how many entries the Atom and RSS feeds carry
+const feedSize = 20
+
+// feedItem is an entry in an Atom or RSS feed
+type feedItem struct {
+	// UID stays the same across edits and renames, unlike the link
+	UID       string
+	Title     string
+	Path      string
+	Summary   string
+	Published time.Time
+	Updated   time.Time
+}
+
+// feed is everything needed to render a feed in either format
+type feed struct {
+	Title string
+	// Path is the page the feed mirrors, like /events
+	Path  string
+	Items []feedItem
+}
+
+// byUpdated sorts feed items most recently changed first
+type byUpdated []feedItem
+
+func (f byUpdated) Len() int           { return len(f) }
+func (f byUpdated) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byUpdated) Less(i, j int) bool { return f[i].Updated.After(f[j].Updated) }
+
+// feedTimes returns the published and updated times of a record.  Records
+// saved before these were tracked fall back to when they take place
+func feedTimes(created, updated, datetime time.Time) (time.Time, time.Time) {
+	if updated.IsZero() {
+		updated = datetime
+	}
+	if created.IsZero() {
+		created = updated
+	}
+
+	return created, updated
+}
+
+// feedSummary describes when and where something is happening, followed by
+// its details
+func feedSummary(when, where, details string) string {
+	summary := "When: " + when
+	if where != "" {
+		summary += "\nWhere: " + where
+	}
+
+	return summary + "\n\n" + details
+}
+
+// eventFeed builds the feed of events
+func (s *site) eventFeed(r *http.Request) (feed, error) {
+	f := feed{Title: "GDG Gigcity Events", Path: "/events"}
+	events, err := s.backend.Events(r).List(0)
+	if err != nil {
+		return f, err
+	}
+
+	addresses, err := s.locationAddresses(r)
+	if err != nil {
+		return f, err
+	}
+
+	f.Items = eventItems(events, addresses)
+	return f, nil
+}
+
+// eventItems turns events into feed items, addresses maps location IDs to
+// their street addresses
+func eventItems(events []Event, addresses map[string]string) []feedItem {
+	var items []feedItem
+	for _, e := range events {
+		published, updated := feedTimes(e.Created, e.Updated, e.Datetime)
+		items = append(items, feedItem{
+			UID:       e.CalendarUID(),
+			Title:     e.Title,
+			Path:      "/events/" + e.ID,
+			Summary:   feedSummary(e.When(), addresses[e.LocID], e.Details),
+			Published: published,
+			Updated:   updated,
+		})
+	}
+
+	return items
+}
+
+// learningFeed builds the feed of study groups
+func (s *site) learningFeed(r *http.Request) (feed, error) {
+	f := feed{Title: "GDG Gigcity Study Groups", Path: "/learning"}
+	learn, err := s.backend.LearnEvents(r).List(0)
+	if err != nil {
+		return f, err
+	}
+
+	addresses, err := s.locationAddresses(r)
+	if err != nil {
+		return f, err
+	}
+
+	f.Items = learnItems(learn, addresses)
+	return f, nil
+}
+
+// learnItems turns study groups into feed items, like eventItems
+func learnItems(learn []LearnEvent, addresses map[string]string) []feedItem {
+	var items []feedItem
+	for _, l := range learn {
+		published, updated := feedTimes(l.Created, l.Updated, l.Datetime)
+		items = append(items, feedItem{
+			UID:       l.CalendarUID(),
+			Title:     l.Title,
+			Path:      "/learning/" + l.ID,
+			Summary:   feedSummary(learnWhen(l), addresses[l.LocID], l.Details),
+			Published: published,
+			Updated:   updated,
+		})
+	}
+
+	return items
+}
+
+// learnWhen says when a study group meets, its schedule if it repeats
+func learnWhen(l LearnEvent) string {
+	if l.Repeats() {
+		return l.Schedule()
+	}
+
+	return l.When()
+}
+
+// latest sorts the feed's items newest first and trims it to feedSize,
+// returning when the feed last changed
+func (f *feed) latest() time.Time {
+	sort.Stable(byUpdated(f.Items))
+	if len(f.Items) > feedSize {
+		f.Items = f.Items[:feedSize]
+	}
+
+	if len(f.Items) == 0 {
+		return time.Time{}
+	}
+
+	return f.Items[0].Updated
+}
+
+// feedID turns a UID into a permanent feed entry ID
+func feedID(uid string) string {
+	return "tag:" + uidDomain + ",2015:" + uid
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+	Link      atomLink `xml:"link"`
+	Summary   string   `xml:"summary"`
+}
+
+// writeAtom renders f as an Atom 1.0 feed
+func (s *site) writeAtom(w http.ResponseWriter, r *http.Request, f feed) {
+	base := baseURL(r)
+	updated := f.latest()
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	a := atomFeed{
+		Title:   f.Title,
+		ID:      base + f.Path,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + r.URL.Path},
+			{Rel: "alternate", Type: "text/html", Href: base + f.Path},
+		},
+		Author: atomAuthor{Name: "GDG Gigcity"},
+	}
+
+	for _, item := range f.Items {
+		a.Entries = append(a.Entries, atomEntry{
+			Title:     item.Title,
+			ID:        feedID(item.UID),
+			Published: item.Published.UTC().Format(time.RFC3339),
+			Updated:   item.Updated.UTC().Format(time.RFC3339),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: base + item.Path},
+			Summary:   item.Summary,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	s.writeXML(w, r, a)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// writeRSS renders f as an RSS 2.0 feed
+func (s *site) writeRSS(w http.ResponseWriter, r *http.Request, f feed) {
+	base := baseURL(r)
+	rss := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        base + f.Path,
+			Description: f.Title,
+		},
+	}
+
+	if updated := f.latest(); !updated.IsZero() {
+		rss.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, item := range f.Items {
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        base + item.Path,
+			Description: item.Summary,
+			// links change when an event is renamed, so the GUID is the UID
+			GUID:    rssGUID{false, feedID(item.UID)},
+			PubDate: item.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	s.writeXML(w, r, rss)
+}
+
+// writeXML writes v as an XML document
+func (s *site) writeXML(w http.ResponseWriter, r *http.Request, v interface{}) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// Handles requests to /events/feed.atom and /events/feed.rss
+func (s *site) eventFeedHandler(write func(http.ResponseWriter, *http.Request, feed)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := s.eventFeed(r)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		write(w, r, f)
+	}
+}
+
+// Handles requests to /learning/feed.atom and /learning/feed.rss
+func (s *site) learningFeedHandler(write func(http.ResponseWriter, *http.Request, feed)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := s.learningFeed(r)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		write(w, r, f)
+	}
+}
@@ -0,0 +1,82 @@
+package gigcity
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFeedTimes(t *testing.T) {
+	created, updated, datetime := at("2015-01-01T10:00"), at("2015-02-01T10:00"), at("2015-03-04T23:30")
+
+	if p, u := feedTimes(created, updated, datetime); !p.Equal(created) || !u.Equal(updated) {
+		t.Errorf("feedTimes = %s, %s, want the record's own times", p, u)
+	}
+	// records saved before the times were tracked
+	if p, u := feedTimes(time.Time{}, time.Time{}, datetime); !p.Equal(datetime) || !u.Equal(datetime) {
+		t.Errorf("feedTimes of an old record = %s, %s, want its date", p, u)
+	}
+}
+
+func TestFeedLatest(t *testing.T) {
+	var f feed
+	if !f.latest().IsZero() {
+		t.Error("an empty feed has a last change")
+	}
+
+	first := at("2015-01-01T10:00")
+	for i := 0; i < feedSize+5; i++ {
+		f.Items = append(f.Items, feedItem{UID: fmt.Sprint(i), Updated: first.Add(time.Duration(i) * time.Hour)})
+	}
+
+	want := first.Add(time.Duration(feedSize+4) * time.Hour)
+	if got := f.latest(); !got.Equal(want) {
+		t.Errorf("latest() = %s, want %s", got, want)
+	}
+	if len(f.Items) != feedSize || f.Items[0].UID != fmt.Sprint(feedSize+4) {
+		t.Errorf("feed has %d items starting with %s, want the newest %d", len(f.Items), f.Items[0].UID, feedSize)
+	}
+}
+
+func TestEventFeeds(t *testing.T) {
+	ts := newTestServer(t)
+	for _, e := range []Event{
+		{ID: "old", UID: "old@example.com", Title: "Old", Datetime: at("2015-01-04T23:30"), Updated: at("2015-01-01T10:00")},
+		{ID: "new", UID: "new@example.com", Title: "New", Datetime: at("2015-03-04T23:30"), Updated: at("2015-02-01T10:00")},
+	} {
+		if err := ts.Backend.Events(nil).Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := ts.request(t, "GET", "/events/feed.atom", nil, false)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("GET /events/feed.atom = %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var atom atomFeed
+	if err := xml.Unmarshal([]byte(body), &atom); err != nil {
+		t.Fatal(err)
+	}
+	if len(atom.Entries) != 2 || atom.Entries[0].ID != feedID("new@example.com") || atom.Entries[1].Link.Href != ts.URL+"/events/old" {
+		t.Errorf("Atom entries = %+v, want new then old", atom.Entries)
+	}
+	if atom.Updated != "2015-02-01T10:00:00Z" {
+		t.Errorf("Atom feed updated %q, want when the newest entry changed", atom.Updated)
+	}
+
+	resp, body = ts.request(t, "GET", "/events/feed.rss", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events/feed.rss = %d", resp.StatusCode)
+	}
+
+	var rss rssFeed
+	if err := xml.Unmarshal([]byte(body), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if rss.Version != "2.0" || len(rss.Channel.Items) != 2 || rss.Channel.Items[0].Title != "New" || rss.Channel.Items[0].GUID.IsPermaLink {
+		t.Errorf("RSS feed = %+v", rss)
+	}
+}
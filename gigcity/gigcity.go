@@ -1,8 +1,8 @@
 package gigcity
 
 import (
+	"bytes"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	"os"
@@ -12,40 +12,157 @@ import (
 	"github.com/yosssi/gcss"
 )
 
-// Under appengine our code runs as a package, not a binary.  Due to this
-// define the routes during package initilization.  Normally this wourd happen
-// with in main()
-func init() {
+// NewHandler wires every route of the site to handlers backed by b, with the
+// admin area guarded by a and emails to visitors sent through mailer.  Code of
+// conduct reports are encrypted with reportKey, see ParseReportKey; without
+// one they are refused.  Every page template is parsed up front, an error
+// means one of them is broken.  In dev mode templates are reloaded from disk
+// when they change
+func NewHandler(b Backend, a Authenticator, mailer Mailer, reportKey []byte, dev bool) (http.Handler, error) {
+	if reportKey != nil && len(reportKey) != 32 {
+		return nil, fmt.Errorf("report key is %d bytes, it must be 32", len(reportKey))
+	}
+
+	templates, err := loadTemplates(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &site{backend: b, auth: a, mail: mailer, templates: templates, rsvpLimit: newRateLimiter(rsvpsPerHour, time.Hour), reportKey: reportKey}
 	m := pat.New()
 
 	// handle asset paths
-	m.Get("/css/:file", http.HandlerFunc(compileCSS))
+	m.Get("/css/:file", http.HandlerFunc(s.compileCSS))
 
 	// hondle application paths
-	m.Post("/admin/learn/add", http.HandlerFunc(addLearningHandler))
-	m.Get("/admin/learn/add", http.HandlerFunc(addLearningHandler))
-	m.Get("/admin/location/add", http.HandlerFunc(addLocationHandler))
-	m.Post("/admin/location/add", http.HandlerFunc(addLocationHandler))
-	m.Get("/admin/location", http.HandlerFunc(locationHandler))
-	m.Get("/admin/events/add", http.HandlerFunc(addEventHandler))
-	m.Post("/admin/events/add", http.HandlerFunc(addEventHandler))
-	m.Get("/admin", http.HandlerFunc(adminRootHandler))
-	m.Get("/learning/:event", http.HandlerFunc(getLearnHandler))
-	m.Get("/learning", http.HandlerFunc(learningHandler))
-	m.Get("/coc", http.HandlerFunc(cocHandler))
-	m.Get("/events/:event", http.HandlerFunc(getEventHandler))
-	m.Get("/events", http.HandlerFunc(eventHandler))
-	m.Get("/about", http.HandlerFunc(aboutHandler))
-	m.Get("/", http.HandlerFunc(rootHandler))
-	http.Handle("/", m)
+	m.Post("/admin/learn/add", http.HandlerFunc(s.addLearningHandler))
+	m.Get("/admin/learn/add", http.HandlerFunc(s.addLearningHandler))
+	m.Get("/admin/learn/:event/edit", http.HandlerFunc(s.editLearningHandler))
+	m.Post("/admin/learn/:event/edit", http.HandlerFunc(s.editLearningHandler))
+	m.Post("/admin/learn/:event/delete", http.HandlerFunc(s.deleteLearningHandler))
+	m.Get("/admin/learn/:event/meetings", http.HandlerFunc(s.adminMeetingsHandler))
+	m.Post("/admin/learn/:event/meetings/:date", http.HandlerFunc(s.meetingHandler))
+	m.Get("/admin/learn", http.HandlerFunc(s.adminLearningHandler))
+	m.Get("/admin/location/add", http.HandlerFunc(s.addLocationHandler))
+	m.Post("/admin/location/add", http.HandlerFunc(s.addLocationHandler))
+	m.Get("/admin/location/:location/edit", http.HandlerFunc(s.editLocationHandler))
+	m.Post("/admin/location/:location/edit", http.HandlerFunc(s.editLocationHandler))
+	m.Get("/admin/location/:location/delete", http.HandlerFunc(s.deleteLocationHandler))
+	m.Post("/admin/location/:location/delete", http.HandlerFunc(s.deleteLocationHandler))
+	m.Post("/admin/location/:location/merge", http.HandlerFunc(s.mergeLocationHandler))
+	m.Get("/admin/location", http.HandlerFunc(s.locationHandler))
+	m.Get("/admin/events/add", http.HandlerFunc(s.addEventHandler))
+	m.Post("/admin/events/add", http.HandlerFunc(s.addEventHandler))
+	m.Get("/admin/events/:event/edit", http.HandlerFunc(s.editEventHandler))
+	m.Post("/admin/events/:event/edit", http.HandlerFunc(s.editEventHandler))
+	m.Post("/admin/events/:event/delete", http.HandlerFunc(s.deleteEventHandler))
+	m.Get("/admin/events/:event/rsvps", http.HandlerFunc(s.adminRSVPsHandler))
+	m.Get("/admin/events/:event/agenda/:session/edit", http.HandlerFunc(s.editSessionHandler))
+	m.Post("/admin/events/:event/agenda/:session/edit", http.HandlerFunc(s.editSessionHandler))
+	m.Post("/admin/events/:event/agenda/:session/delete", http.HandlerFunc(s.deleteSessionHandler))
+	m.Get("/admin/events/:event/agenda", http.HandlerFunc(s.adminAgendaHandler))
+	m.Post("/admin/events/:event/agenda", http.HandlerFunc(s.adminAgendaHandler))
+	m.Get("/admin/events/:event/checkin/count", http.HandlerFunc(s.checkinCountHandler))
+	m.Get("/admin/events/:event/checkin", http.HandlerFunc(s.checkinHandler))
+	m.Post("/admin/events/:event/checkin", http.HandlerFunc(s.checkinHandler))
+	m.Get("/admin/events", http.HandlerFunc(s.adminEventsHandler))
+	m.Get("/admin/speakers/add", http.HandlerFunc(s.addSpeakerHandler))
+	m.Post("/admin/speakers/add", http.HandlerFunc(s.addSpeakerHandler))
+	m.Get("/admin/speakers/:speaker/edit", http.HandlerFunc(s.editSpeakerHandler))
+	m.Post("/admin/speakers/:speaker/edit", http.HandlerFunc(s.editSpeakerHandler))
+	m.Post("/admin/speakers/:speaker/delete", http.HandlerFunc(s.deleteSpeakerHandler))
+	m.Get("/admin/speakers", http.HandlerFunc(s.adminSpeakersHandler))
+	m.Get("/admin/sponsors/add", http.HandlerFunc(s.addSponsorHandler))
+	m.Post("/admin/sponsors/add", http.HandlerFunc(s.addSponsorHandler))
+	m.Post("/admin/sponsors/builtin", http.HandlerFunc(s.builtinSponsorsHandler))
+	m.Get("/admin/sponsors/:sponsor/edit", http.HandlerFunc(s.editSponsorHandler))
+	m.Post("/admin/sponsors/:sponsor/edit", http.HandlerFunc(s.editSponsorHandler))
+	m.Post("/admin/sponsors/:sponsor/delete", http.HandlerFunc(s.deleteSponsorHandler))
+	m.Get("/admin/sponsors", http.HandlerFunc(s.adminSponsorsHandler))
+	m.Get("/admin/tags/add", http.HandlerFunc(s.addTagHandler))
+	m.Post("/admin/tags/add", http.HandlerFunc(s.addTagHandler))
+	m.Get("/admin/tags/:tag/edit", http.HandlerFunc(s.editTagHandler))
+	m.Post("/admin/tags/:tag/edit", http.HandlerFunc(s.editTagHandler))
+	m.Post("/admin/tags/:tag/delete", http.HandlerFunc(s.deleteTagHandler))
+	m.Get("/admin/tags", http.HandlerFunc(s.adminTagsHandler))
+	m.Get("/admin/organizers/add", http.HandlerFunc(s.addOrganizerHandler))
+	m.Post("/admin/organizers/add", http.HandlerFunc(s.addOrganizerHandler))
+	m.Post("/admin/organizers/builtin", http.HandlerFunc(s.builtinOrganizersHandler))
+	m.Get("/admin/organizers/:organizer/edit", http.HandlerFunc(s.editOrganizerHandler))
+	m.Post("/admin/organizers/:organizer/edit", http.HandlerFunc(s.editOrganizerHandler))
+	m.Post("/admin/organizers/:organizer/delete", http.HandlerFunc(s.deleteOrganizerHandler))
+	m.Get("/admin/organizers", http.HandlerFunc(s.adminOrganizersHandler))
+	m.Get("/admin/reports/:report", http.HandlerFunc(s.viewReportHandler))
+	m.Post("/admin/reports/:report", http.HandlerFunc(s.updateReportHandler))
+	m.Get("/admin/reports", http.HandlerFunc(s.adminReportsHandler))
+	m.Get("/admin/tokens", http.HandlerFunc(s.tokensHandler))
+	m.Post("/admin/tokens", http.HandlerFunc(s.tokensHandler))
+	m.Post("/admin/tokens/:token/revoke", http.HandlerFunc(s.revokeTokenHandler))
+	m.Get("/admin/migrate/datetimes", http.HandlerFunc(s.migrateDatetimesHandler))
+	m.Post("/admin/migrate/datetimes", http.HandlerFunc(s.migrateDatetimesHandler))
+	m.Get("/admin/migrate/slugs", http.HandlerFunc(s.migrateSlugsHandler))
+	m.Post("/admin/migrate/slugs", http.HandlerFunc(s.migrateSlugsHandler))
+	m.Get("/admin/search", http.HandlerFunc(s.adminSearchHandler))
+	m.Post("/admin/search", http.HandlerFunc(s.adminSearchHandler))
+	m.Post("/admin/markdown", http.HandlerFunc(s.markdownPreviewHandler))
+	m.Get("/admin", http.HandlerFunc(s.adminRootHandler))
+	m.Get(apiPrefix+"/events/:event", http.HandlerFunc(s.apiEventHandler))
+	m.Get(apiPrefix+"/events", http.HandlerFunc(s.apiEventsHandler))
+	m.Get(apiPrefix+"/learning/:event", http.HandlerFunc(s.apiLearnEventHandler))
+	m.Get(apiPrefix+"/learning", http.HandlerFunc(s.apiLearningHandler))
+	m.Get(apiPrefix+"/locations/:location", http.HandlerFunc(s.apiLocationHandler))
+	m.Get(apiPrefix+"/locations", http.HandlerFunc(s.apiLocationsHandler))
+	m.Get(apiPrefix+"/search", http.HandlerFunc(s.apiSearchHandler))
+	m.Post(apiPrefix+"/events", http.HandlerFunc(s.apiCreateEventHandler))
+	m.Put(apiPrefix+"/events/:event", http.HandlerFunc(s.apiUpdateEventHandler))
+	m.Del(apiPrefix+"/events/:event", http.HandlerFunc(s.apiDeleteEventHandler))
+	m.Post(apiPrefix+"/learning", http.HandlerFunc(s.apiCreateLearnEventHandler))
+	m.Put(apiPrefix+"/learning/:event", http.HandlerFunc(s.apiUpdateLearnEventHandler))
+	m.Del(apiPrefix+"/learning/:event", http.HandlerFunc(s.apiDeleteLearnEventHandler))
+	m.Post(apiPrefix+"/locations", http.HandlerFunc(s.apiCreateLocationHandler))
+	m.Put(apiPrefix+"/locations/:location", http.HandlerFunc(s.apiUpdateLocationHandler))
+	m.Del(apiPrefix+"/locations/:location", http.HandlerFunc(s.apiDeleteLocationHandler))
+	m.Get("/api/", http.HandlerFunc(apiNotFoundHandler))
+	m.Get("/learning/feed.atom", s.learningFeedHandler(s.writeAtom))
+	m.Get("/learning/feed.rss", s.learningFeedHandler(s.writeRSS))
+	m.Get("/learning/archive", http.HandlerFunc(s.learningArchiveHandler))
+	m.Get("/learning/:event/:date", http.HandlerFunc(s.getLearnHandler))
+	m.Get("/learning/:event", http.HandlerFunc(s.getLearnHandler))
+	m.Get("/learning", http.HandlerFunc(s.learningHandler))
+	m.Get("/coc/report", http.HandlerFunc(s.cocReportHandler))
+	m.Post("/coc/report", http.HandlerFunc(s.cocReportHandler))
+	m.Get("/coc", http.HandlerFunc(s.cocHandler))
+	m.Get("/learning.ics", http.HandlerFunc(s.learningICalHandler))
+	m.Get("/events.ics", http.HandlerFunc(s.eventsICalHandler))
+	m.Get("/events/feed.atom", s.eventFeedHandler(s.writeAtom))
+	m.Get("/events/feed.rss", s.eventFeedHandler(s.writeRSS))
+	m.Post("/events/:event/rsvp", http.HandlerFunc(s.rsvpHandler))
+	m.Get("/events/:event/rsvp/:rsvp/ticket", http.HandlerFunc(s.ticketHandler))
+	m.Get("/events/:event/rsvp/:rsvp", http.HandlerFunc(s.manageRSVPHandler))
+	m.Post("/events/:event/rsvp/:rsvp/confirm", http.HandlerFunc(s.confirmRSVPHandler))
+	m.Post("/events/:event/rsvp/:rsvp/cancel", http.HandlerFunc(s.cancelRSVPHandler))
+	m.Get("/events/archive", http.HandlerFunc(s.eventArchiveHandler))
+	m.Get("/events/:event.ics", http.HandlerFunc(s.eventICalHandler))
+	m.Get("/events/:event", http.HandlerFunc(s.getEventHandler))
+	m.Get("/events", http.HandlerFunc(s.eventHandler))
+	m.Get("/speakers/:speaker", http.HandlerFunc(s.speakerHandler))
+	m.Get("/topics/:tag/feed.atom", s.topicFeedHandler(s.writeAtom))
+	m.Get("/topics/:tag/feed.rss", s.topicFeedHandler(s.writeRSS))
+	m.Get("/topics/:tag", http.HandlerFunc(s.topicHandler))
+	m.Get("/topics", http.HandlerFunc(s.topicsHandler))
+	m.Get("/locations/:location", http.HandlerFunc(s.viewLocationHandler))
+	m.Get("/search", http.HandlerFunc(s.searchHandler))
+	m.Get("/about", http.HandlerFunc(s.aboutHandler))
+	m.Get("/", http.HandlerFunc(s.rootHandler))
+	return m, nil
 }
 
 // compileCSS gets the CSS name from the URL, determines if there is a pre-built version
 // and compiles the CSS if need be before serving it to the client
-func compileCSS(w http.ResponseWriter, r *http.Request) {
+func (s *site) compileCSS(w http.ResponseWriter, r *http.Request) {
 	file := r.URL.Query().Get(":file")
 	if file == "" {
-		errorHandler(w, r, http.StatusInternalServerError, "did not get a name of a CSS file")
+		s.errorHandler(w, r, http.StatusInternalServerError, "did not get a name of a CSS file")
 		return
 	}
 
@@ -64,14 +181,14 @@ func compileCSS(w http.ResponseWriter, r *http.Request) {
 	// read the GCSS file
 	css, err := os.Open(f)
 	if err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// close out the file resource once done
 	defer func() {
 		if err := css.Close(); err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 	}()
@@ -82,11 +199,22 @@ func compileCSS(w http.ResponseWriter, r *http.Request) {
 	// build out the CSS and serve it to the browser
 	_, err = gcss.Compile(w, css)
 	if err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
 
+// baseURL returns the scheme and host the request was made to, for building
+// absolute links
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
 // Handle messages that should be written out to the log.  lvl is the level of the message
 // and msg contains the message body
 func logHandler(lvl, msg string) {
@@ -112,84 +240,63 @@ func logTime() string {
 
 // Handle errors here, this allows us to control the format of the output rather
 // than using http.Error() defaults
-func errorHandler(w http.ResponseWriter, r *http.Request, status int, err string) {
-	w.WriteHeader(status)
+func (s *site) errorHandler(w http.ResponseWriter, r *http.Request, status int, err string) {
 	switch status {
 	case http.StatusNotFound:
 		logHandler("ERROR", fmt.Sprintf("client %s tried to request %v", r.RemoteAddr, r.URL.Path))
-		page := template.Must(template.ParseFiles(
-			"static/_base.html",
-			"static/404.html",
-		))
-
-		if err := page.Execute(w, nil); err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
+		s.renderStatus(w, r, status, "404", nil)
 	case http.StatusInternalServerError:
 		logHandler("ERROR", fmt.Sprintf("an internal server error occured when %s requested %s with error:\n%s", r.RemoteAddr, r.URL.Path, err))
-		page := template.Must(template.ParseFiles(
-			"static/_base.html",
-			"static/500.html",
-		))
-
-		if err := page.Execute(w, nil); err != nil {
+		var buf bytes.Buffer
+		if err := s.executePage(&buf, "500", nil, nil); err != nil {
 			// IF for some reason the tempalets for 500 errors fails, fallback
 			// on http.Error()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		w.WriteHeader(status)
+		buf.WriteTo(w)
+	default:
+		w.WriteHeader(status)
 	}
 }
 
 // Handles requests to '/' as well as any unmatched routes to the server
-func rootHandler(w http.ResponseWriter, r *http.Request) {
+func (s *site) rootHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Organizers []Organizer
+		Partners   []sponsorTier
+	}
+
 	// If the request is not for the root of the app, then it is a 404
 	if r.URL.Path != "/" {
-		errorHandler(w, r, http.StatusNotFound, "")
+		s.errorHandler(w, r, http.StatusNotFound, "")
 		return
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/index.html",
-	))
-
-	if err := page.Execute(w, nil); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	organizers, err := s.publicOrganizers(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-}
 
-// Handles requests to /about
-func aboutHandler(w http.ResponseWriter, r *http.Request) {
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/about.html",
-	))
-
-	if err := page.Execute(w, nil); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	partners, err := s.activePartners(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
-}
-
-// Handles requests to /coc
-func cocHandler(w http.ResponseWriter, r *http.Request) {
-	type Organizer struct {
-		Name, Role, Email, GooglePlus, IRC string
-	}
 
-	var organizers []Organizer
-	organizers = append(organizers, Organizer{Name: "Adam Jimerson", Role: "Lead Community Organizer", Email: "vendion@gmail.com", GooglePlus: "https://google.com/+AdamJimerson", IRC: "vendion"})
-
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/coc.html",
-	))
+	s.render(w, r, "index", Content{organizers, partners})
+}
 
-	if err := page.Execute(w, organizers); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+// Handles requests to /about
+func (s *site) aboutHandler(w http.ResponseWriter, r *http.Request) {
+	partners, err := s.activePartners(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	s.render(w, r, "about", partners)
 }
@@ -0,0 +1,524 @@
+package gigcity
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the templates and CSS are loaded relative to the repository root
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+const (
+	testOwner    = "owner@example.com"
+	testPassword = "pw"
+)
+
+// at parses a time in formTimeLayout as UTC
+func at(v string) time.Time {
+	t, err := time.Parse(formTimeLayout, v)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// sentMail is a message recorded by testMailer
+type sentMail struct {
+	To, Subject, Body string
+}
+
+// testMailer records the messages it is asked to send instead of sending them
+type testMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *testMailer) Send(r *http.Request, to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+// testServer is the site running on the memory backend, visited by a client
+// that keeps cookies like a browser
+type testServer struct {
+	*httptest.Server
+	Backend Backend
+	Mail    *testMailer
+	client  *http.Client
+}
+
+func newTestServer(t *testing.T) *testServer {
+	return newTestServerOn(t, newMemoryBackend())
+}
+
+// newTestServerOn is newTestServer running on b
+func newTestServerOn(t *testing.T, b Backend) *testServer {
+	mail := new(testMailer)
+	h, err := NewHandler(b, BasicAuth(testOwner, testPassword), mail, make([]byte, 32), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{Server: httptest.NewServer(h), Backend: b, Mail: mail}
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.client = &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	return ts
+}
+
+// request sends a request to the site without following redirects, signed in
+// as the owner if admin is set, and returns the response and its body
+func (ts *testServer) request(t *testing.T, method, path string, form url.Values, admin bool) (*http.Response, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if admin {
+		req.SetBasicAuth(testOwner, testPassword)
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// csrfInput matches the hidden input admin forms carry their CSRF token in
+var csrfInput = regexp.MustCompile(`name="` + csrfParam + `" value="([0-9a-f]*)"`)
+
+// token loads page as the signed in owner and returns the CSRF token of its
+// form posting to action, or of its first form if none does, like the
+// Markdown preview which posts from script
+func (ts *testServer) token(t *testing.T, page, action string) string {
+	resp, body := ts.request(t, "GET", page, nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s = %d, want %d", page, resp.StatusCode, http.StatusOK)
+	}
+
+	if i := strings.Index(body, `action="`+action+`"`); i >= 0 {
+		body = body[i:]
+	}
+
+	m := csrfInput.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("%s has no form with a CSRF token", page)
+	}
+
+	return m[1]
+}
+
+// submit fills in the admin form shown on page with form and posts it to
+// action, the way a signed in owner's browser would
+func (ts *testServer) submit(t *testing.T, page, action string, form url.Values) *http.Response {
+	v := url.Values{csrfParam: {ts.token(t, page, action)}}
+	for k, vs := range form {
+		v[k] = vs
+	}
+
+	resp, _ := ts.request(t, "POST", action, v, true)
+	return resp
+}
+
+func TestMemoryEvents(t *testing.T) {
+	events := newMemoryBackend().Events(nil)
+	for _, e := range []Event{
+		{ID: "march", Title: "March", Datetime: at("2015-03-04T18:30")},
+		{ID: "may", Title: "May", Datetime: at("2015-05-06T18:30")},
+		{ID: "april", Title: "April", Datetime: at("2015-04-01T18:30")},
+	} {
+		if err := events.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := events.List(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "may" || list[1].ID != "april" {
+		t.Errorf("List(2) = %+v, want may then april", list)
+	}
+
+	if list, _ := events.List(0); len(list) != 3 {
+		t.Errorf("List(0) returned %d events, want all 3", len(list))
+	}
+	if err := events.Add(Event{ID: "march", Title: "Another March"}); err != ErrExists {
+		t.Errorf("Add of a taken ID = %v, want ErrExists", err)
+	}
+
+	e, err := events.Get("april")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Title != "April" {
+		t.Errorf("Get(april) = %+v", e)
+	}
+
+	if _, err := events.Get("june"); err != ErrNotFound {
+		t.Errorf("Get of a missing event = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryLocations(t *testing.T) {
+	b := newMemoryBackend()
+	locations := b.Locations(nil)
+	if err := locations.Add(Location{ID: "hall", Name: "Hall", Address: "1 Street"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := locations.Get("hall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Address != "1 Street" {
+		t.Errorf("Get(hall) = %+v", l)
+	}
+
+	// each kind of record is kept apart
+	if _, err := b.Events(nil).Get("hall"); err != ErrNotFound {
+		t.Errorf("Events().Get of a location's ID = %v, want ErrNotFound", err)
+	}
+	if _, err := b.LearnEvents(nil).Get("hall"); err != ErrNotFound {
+		t.Errorf("LearnEvents().Get of a location's ID = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPublicPages(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.Backend.Locations(nil).Add(Location{ID: "hall", Name: "Town Hall", Address: "1 High Street"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Backend.Events(nil).Add(Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-03-04T18:30"), LocID: "hall"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/", http.StatusOK},
+		{"/events", http.StatusOK},
+		{"/events/go-night", http.StatusOK},
+		{"/learning", http.StatusOK},
+		{"/about", http.StatusOK},
+		{"/coc", http.StatusOK},
+		{"/events/nope", http.StatusNotFound},
+		{"/nope", http.StatusNotFound},
+	} {
+		if resp, _ := ts.request(t, "GET", tt.path, nil, false); resp.StatusCode != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestAdminNeedsSignIn(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, path := range []string{"/admin", "/admin/events/add", "/admin/location"} {
+		if resp, _ := ts.request(t, "GET", path, nil, false); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s signed out = %d, want %d", path, resp.StatusCode, http.StatusUnauthorized)
+		}
+		if resp, _ := ts.request(t, "GET", path, nil, true); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s as the owner = %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	form := url.Values{"name": {"Hall"}, "address": {"1 Street"}}
+	if resp, _ := ts.request(t, "POST", "/admin/location/add", form, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST signed out = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if locations, _ := ts.Backend.Locations(nil).List(0); len(locations) != 0 {
+		t.Errorf("a signed out post saved %d locations", len(locations))
+	}
+}
+
+func TestAdminPostNeedsCSRFToken(t *testing.T) {
+	ts := newTestServer(t)
+	form := url.Values{"name": {"Hall"}, "address": {"1 Street"}}
+
+	if resp, _ := ts.request(t, "POST", "/admin/location/add", form, true); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST without a token = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	ts.token(t, "/admin/location/add", "/admin/location/add")
+	form.Set(csrfParam, "0123456789abcdef0123456789abcdef")
+	if resp, _ := ts.request(t, "POST", "/admin/location/add", form, true); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST with the wrong token = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	locations, err := ts.Backend.Locations(nil).List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 0 {
+		t.Errorf("refused posts saved %d locations", len(locations))
+	}
+}
+
+func TestMultiFormPage(t *testing.T) {
+	ts := newTestServer(t)
+	for _, id := range []string{"one", "two", "three"} {
+		if err := ts.Backend.Events(nil).Add(Event{ID: id, Title: id, Datetime: at("2015-03-04T23:30")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a browser without a token yet loads a page with a form per event and
+	// keeps the cookie it is given
+	resp, body := ts.request(t, "GET", "/admin/events", nil, true)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/events = %d", resp.StatusCode)
+	}
+	if n := len(resp.Header["Set-Cookie"]); n != 1 {
+		t.Errorf("the page set %d cookies, want 1", n)
+	}
+
+	// then submits the first form on it
+	m := regexp.MustCompile(`action="(/admin/events/[^"]+/delete)"`).FindStringSubmatchIndex(body)
+	if m == nil {
+		t.Fatal("no delete form on /admin/events")
+	}
+	action := body[m[2]:m[3]]
+	token := csrfInput.FindStringSubmatch(body[m[0]:])
+	if token == nil {
+		t.Fatal("the delete form has no CSRF token")
+	}
+
+	if resp, _ := ts.request(t, "POST", action, url.Values{csrfParam: {token[1]}}, true); resp.StatusCode != http.StatusFound {
+		t.Errorf("POST %s from the first form = %d, want %d", action, resp.StatusCode, http.StatusFound)
+	}
+}
+
+func TestAddEvent(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp := ts.submit(t, "/admin/location/add", "/admin/location/add", url.Values{
+		"name":     {"Town Hall"},
+		"address":  {"1 High Street"},
+		"timezone": {"Europe/London"},
+	})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("adding a location = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	resp = ts.submit(t, "/admin/events/add", "/admin/events/add", url.Values{
+		"title":    {"Go Night"},
+		"date":     {"2030-07-04T18:30"},
+		"location": {"town-hall"},
+		"gplus":    {"https://plus.google.com/events/1"},
+		"details":  {"Lightning talks"},
+	})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("adding an event = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	resp, body := ts.request(t, "GET", "/events/go-night", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /events/go-night = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(body, "1 High Street") {
+		t.Error("the event page doesn't show its location")
+	}
+
+	// the time is read in the location's time zone and stored in UTC
+	e, err := ts.Backend.Events(nil).Get("go-night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := at("2030-07-04T17:30"); !e.Datetime.Equal(want) || e.TimeZone != "Europe/London" {
+		t.Errorf("event is at %s in %q, want %s in Europe/London", e.Datetime, e.TimeZone, want)
+	}
+}
+
+func TestEditDeleteEvent(t *testing.T) {
+	ts := newTestServer(t)
+	events := ts.Backend.Events(nil)
+	if err := events.Add(Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-03-04T18:30"), LocID: "hall"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := ts.request(t, "GET", "/admin/events/go-night/edit", nil, true)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `value="Go Night"`) {
+		t.Errorf("the edit form = %d, want it filled in with the event", resp.StatusCode)
+	}
+
+	resp = ts.submit(t, "/admin/events/go-night/edit", "/admin/events/go-night/edit", url.Values{
+		"title":    {"Go Night Two"},
+		"date":     {"2015-03-04T19:00"},
+		"location": {"hall"},
+		"gplus":    {"https://plus.google.com/events/1"},
+		"details":  {"More talks"},
+	})
+	// a new title moves the event to a new slug, the old one redirects
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/events/go-night-two" {
+		t.Errorf("editing = %d to %q, want a redirect to the renamed event", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	e, err := events.Get("go-night-two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Title != "Go Night Two" || e.FormDatetime() != "2015-03-04T19:00" {
+		t.Errorf("edited event = %+v", e)
+	}
+	if _, err := events.Get("go-night"); err != ErrNotFound {
+		t.Errorf("Get of the old slug = %v, want ErrNotFound", err)
+	}
+	if resp, _ := ts.request(t, "GET", "/events/go-night", nil, false); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/events/go-night-two" {
+		t.Errorf("GET of the old slug = %d to %q, want a redirect to the new one", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	if resp := ts.submit(t, "/admin/events", "/admin/events/go-night-two/delete", url.Values{}); resp.StatusCode != http.StatusFound {
+		t.Errorf("deleting = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if _, err := events.Get("go-night-two"); err != ErrNotFound {
+		t.Errorf("Get after delete = %v, want ErrNotFound", err)
+	}
+	// the old slug no longer leads anywhere, and is free again
+	if resp, _ := ts.request(t, "GET", "/events/go-night", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of the old slug after delete = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	if resp := ts.submit(t, "/admin/events/add", "/admin/events/go-night-two/delete", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting again = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp, _ := ts.request(t, "GET", "/admin/events/go-night-two/edit", nil, true); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("editing a deleted event = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEditDeleteLearnEvent(t *testing.T) {
+	ts := newTestServer(t)
+	learn := ts.Backend.LearnEvents(nil)
+
+	resp := ts.submit(t, "/admin/learn/add", "/admin/learn/add", url.Values{
+		"title":    {"Go Study"},
+		"date":     {"2015-03-03T18:30"},
+		"location": {"hall"},
+		"details":  {"Bring a laptop"},
+	})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("adding = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	if resp, body := ts.request(t, "GET", "/admin/learn", nil, true); resp.StatusCode != http.StatusOK || !strings.Contains(body, "/admin/learn/go-study/edit") {
+		t.Errorf("the study group list = %d, want it to link to the new group", resp.StatusCode)
+	}
+
+	resp = ts.submit(t, "/admin/learn/go-study/edit", "/admin/learn/go-study/edit", url.Values{
+		"title":    {"Go Study"},
+		"date":     {"2015-03-10T18:30"},
+		"location": {"hall"},
+		"details":  {"Bring a laptop"},
+	})
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("editing = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if l, err := learn.Get("go-study"); err != nil || l.FormDatetime() != "2015-03-10T18:30" {
+		t.Errorf("edited study group = %+v, %v", l, err)
+	}
+
+	if resp := ts.submit(t, "/admin/learn", "/admin/learn/go-study/delete", url.Values{}); resp.StatusCode != http.StatusFound {
+		t.Errorf("deleting = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if _, err := learn.Get("go-study"); err != ErrNotFound {
+		t.Errorf("Get after delete = %v, want ErrNotFound", err)
+	}
+	if resp := ts.submit(t, "/admin/learn/add", "/admin/learn/go-study/delete", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting again = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestDeleteAndMergeLocation(t *testing.T) {
+	ts := newTestServer(t)
+	locations := ts.Backend.Locations(nil)
+	for _, l := range []Location{
+		{ID: "hall", Name: "Hall", Address: "1 Street"},
+		{ID: "library", Name: "Library", Address: "2 Street"},
+		{ID: "unused", Name: "Unused", Address: "3 Street"},
+	} {
+		if err := locations.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Backend.Events(nil).Add(Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-03-04T18:30"), LocID: "hall"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Backend.LearnEvents(nil).Add(LearnEvent{ID: "go-study", Title: "Go Study", Datetime: at("2015-03-03T18:30"), LocID: "hall"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a location that is in use can't just be deleted
+	resp, body := ts.request(t, "GET", "/admin/location/hall/delete", nil, true)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Go Night") || !strings.Contains(body, "Go Study") {
+		t.Errorf("the delete page = %d, want it to list the event and study group", resp.StatusCode)
+	}
+	if resp := ts.submit(t, "/admin/location/hall/delete", "/admin/location/hall/delete", url.Values{}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("deleting a location in use = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	if resp := ts.submit(t, "/admin/location/unused/delete", "/admin/location/unused/delete", url.Values{}); resp.StatusCode != http.StatusFound {
+		t.Errorf("deleting an unused location = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if _, err := locations.Get("unused"); err != ErrNotFound {
+		t.Errorf("Get after delete = %v, want ErrNotFound", err)
+	}
+
+	for _, into := range []string{"", "hall", "nope"} {
+		resp := ts.submit(t, "/admin/location/hall/delete", "/admin/location/hall/merge", url.Values{"into": {into}})
+		if resp.StatusCode == http.StatusFound {
+			t.Errorf("merging into %q was accepted", into)
+		}
+	}
+
+	resp = ts.submit(t, "/admin/location/hall/delete", "/admin/location/hall/merge", url.Values{"into": {"library"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("merging = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if _, err := locations.Get("hall"); err != ErrNotFound {
+		t.Errorf("Get of the merged location = %v, want ErrNotFound", err)
+	}
+	if e, _ := ts.Backend.Events(nil).Get("go-night"); e.LocID != "library" {
+		t.Errorf("event is at %q after the merge, want library", e.LocID)
+	}
+	if l, _ := ts.Backend.LearnEvents(nil).Get("go-study"); l.LocID != "library" {
+		t.Errorf("study group is at %q after the merge, want library", l.LocID)
+	}
+}
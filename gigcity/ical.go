@@ -0,0 +1,260 @@
+package gigcity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// uidDomain is the domain part of the iCalendar UIDs handed out to events
+const uidDomain = "gdggigcity.com"
+
+// defaultEventLength is how long calendar entries last, events don't record
+// an end time
+const defaultEventLength = 2 * time.Hour
+
+// icalTimeLayout is the RFC 5545 UTC DATE-TIME format
+const icalTimeLayout = "20060102T150405Z"
+
+// newUID returns a random iCalendar UID.  It is generated once when a record
+// is created and never changes, so calendar apps can track the record through
+// edits and renames
+func newUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to the clock, still unique enough for a chapter's events
+		return fmt.Sprintf("%d@%s", time.Now().UnixNano(), uidDomain)
+	}
+
+	return hex.EncodeToString(b) + "@" + uidDomain
+}
+
+// CalendarUID returns the event's iCalendar UID.  Events created before UIDs
+// were stored get one derived from their ID
+func (e Event) CalendarUID() string {
+	if e.UID != "" {
+		return e.UID
+	}
+
+	return "events-" + e.ID + "@" + uidDomain
+}
+
+// CalendarUID returns the study group's iCalendar UID.  Study groups created
+// before UIDs were stored get one derived from their ID
+func (l LearnEvent) CalendarUID() string {
+	if l.UID != "" {
+		return l.UID
+	}
+
+	return "learning-" + l.ID + "@" + uidDomain
+}
+
+// vevent is a single entry in an iCalendar feed
+type vevent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	// Cancelled keeps a called off meeting on the calendar, marked so that
+	// subscribers' calendars drop it
+	Cancelled bool
+}
+
+// icalEscaper escapes TEXT values as required by RFC 5545 section 3.3.11
+var icalEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// writeICalLine writes a content line, folding it so no line is longer than
+// 75 octets
+func writeICalLine(buf *bytes.Buffer, name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		// don't split a multi-byte UTF-8 sequence
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+
+		buf.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space, which counts towards the
+		// limit
+		limit = 74
+	}
+
+	buf.WriteString(line + "\r\n")
+}
+
+// writeCalendar renders events as an RFC 5545 calendar named name
+func writeCalendar(w io.Writer, name string, events []vevent) error {
+	var buf bytes.Buffer
+	stamp := time.Now().UTC().Format(icalTimeLayout)
+
+	writeICalLine(&buf, "BEGIN", "VCALENDAR")
+	writeICalLine(&buf, "VERSION", "2.0")
+	writeICalLine(&buf, "PRODID", "-//GDG Gigcity//gigcity-site//EN")
+	writeICalLine(&buf, "CALSCALE", "GREGORIAN")
+	writeICalLine(&buf, "METHOD", "PUBLISH")
+	writeICalLine(&buf, "X-WR-CALNAME", icalEscaper.Replace(name))
+	for _, e := range events {
+		// an event without a date can't go on a calendar
+		if e.Start.IsZero() {
+			continue
+		}
+
+		writeICalLine(&buf, "BEGIN", "VEVENT")
+		writeICalLine(&buf, "UID", e.UID)
+		writeICalLine(&buf, "DTSTAMP", stamp)
+		writeICalLine(&buf, "DTSTART", e.Start.UTC().Format(icalTimeLayout))
+		writeICalLine(&buf, "DTEND", e.Start.Add(defaultEventLength).UTC().Format(icalTimeLayout))
+		writeICalLine(&buf, "SUMMARY", icalEscaper.Replace(e.Summary))
+		if e.Description != "" {
+			writeICalLine(&buf, "DESCRIPTION", icalEscaper.Replace(e.Description))
+		}
+		if e.Location != "" {
+			writeICalLine(&buf, "LOCATION", icalEscaper.Replace(e.Location))
+		}
+		writeICalLine(&buf, "URL", e.URL)
+		if e.Cancelled {
+			writeICalLine(&buf, "STATUS", "CANCELLED")
+		}
+		writeICalLine(&buf, "END", "VEVENT")
+	}
+	writeICalLine(&buf, "END", "VCALENDAR")
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// locationAddresses maps every location ID to its address
+func (s *site) locationAddresses(r *http.Request) (map[string]string, error) {
+	locations, err := s.backend.Locations(r).List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]string, len(locations))
+	for _, l := range locations {
+		addresses[l.ID] = l.Address
+	}
+
+	return addresses, nil
+}
+
+// eventVEvent converts e to a calendar entry
+func eventVEvent(r *http.Request, e Event, address string) vevent {
+	return vevent{
+		UID:         e.CalendarUID(),
+		Summary:     e.Title,
+		Description: e.Details,
+		Location:    address,
+		URL:         baseURL(r) + "/events/" + e.ID,
+		Start:       e.Datetime,
+	}
+}
+
+// serveCalendar writes a calendar with the right headers.  A non empty
+// filename makes browsers download it rather than subscribe
+func serveCalendar(w http.ResponseWriter, r *http.Request, name, filename string, events []vevent) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if filename != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+
+	if err := writeCalendar(w, name, events); err != nil {
+		logHandler("ERROR", "writing calendar failed: "+err.Error())
+	}
+}
+
+// Handles requests to /events.ics
+func (s *site) eventsICalHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := s.backend.Events(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	addresses, err := s.locationAddresses(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	entries := make([]vevent, 0, len(events))
+	for _, e := range events {
+		entries = append(entries, eventVEvent(r, e, addresses[e.LocID]))
+	}
+
+	serveCalendar(w, r, "GDG Gigcity Events", "", entries)
+}
+
+// Handles requests to /events/:event.ics, a single event for the "Add to
+// calendar" button
+func (s *site) eventICalHandler(w http.ResponseWriter, r *http.Request) {
+	eventID := r.URL.Query().Get(":event")
+	e, err := s.backend.Events(r).Get(eventID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "Events", eventID, "/events/", ".ics") {
+			s.errorHandler(w, r, http.StatusNotFound, "")
+		}
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	l, err := s.backend.Locations(r).Get(e.LocID)
+	if err != nil && err != ErrNotFound {
+		logHandler("ERROR", fmt.Sprintf("fetching location details failed: %v", err))
+	}
+
+	serveCalendar(w, r, e.Title, e.ID+".ics", []vevent{eventVEvent(r, e, l.Address)})
+}
+
+// Handles requests to /learning.ics
+func (s *site) learningICalHandler(w http.ResponseWriter, r *http.Request) {
+	learn, err := s.backend.LearnEvents(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	addresses, err := s.locationAddresses(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// each meeting of a repeating study group is its own entry, so moved
+	// ones don't need a time zone definition and RECURRENCE-IDs
+	entries := make([]vevent, 0, len(learn))
+	for _, l := range learn {
+		for _, o := range l.Occurrences() {
+			entries = append(entries, vevent{
+				UID:         o.CalendarUID(),
+				Summary:     o.Title,
+				Description: o.Details,
+				Location:    addresses[o.LocID],
+				URL:         baseURL(r) + o.Link(),
+				Start:       o.Datetime,
+				Cancelled:   o.Cancelled,
+			})
+		}
+	}
+
+	serveCalendar(w, r, "GDG Gigcity Study Groups", "", entries)
+}
@@ -0,0 +1,114 @@
+package gigcity
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWriteICalLine(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+	}{
+		{"SUMMARY", "Go Night"},
+		{"SUMMARY", strings.Repeat("x", 75-len("SUMMARY:"))},
+		{"SUMMARY", strings.Repeat("x", 76-len("SUMMARY:"))},
+		{"DESCRIPTION", strings.Repeat("abcdefghij", 30)},
+		{"DESCRIPTION", strings.Repeat("é", 100)},
+		{"DESCRIPTION", "x" + strings.Repeat("日本語", 40)},
+	} {
+		var buf bytes.Buffer
+		writeICalLine(&buf, tt.name, tt.value)
+		out := buf.String()
+
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Errorf("%s line doesn't end in CRLF: %q", tt.name, out)
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		var unfolded string
+		for i, line := range lines {
+			if len(line) > 75 {
+				t.Errorf("%s line %d is %d octets, want at most 75", tt.name, i, len(line))
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("%s line %d splits a UTF-8 sequence: %q", tt.name, i, line)
+			}
+			if i > 0 {
+				if !strings.HasPrefix(line, " ") {
+					t.Errorf("%s continuation line %d doesn't start with a space: %q", tt.name, i, line)
+				}
+				line = line[1:]
+			}
+			unfolded += line
+		}
+
+		if want := tt.name + ":" + tt.value; unfolded != want {
+			t.Errorf("%s unfolds to %q, want %q", tt.name, unfolded, want)
+		}
+		if len(tt.name)+1+len(tt.value) <= 75 && len(lines) != 1 {
+			t.Errorf("%s line of %d octets was folded", tt.name, len(tt.name)+1+len(tt.value))
+		}
+	}
+}
+
+func TestICalEscaper(t *testing.T) {
+	got := icalEscaper.Replace("Talks; food, drinks\r\nC:\\go\nend")
+	want := `Talks\; food\, drinks\nC:\\go\nend`
+	if got != want {
+		t.Errorf("escaped to %q, want %q", got, want)
+	}
+}
+
+func TestEventsICal(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.Backend.Locations(nil).Add(Location{ID: "hall", Name: "Hall", Address: "1 High Street, Chattanooga"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Event{
+		{ID: "go-night", UID: "fixed@example.com", Title: "Go; night, again", Datetime: at("2015-03-04T23:30"), LocID: "hall"},
+		// an event without a date is left off
+		{ID: "tba", Title: "To be announced"},
+	} {
+		if err := ts.Backend.Events(nil).Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := ts.request(t, "GET", "/events.ics", nil, false)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/calendar") {
+		t.Fatalf("GET /events.ics = %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:fixed@example.com\r\n",
+		"DTSTART:20150304T233000Z\r\n",
+		"DTEND:20150305T013000Z\r\n",
+		`SUMMARY:Go\; night\, again` + "\r\n",
+		`LOCATION:1 High Street\, Chattanooga` + "\r\n",
+		"URL:" + ts.URL + "/events/go-night\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("calendar is missing %q", want)
+		}
+	}
+	if n := strings.Count(body, "BEGIN:VEVENT"); n != 1 {
+		t.Errorf("calendar has %d events, want 1", n)
+	}
+
+	resp, body = ts.request(t, "GET", "/events/go-night.ics", nil, false)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), `filename="go-night.ics"`) {
+		t.Errorf("GET /events/go-night.ics = %d %q, want a download", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+	if !strings.Contains(body, "UID:fixed@example.com") {
+		t.Error("single event calendar is missing the event")
+	}
+	if resp, _ := ts.request(t, "GET", "/events/nope.ics", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /events/nope.ics = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,1037 @@
+package gigcity
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kv is the minimal key/value layer shared by the non datastore backends.
+// Records are grouped into buckets (one per entity kind) and keyed by their
+// ID.  Implementations must return ErrNotFound from Get for missing keys
+type kv interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	// PutNew is Put, but returns ErrExists instead if key is already in
+	// bucket.  The check and the write must be atomic
+	PutNew(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// ForEach calls fn for every record in bucket, in key order
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+}
+
+// kvBackend implements Backend on top of any kv.  Records are stored JSON
+// encoded so callers never share memory with the backend
+type kvBackend struct {
+	db kv
+	// mu serializes read-modify-write sequences, like RSVPStore.Atomically
+	mu *sync.Mutex
+}
+
+func (b kvBackend) Events(r *http.Request) EventStore {
+	return kvEvents{b}
+}
+
+func (b kvBackend) LearnEvents(r *http.Request) LearnEventStore {
+	return kvLearnEvents{b}
+}
+
+func (b kvBackend) Locations(r *http.Request) LocationStore {
+	return kvLocations{b}
+}
+
+func (b kvBackend) Speakers(r *http.Request) SpeakerStore {
+	return kvSpeakers{b}
+}
+
+func (b kvBackend) Sponsors(r *http.Request) SponsorStore {
+	return kvSponsors{b}
+}
+
+func (b kvBackend) Tags(r *http.Request) TagStore {
+	return kvTags{b}
+}
+
+func (b kvBackend) Organizers(r *http.Request) OrganizerStore {
+	return kvOrganizers{b}
+}
+
+func (b kvBackend) Reports(r *http.Request) ReportStore {
+	return kvReports{b}
+}
+
+func (b kvBackend) Audit(r *http.Request) AuditStore {
+	return kvAudit{b}
+}
+
+func (b kvBackend) Redirects(r *http.Request) RedirectStore {
+	return kvRedirects{b}
+}
+
+func (b kvBackend) Tokens(r *http.Request) TokenStore {
+	return kvTokens{b}
+}
+
+func (b kvBackend) RSVPs(r *http.Request) RSVPStore {
+	return kvRSVPs{b}
+}
+
+func (b kvBackend) Sessions(r *http.Request) SessionStore {
+	return kvSessions{b}
+}
+
+func (b kvBackend) Search(r *http.Request) SearchIndex {
+	return kvSearch{b}
+}
+
+func (b kvBackend) Secrets(r *http.Request) SecretStore {
+	return kvSecrets{b}
+}
+
+// get decodes the record stored under bucket/key into v
+func (b kvBackend) get(bucket, key string, v interface{}) error {
+	data, err := b.db.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// put encodes v and stores it under bucket/key
+func (b kvBackend) put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Put(bucket, key, data)
+}
+
+// insert encodes v and stores it under bucket/key, or returns ErrExists if
+// there is a record there already
+func (b kvBackend) insert(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.db.PutNew(bucket, key, data)
+}
+
+// replace overwrites the existing record stored under bucket/oldKey with v,
+// moving it to newKey if the two differ.  Moving onto another record's key
+// returns ErrExists
+func (b kvBackend) replace(bucket, oldKey, newKey string, v interface{}) error {
+	if _, err := b.db.Get(bucket, oldKey); err != nil {
+		return err
+	}
+
+	if oldKey == newKey {
+		return b.put(bucket, newKey, v)
+	}
+
+	if err := b.insert(bucket, newKey, v); err != nil {
+		return err
+	}
+
+	return b.db.Delete(bucket, oldKey)
+}
+
+// remove deletes the existing record stored under bucket/key
+func (b kvBackend) remove(bucket, key string) error {
+	if _, err := b.db.Get(bucket, key); err != nil {
+		return err
+	}
+
+	return b.db.Delete(bucket, key)
+}
+
+// each decodes every record in bucket with newRecord and passes it to fn
+func (b kvBackend) each(bucket string, newRecord func() interface{}, fn func(v interface{})) error {
+	return b.db.ForEach(bucket, func(key string, value []byte) error {
+		v := newRecord()
+		if err := json.Unmarshal(value, v); err != nil {
+			return err
+		}
+
+		fn(v)
+		return nil
+	})
+}
+
+// byDatetime sorts events newest first, matching the datastore's
+// Order("-Datetime")
+type byDatetime []Event
+
+func (e byDatetime) Len() int           { return len(e) }
+func (e byDatetime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byDatetime) Less(i, j int) bool { return e[i].Datetime.After(e[j].Datetime) }
+
+type kvEvents struct {
+	kvBackend
+}
+
+func (s kvEvents) List(limit int) ([]Event, error) {
+	var events []Event
+	err := s.each("Events", func() interface{} { return new(Event) }, func(v interface{}) {
+		events = append(events, *v.(*Event))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(byDatetime(events))
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+func (s kvEvents) Range(q RangeQuery) ([]Event, string, error) {
+	events, err := s.List(0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if q.contains(e.Datetime) && q.tagged(e.TagIDs) {
+			matched = append(matched, e)
+		}
+	}
+
+	if !q.Desc {
+		sort.Stable(sort.Reverse(byDatetime(matched)))
+	}
+
+	start, end, next, err := kvPage(len(matched), q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return matched[start:end], next, nil
+}
+
+// kvPage works out which of n matching records are on the page q asks for.
+// The kv backends' cursors are simply the offset of the next page
+func kvPage(n int, q RangeQuery) (start, end int, next string, err error) {
+	if q.Cursor != "" {
+		start, err = strconv.Atoi(q.Cursor)
+		if err != nil || start < 0 {
+			return 0, 0, "", ErrBadCursor
+		}
+	}
+
+	if start > n {
+		start = n
+	}
+
+	end = start + q.Limit
+	if end >= n {
+		return start, n, "", nil
+	}
+
+	return start, end, strconv.Itoa(end), nil
+}
+
+func (s kvEvents) Get(id string) (Event, error) {
+	var e Event
+	err := s.get("Events", id, &e)
+	return e, err
+}
+
+func (s kvEvents) Add(e Event) error {
+	return s.insert("Events", e.ID, e)
+}
+
+// Update holds the lock RSVPStore.Atomically takes, so an RSVP can't be
+// added under the old ID while the event's children are moved
+func (s kvEvents) Update(id string, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.replace("Events", id, e.ID, e); err != nil {
+		return err
+	}
+
+	// RSVPs and sessions are keyed by their event's ID, move them along with
+	// it
+	if id == e.ID {
+		return nil
+	}
+
+	return s.moveChildren(id, e.ID)
+}
+
+// Delete holds the lock like Update does
+func (s kvEvents) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.remove("Events", id); err != nil {
+		return err
+	}
+
+	return s.moveChildren(id, "")
+}
+
+// moveChildren moves the RSVPs and sessions of the event with ID oldID to
+// newID, or deletes them if newID is empty
+func (s kvEvents) moveChildren(oldID, newID string) error {
+	for _, bucket := range []string{"RSVP", "Session"} {
+		if err := s.move(bucket, oldID, newID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s kvEvents) ByLocation(locID string) ([]Event, error) {
+	events, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if e.LocID == locID {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched, nil
+}
+
+func (s kvEvents) BySpeaker(speakerID string) ([]Event, error) {
+	events, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if e.HasSpeaker(speakerID) {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched, nil
+}
+
+func (s kvEvents) BySponsor(sponsorID string) ([]Event, error) {
+	events, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if e.HasSponsor(sponsorID) {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched, nil
+}
+
+func (s kvEvents) ByTag(tagID string) ([]Event, error) {
+	events, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Event
+	for _, e := range events {
+		if e.HasTag(tagID) {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched, nil
+}
+
+type kvLearnEvents struct {
+	kvBackend
+}
+
+func (s kvLearnEvents) List(limit int) ([]LearnEvent, error) {
+	var learn []LearnEvent
+	err := s.each("LearnEvent", func() interface{} { return new(LearnEvent) }, func(v interface{}) {
+		learn = append(learn, *v.(*LearnEvent))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(learn) > limit {
+		learn = learn[:limit]
+	}
+
+	return learn, nil
+}
+
+// learnByDatetime sorts study groups oldest first
+type learnByDatetime []LearnEvent
+
+func (l learnByDatetime) Len() int           { return len(l) }
+func (l learnByDatetime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l learnByDatetime) Less(i, j int) bool { return l[i].Datetime.Before(l[j].Datetime) }
+
+func (s kvLearnEvents) Range(q RangeQuery) ([]Occurrence, string, error) {
+	learn, err := s.List(0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return occurrenceRange(learn, q)
+}
+
+func (s kvLearnEvents) Get(id string) (LearnEvent, error) {
+	var l LearnEvent
+	err := s.get("LearnEvent", id, &l)
+	return l, err
+}
+
+func (s kvLearnEvents) Add(l LearnEvent) error {
+	return s.insert("LearnEvent", l.ID, l)
+}
+
+func (s kvLearnEvents) Update(id string, l LearnEvent) error {
+	return s.replace("LearnEvent", id, l.ID, l)
+}
+
+func (s kvLearnEvents) Delete(id string) error {
+	return s.remove("LearnEvent", id)
+}
+
+func (s kvLearnEvents) ByLocation(locID string) ([]LearnEvent, error) {
+	learn, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []LearnEvent
+	for _, l := range learn {
+		if l.LocID == locID {
+			matched = append(matched, l)
+		}
+	}
+
+	return matched, nil
+}
+
+func (s kvLearnEvents) ByTag(tagID string) ([]LearnEvent, error) {
+	learn, err := s.List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []LearnEvent
+	for _, l := range learn {
+		if l.HasTag(tagID) {
+			matched = append(matched, l)
+		}
+	}
+
+	return matched, nil
+}
+
+type kvLocations struct {
+	kvBackend
+}
+
+func (s kvLocations) List(limit int) ([]Location, error) {
+	var locations []Location
+	err := s.each("Locations", func() interface{} { return new(Location) }, func(v interface{}) {
+		locations = append(locations, *v.(*Location))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(locations) > limit {
+		locations = locations[:limit]
+	}
+
+	return locations, nil
+}
+
+func (s kvLocations) Get(id string) (Location, error) {
+	var l Location
+	err := s.get("Locations", id, &l)
+	return l, err
+}
+
+func (s kvLocations) Add(l Location) error {
+	return s.insert("Locations", l.ID, l)
+}
+
+func (s kvLocations) Update(id string, l Location) error {
+	return s.replace("Locations", id, l.ID, l)
+}
+
+func (s kvLocations) Delete(id string) error {
+	return s.remove("Locations", id)
+}
+
+type kvSpeakers struct {
+	kvBackend
+}
+
+func (s kvSpeakers) List(limit int) ([]Speaker, error) {
+	var speakers []Speaker
+	err := s.each("Speakers", func() interface{} { return new(Speaker) }, func(v interface{}) {
+		speakers = append(speakers, *v.(*Speaker))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(speakers) > limit {
+		speakers = speakers[:limit]
+	}
+
+	return speakers, nil
+}
+
+func (s kvSpeakers) Get(id string) (Speaker, error) {
+	var sp Speaker
+	err := s.get("Speakers", id, &sp)
+	return sp, err
+}
+
+func (s kvSpeakers) Add(sp Speaker) error {
+	return s.insert("Speakers", sp.ID, sp)
+}
+
+func (s kvSpeakers) Update(id string, sp Speaker) error {
+	return s.replace("Speakers", id, sp.ID, sp)
+}
+
+func (s kvSpeakers) Delete(id string) error {
+	return s.remove("Speakers", id)
+}
+
+type kvSponsors struct {
+	kvBackend
+}
+
+func (s kvSponsors) List(limit int) ([]Sponsor, error) {
+	var sponsors []Sponsor
+	err := s.each("Sponsors", func() interface{} { return new(Sponsor) }, func(v interface{}) {
+		sponsors = append(sponsors, *v.(*Sponsor))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(sponsors) > limit {
+		sponsors = sponsors[:limit]
+	}
+
+	return sponsors, nil
+}
+
+func (s kvSponsors) Get(id string) (Sponsor, error) {
+	var sp Sponsor
+	err := s.get("Sponsors", id, &sp)
+	return sp, err
+}
+
+func (s kvSponsors) Add(sp Sponsor) error {
+	return s.insert("Sponsors", sp.ID, sp)
+}
+
+func (s kvSponsors) Update(id string, sp Sponsor) error {
+	return s.replace("Sponsors", id, sp.ID, sp)
+}
+
+func (s kvSponsors) Delete(id string) error {
+	return s.remove("Sponsors", id)
+}
+
+type kvTags struct {
+	kvBackend
+}
+
+func (s kvTags) List(limit int) ([]Tag, error) {
+	var tags []Tag
+	err := s.each("Tags", func() interface{} { return new(Tag) }, func(v interface{}) {
+		tags = append(tags, *v.(*Tag))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(tags) > limit {
+		tags = tags[:limit]
+	}
+
+	return tags, nil
+}
+
+func (s kvTags) Get(id string) (Tag, error) {
+	var t Tag
+	err := s.get("Tags", id, &t)
+	return t, err
+}
+
+func (s kvTags) Add(t Tag) error {
+	return s.insert("Tags", t.ID, t)
+}
+
+func (s kvTags) Update(id string, t Tag) error {
+	return s.replace("Tags", id, t.ID, t)
+}
+
+func (s kvTags) Delete(id string) error {
+	return s.remove("Tags", id)
+}
+
+type kvOrganizers struct {
+	kvBackend
+}
+
+func (s kvOrganizers) List(limit int) ([]Organizer, error) {
+	var organizers []Organizer
+	err := s.each("Organizers", func() interface{} { return new(Organizer) }, func(v interface{}) {
+		organizers = append(organizers, *v.(*Organizer))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(organizers) > limit {
+		organizers = organizers[:limit]
+	}
+
+	return organizers, nil
+}
+
+func (s kvOrganizers) Get(id string) (Organizer, error) {
+	var o Organizer
+	err := s.get("Organizers", id, &o)
+	return o, err
+}
+
+func (s kvOrganizers) Add(o Organizer) error {
+	return s.insert("Organizers", o.ID, o)
+}
+
+func (s kvOrganizers) Update(id string, o Organizer) error {
+	return s.replace("Organizers", id, o.ID, o)
+}
+
+func (s kvOrganizers) Delete(id string) error {
+	return s.remove("Organizers", id)
+}
+
+type kvReports struct {
+	kvBackend
+}
+
+func (s kvReports) List() ([]Report, error) {
+	var reports []Report
+	err := s.each("Report", func() interface{} { return new(Report) }, func(v interface{}) {
+		reports = append(reports, *v.(*Report))
+	})
+
+	return reports, err
+}
+
+func (s kvReports) Get(id string) (Report, error) {
+	var rep Report
+	err := s.get("Report", id, &rep)
+	return rep, err
+}
+
+func (s kvReports) Add(rep Report) error {
+	return s.put("Report", rep.ID, rep)
+}
+
+// Modify holds the lock for the whole read and write, like
+// kvRSVPs.Atomically
+func (s kvReports) Modify(id string, fn func(*Report) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rep, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&rep); err != nil {
+		return err
+	}
+
+	return s.replace("Report", id, id, rep)
+}
+
+type kvRedirects struct {
+	kvBackend
+}
+
+func (s kvRedirects) Lookup(kind, old string) (string, error) {
+	slug, err := s.db.Get("SlugRedirect", kind+"/"+old)
+	return string(slug), err
+}
+
+func (s kvRedirects) Add(kind, old, slug string) error {
+	return s.db.Put("SlugRedirect", kind+"/"+old, []byte(slug))
+}
+
+func (s kvRedirects) Remove(kind, old string) error {
+	return s.db.Delete("SlugRedirect", kind+"/"+old)
+}
+
+func (s kvRedirects) Renamed(kind, slug string) ([]string, error) {
+	var olds []string
+	prefix := kind + "/"
+	err := s.db.ForEach("SlugRedirect", func(key string, value []byte) error {
+		if strings.HasPrefix(key, prefix) && string(value) == slug {
+			olds = append(olds, strings.TrimPrefix(key, prefix))
+		}
+		return nil
+	})
+
+	return olds, err
+}
+
+type kvTokens struct {
+	kvBackend
+}
+
+func (s kvTokens) List() ([]APIToken, error) {
+	var tokens []APIToken
+	err := s.each("APIToken", func() interface{} { return new(APIToken) }, func(v interface{}) {
+		tokens = append(tokens, *v.(*APIToken))
+	})
+
+	return tokens, err
+}
+
+func (s kvTokens) Get(id string) (APIToken, error) {
+	var t APIToken
+	err := s.get("APIToken", id, &t)
+	return t, err
+}
+
+func (s kvTokens) Add(t APIToken) error {
+	return s.put("APIToken", t.ID, t)
+}
+
+func (s kvTokens) Delete(id string) error {
+	return s.remove("APIToken", id)
+}
+
+// kvRSVPs keys RSVPs by their event's ID and their own, the kv equivalent of
+// a child entity
+type kvRSVPs struct {
+	kvBackend
+}
+
+func (s kvRSVPs) List(eventID string) ([]RSVP, error) {
+	if _, err := s.db.Get("Events", eventID); err != nil {
+		return nil, err
+	}
+
+	var rsvps []RSVP
+	prefix := eventID + "/"
+	err := s.db.ForEach("RSVP", func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		var v RSVP
+		if err := json.Unmarshal(value, &v); err != nil {
+			return err
+		}
+
+		rsvps = append(rsvps, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(rsvpsByCreated(rsvps))
+	return rsvps, nil
+}
+
+func (s kvRSVPs) Get(eventID, id string) (RSVP, error) {
+	var v RSVP
+	err := s.get("RSVP", eventID+"/"+id, &v)
+	return v, err
+}
+
+func (s kvRSVPs) Add(eventID string, v RSVP) error {
+	if _, err := s.db.Get("Events", eventID); err != nil {
+		return err
+	}
+
+	return s.put("RSVP", eventID+"/"+v.ID, v)
+}
+
+func (s kvRSVPs) Update(eventID string, v RSVP) error {
+	return s.replace("RSVP", eventID+"/"+v.ID, eventID+"/"+v.ID, v)
+}
+
+// Atomically holds a lock for the whole of fn, the backend only serves one
+// process so that is enough
+func (s kvRSVPs) Atomically(eventID string, fn func(RSVPStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fn(s)
+}
+
+type kvSessions struct {
+	kvBackend
+}
+
+func (s kvSessions) List(eventID string) ([]Session, error) {
+	if _, err := s.db.Get("Events", eventID); err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	prefix := eventID + "/"
+	err := s.db.ForEach("Session", func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		var ss Session
+		if err := json.Unmarshal(value, &ss); err != nil {
+			return err
+		}
+
+		sessions = append(sessions, ss)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(sessionsByStart(sessions))
+	return sessions, nil
+}
+
+func (s kvSessions) Get(eventID, id string) (Session, error) {
+	var ss Session
+	err := s.get("Session", eventID+"/"+id, &ss)
+	return ss, err
+}
+
+func (s kvSessions) Add(eventID string, ss Session) error {
+	if _, err := s.db.Get("Events", eventID); err != nil {
+		return err
+	}
+
+	return s.put("Session", eventID+"/"+ss.ID, ss)
+}
+
+func (s kvSessions) Update(eventID string, ss Session) error {
+	return s.replace("Session", eventID+"/"+ss.ID, eventID+"/"+ss.ID, ss)
+}
+
+func (s kvSessions) Delete(eventID, id string) error {
+	return s.remove("Session", eventID+"/"+id)
+}
+
+func (s kvSessions) BySpeaker(speakerID string) (map[string][]Session, error) {
+	matched := make(map[string][]Session)
+	err := s.db.ForEach("Session", func(key string, value []byte) error {
+		var ss Session
+		if err := json.Unmarshal(value, &ss); err != nil {
+			return err
+		}
+
+		for _, id := range ss.SpeakerIDs {
+			if id == speakerID {
+				eventID := key[:strings.LastIndex(key, "/")]
+				matched[eventID] = append(matched[eventID], ss)
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return matched, err
+}
+
+// move rekeys every child record in bucket of the event from under oldID to
+// under newID, or deletes them if newID is empty
+func (b kvBackend) move(bucket, oldID, newID string) error {
+	moved := make(map[string][]byte)
+	prefix := oldID + "/"
+	err := b.db.ForEach(bucket, func(key string, value []byte) error {
+		if strings.HasPrefix(key, prefix) {
+			moved[strings.TrimPrefix(key, prefix)] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, value := range moved {
+		if newID != "" {
+			if err := b.db.Put(bucket, newID+"/"+id, value); err != nil {
+				return err
+			}
+		}
+
+		if err := b.db.Delete(bucket, prefix+id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kvSearch keeps the documents in their own bucket and scores every one of
+// them against each query, which is plenty for a chapter's worth of records
+type kvSearch struct {
+	kvBackend
+}
+
+func (s kvSearch) Put(doc SearchDoc) error {
+	return s.put("SearchDoc", searchKey(doc.Kind, doc.ID), doc)
+}
+
+func (s kvSearch) Delete(kind, id string) error {
+	return s.db.Delete("SearchDoc", searchKey(kind, id))
+}
+
+func (s kvSearch) Search(terms []string, limit int) ([]SearchDoc, error) {
+	var matches scoredDocs
+	err := s.each("SearchDoc", func() interface{} { return new(SearchDoc) }, func(v interface{}) {
+		doc := *v.(*SearchDoc)
+		if score := searchScore(doc, terms); score > 0 {
+			matches.docs = append(matches.docs, doc)
+			matches.scores = append(matches.scores, score)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(matches)
+	if limit > 0 && len(matches.docs) > limit {
+		matches.docs = matches.docs[:limit]
+	}
+
+	return matches.docs, nil
+}
+
+// scoredDocs sorts search matches best first, then newest first
+type scoredDocs struct {
+	docs   []SearchDoc
+	scores []int
+}
+
+func (m scoredDocs) Len() int { return len(m.docs) }
+func (m scoredDocs) Swap(i, j int) {
+	m.docs[i], m.docs[j] = m.docs[j], m.docs[i]
+	m.scores[i], m.scores[j] = m.scores[j], m.scores[i]
+}
+func (m scoredDocs) Less(i, j int) bool {
+	if m.scores[i] != m.scores[j] {
+		return m.scores[i] > m.scores[j]
+	}
+
+	return m.docs[i].Datetime.After(m.docs[j].Datetime)
+}
+
+// kvAudit keys entries by when they were made, so they are kept in order
+type kvAudit struct {
+	kvBackend
+}
+
+func (s kvAudit) List() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := s.each("Audit", func() interface{} { return new(AuditEntry) }, func(v interface{}) {
+		entries = append(entries, *v.(*AuditEntry))
+	})
+
+	return entries, err
+}
+
+func (s kvAudit) Add(e AuditEntry) error {
+	// the random suffix keeps entries made at the same instant apart
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+
+	return s.insert("Audit", e.At.UTC().Format("20060102T150405.000000000")+"/"+suffix, e)
+}
+
+type kvSecrets struct {
+	kvBackend
+}
+
+func (s kvSecrets) Key(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, err := s.db.Get("Secret", name)
+	if err != ErrNotFound {
+		return key, err
+	}
+
+	key, err = newSecretKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return key, s.db.Put("Secret", name, key)
+}
+
+// MigrateDatetimes converts Events and LearnEvent records saved with a string
+// Datetime.  Records are decoded generically since they can't be decoded into
+// the current structs until they have been converted
+func (b kvBackend) MigrateDatetimes(r *http.Request) (migrationResult, error) {
+	var res migrationResult
+	for _, bucket := range []string{"Events", "LearnEvent"} {
+		err := b.db.ForEach(bucket, func(key string, value []byte) error {
+			var record map[string]interface{}
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+
+			old, _ := record["Datetime"].(string)
+			if _, err := time.Parse(time.RFC3339, old); err == nil {
+				// already a JSON encoded time.Time
+				return nil
+			}
+
+			details, _ := record["Details"].(string)
+			t, zone, newDetails, ok := convertLegacyDatetime(old, details)
+			record["Datetime"] = t
+			record["TimeZone"] = zone
+			record["Details"] = newDetails
+			if ok {
+				res.Converted++
+			} else {
+				res.Unparsed++
+			}
+
+			return b.put(bucket, key, record)
+		})
+		if err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
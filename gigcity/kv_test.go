@@ -0,0 +1,129 @@
+package gigcity
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKVPage(t *testing.T) {
+	for _, tt := range []struct {
+		n, limit   int
+		cursor     string
+		start, end int
+		next       string
+	}{
+		{0, 10, "", 0, 0, ""},
+		{5, 10, "", 0, 5, ""},
+		{10, 10, "", 0, 10, ""},
+		{25, 10, "", 0, 10, "10"},
+		{25, 10, "10", 10, 20, "20"},
+		{25, 10, "20", 20, 25, ""},
+		// the records may have shrunk since the cursor was handed out
+		{15, 10, "20", 15, 15, ""},
+	} {
+		start, end, next, err := kvPage(tt.n, RangeQuery{Limit: tt.limit, Cursor: tt.cursor})
+		if err != nil {
+			t.Errorf("kvPage(%d, limit %d, cursor %q) failed: %v", tt.n, tt.limit, tt.cursor, err)
+			continue
+		}
+		if start != tt.start || end != tt.end || next != tt.next {
+			t.Errorf("kvPage(%d, limit %d, cursor %q) = %d, %d, %q, want %d, %d, %q",
+				tt.n, tt.limit, tt.cursor, start, end, next, tt.start, tt.end, tt.next)
+		}
+	}
+
+	for _, cursor := range []string{"x", "-1", "1.5"} {
+		if _, _, _, err := kvPage(10, RangeQuery{Limit: 5, Cursor: cursor}); err != ErrBadCursor {
+			t.Errorf("kvPage with cursor %q = %v, want ErrBadCursor", cursor, err)
+		}
+	}
+}
+
+func TestKVEventsRange(t *testing.T) {
+	events := newMemoryBackend().Events(nil)
+	first := time.Date(2015, 1, 6, 18, 30, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		e := Event{ID: fmt.Sprintf("event-%d", i), Title: "Go Night", Datetime: first.AddDate(0, 0, 7*i)}
+		if i%2 == 0 {
+			e.TagIDs = []string{"go"}
+		}
+		if err := events.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// walk every page of the query and collect the IDs in order
+	walk := func(q RangeQuery) []string {
+		var ids []string
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("paging never ended")
+			}
+
+			page, next, err := events.Range(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > q.Limit {
+				t.Fatalf("got a page of %d, limit %d", len(page), q.Limit)
+			}
+			for _, e := range page {
+				ids = append(ids, e.ID)
+			}
+
+			if next == "" {
+				return ids
+			}
+			q.Cursor = next
+		}
+	}
+
+	for _, tt := range []struct {
+		q    RangeQuery
+		want string
+	}{
+		{RangeQuery{Limit: 3}, "[event-0 event-1 event-2 event-3 event-4 event-5 event-6]"},
+		{RangeQuery{Limit: 2, Desc: true}, "[event-6 event-5 event-4 event-3 event-2 event-1 event-0]"},
+		{RangeQuery{Limit: 2, Tag: "go"}, "[event-0 event-2 event-4 event-6]"},
+		{RangeQuery{Limit: 10, From: first.AddDate(0, 0, 7), To: first.AddDate(0, 0, 21)}, "[event-1 event-2]"},
+		{RangeQuery{Limit: 1, From: first.AddDate(1, 0, 0)}, "[]"},
+	} {
+		if got := fmt.Sprint(walk(tt.q)); got != tt.want {
+			t.Errorf("Range(%+v) walked %s, want %s", tt.q, got, tt.want)
+		}
+	}
+
+	if _, _, err := events.Range(RangeQuery{Limit: 2, Cursor: "nope"}); err != ErrBadCursor {
+		t.Errorf("Range with a bad cursor = %v, want ErrBadCursor", err)
+	}
+}
+
+func TestKVEventsRenameWaitsForRSVPs(t *testing.T) {
+	b := newMemoryBackend()
+	if err := b.Events(nil).Add(Event{ID: "go-night", Title: "Go Night"}); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := make(chan error)
+	err := b.RSVPs(nil).Atomically("go-night", func(store RSVPStore) error {
+		go func() {
+			renamed <- b.Events(nil).Update("go-night", Event{ID: "go-night-two", Title: "Go Night Two"})
+		}()
+
+		// the rename has to wait for this RSVP, rather than leave it under
+		// the old ID
+		time.Sleep(20 * time.Millisecond)
+		return store.Add("go-night", RSVP{ID: "late", Name: "Ada"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-renamed; err != nil {
+		t.Fatal(err)
+	}
+
+	if rsvps, err := b.RSVPs(nil).List("go-night-two"); err != nil || len(rsvps) != 1 {
+		t.Errorf("RSVPs after the rename = %+v, %v, want the one added during it", rsvps, err)
+	}
+}
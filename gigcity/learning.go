@@ -1,180 +1,365 @@
 package gigcity
 
 import (
-	"html/template"
+	"fmt"
 	"net/http"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/user"
+	"time"
 )
 
 // LearnEvent contains details about GDG study groups, used when preforming read/write ops to the datastore
 type LearnEvent struct {
 	// ID is the unique ID (URI) for the study group event
 	ID string
+	// UID is the study group's iCalendar UID, unlike ID it never changes
+	UID string
 	// Title of the Study Group
 	Title string
-	// Datetime of the study group event
-	Datetime string
+	// Datetime of the study group event, stored in UTC.  For a repeating
+	// study group it is the first meeting
+	Datetime time.Time
+	// Recurrence repeats the study group weekly, its zero value meets once
+	Recurrence Recurrence
+	// Moves are meetings of a repeating study group held off their usual time
+	Moves []OccurrenceMove
+	// TimeZone is the IANA name of the time zone the study group meets in,
+	// like America/New_York
+	TimeZone string
 	// LocID is the location of that the study group meets at
 	LocID string
 	// Details holds information regarding the event
-	Details string
+	Details string `datastore:",noindex"`
+	// TagIDs lists the topics the study group is filed under
+	TagIDs []string
+	// Created is when the study group was first saved
+	Created time.Time
+	// Updated is when the study group was last changed
+	Updated time.Time
+}
+
+// When formats the study group's date and time in its own time zone
+func (l LearnEvent) When() string {
+	return formatLocal(l.Datetime, l.TimeZone)
 }
 
-func learnList(c appengine.Context) *datastore.Key {
-	return datastore.NewKey(c, "LearnEvent", "default_learneventlist", 0, nil)
+// FormDatetime formats the study group's date and time for the admin form
+func (l LearnEvent) FormDatetime() string {
+	return formValueLocal(l.Datetime, l.TimeZone)
 }
 
-func learningHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// query the Learn entity in the database
-	q := datastore.NewQuery("LearnEvent").Ancestor(learnList(c)).Limit(10)
-	// create a slice of LearnEvent with a capacity of 10 items
-	learn := make([]LearnEvent, 0, 10)
-	// store the results into the learn slice
-	if _, err := q.GetAll(c, &learn); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+// Handles requests to /learning, upcoming study groups soonest first
+func (s *site) learningHandler(w http.ResponseWriter, r *http.Request) {
+	tag, tags, ok := s.listingTags(w, r)
+	if !ok {
 		return
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/learn.html",
-	))
+	learn, next, err := s.backend.LearnEvents(r).Range(upcomingQuery(r, tag))
+	if err != nil {
+		s.rangeError(w, r, err)
+		return
+	}
+
+	p := listPage{Path: "/learning", Noun: "study groups", Items: learn, Next: next, Tag: tag, Tags: tags}
+	s.render(w, r, "learn", p)
+}
+
+// learnEventFromForm builds a LearnEvent out of the submitted add/edit form.
+// If a required field is missing or invalid the returned message says which
+func (s *site) learnEventFromForm(r *http.Request) (LearnEvent, string) {
+	return s.learnEventFromValues(r, formValue(r))
+}
+
+// learnEventFromValues builds a LearnEvent out of the named fields returned
+// by value, which are named after the add/edit form's inputs.  It holds the
+// validation rules shared by the form and the API
+func (s *site) learnEventFromValues(r *http.Request, value func(string) string) (LearnEvent, string) {
+	var l LearnEvent
+	msg := tooLong(value, "study group", lineField("title"), lineField("location"), lineField("timezone"),
+		textField("except"), textField("details"))
+	if msg != "" {
+		return l, msg
+	}
+
+	l.Title = value("title")
+	if l.Title == "" {
+		return l, "study group name is required"
+	}
+
+	date := value("date")
+	if date == "" {
+		return l, "study group date and time is requred"
+	}
+
+	l.LocID = value("location")
+	if l.LocID == "" {
+		return l, "study group location is required"
+	}
+
+	l.Datetime, l.TimeZone, msg = s.parseFormTime(r, date, value("timezone"), l.LocID)
+	if msg != "" {
+		return l, "study group " + msg
+	}
+
+	l.Recurrence, msg = recurrenceFromValues(value, l.Datetime, l.TimeZone)
+	if msg != "" {
+		return l, msg
+	}
+
+	l.Details = value("details")
+	if l.Details == "" {
+		return l, "study group details is required"
+	}
+
+	l.TagIDs, msg = s.tagIDs(r, value("tags"))
+	return l, msg
+}
+
+// renderLearnForm shows the add/edit study group form pre-filled with l.  A
+// blank l gives an empty form for a new study group
+func (s *site) renderLearnForm(w http.ResponseWriter, r *http.Request, l LearnEvent) {
+	type Content struct {
+		LearnEvent
+		// Tags are the topics that can be picked
+		Tags []Tag
+		// Days are the weekdays it can repeat on
+		Days []formDay
+	}
 
-	if err := page.Execute(w, learn); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	tags, err := s.listTags(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	s.render(w, r, "admin/add-learn", Content{l, tags, formDays()})
 }
 
-func addLearningHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// get user information if one is logged in
-	u := user.Current(c)
-	if u == nil {
-		// the person that made the request is anonymous, redirect them to the login
-		// page
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			// was unable to get a login URL, so die with a 500 error
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
+// createLearnEvent gives a validated new study group its ID, UID and
+// timestamps, then stores it
+func (s *site) createLearnEvent(r *http.Request, l LearnEvent) (LearnEvent, error) {
+	l.UID = newUID()
+	l.Created = time.Now().UTC()
+	l.Updated = l.Created
+	var err error
+	l.ID, err = claimSlug(func() (string, error) {
+		return s.learnEventSlug(r, l, "")
+	}, func(slug string) error {
+		l.ID = slug
+		return s.backend.LearnEvents(r).Add(l)
+	})
+	if err != nil {
+		return l, err
+	}
+
+	s.index(r, learnEventDoc(l))
+	return l, nil
+}
+
+// updateLearnEvent overwrites the stored study group l with the validated
+// changes in g
+func (s *site) updateLearnEvent(r *http.Request, l, g LearnEvent) (LearnEvent, error) {
+	// only move the study group to a new slug if the title really changed,
+	// the old slug is kept as a redirect
+	g.UID = l.CalendarUID()
+	// the form doesn't carry moved meetings, they are changed one at a time
+	g.Moves = l.Moves
+	g.Created = l.Created
+	g.Updated = time.Now().UTC()
+	var err error
+	g.ID, err = claimSlug(func() (string, error) {
+		if slugify(g.Title) == slugify(l.Title) {
+			return l.ID, nil
 		}
-		// set a retrun URL for when authentication succeeds
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
+		return s.learnEventSlug(r, g, l.ID)
+	}, func(slug string) error {
+		g.ID = slug
+		return s.backend.LearnEvents(r).Update(l.ID, g)
+	})
+	if err != nil {
+		return g, err
+	}
+
+	if err := s.renameSlug(r, "LearnEvent", l.ID, g.ID); err != nil {
+		return g, err
+	}
+
+	if g.ID != l.ID {
+		s.unindex(r, "LearnEvent", l.ID)
+	}
+	s.index(r, learnEventDoc(g))
+	return g, nil
+}
+
+func (s *site) addLearningHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
 		return
 	}
 
 	// check the request method
 	if r.Method == "POST" {
-		var l LearnEvent
-		l.Title = r.FormValue("title")
-		if l.Title == "" {
-			errorHandler(w, r, http.StatusBadRequest, "study group name is required")
+		l, msg := s.learnEventFromForm(r)
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, msg)
 			return
 		}
 
-		l.Datetime = r.FormValue("date")
-		if l.Datetime == "" {
-			errorHandler(w, r, http.StatusBadRequest, "study group date and time is requred")
+		if _, err := s.createLearnEvent(r, l); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		l.LocID = r.FormValue("location")
-		if l.LocID == "" {
-			errorHandler(w, r, http.StatusBadRequest, "study group location is required")
-			return
-		}
+		// send the user back to the view page once done
+		http.Redirect(w, r, "/learning", http.StatusFound)
+	} else {
+		s.renderLearnForm(w, r, LearnEvent{})
+	}
+}
 
-		l.Details = r.FormValue("details")
-		if l.Details == "" {
-			errorHandler(w, r, http.StatusBadRequest, "study group details is required")
-			return
-		}
+// Handles requests to /admin/learn, listing every study group with its admin
+// actions
+func (s *site) adminLearningHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	learn, err := s.backend.LearnEvents(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		l.ID = getID(l.Title)
+	s.render(w, r, "admin/learn", learn)
+}
 
-		// get the next available index key
-		key := datastore.NewIncompleteKey(c, "LearnEvent", learnList(c))
-		_, err := datastore.Put(c, key, &l)
-		if err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
+// Handles requests to /admin/learn/:event/edit.  GET shows the study group
+// form pre-filled with the stored group, POST writes the changes back to it
+func (s *site) editLearningHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
 
-		// send the user back to the view page once done
-		http.Redirect(w, r, "/learning", http.StatusFound)
-	} else {
-		page := template.Must(template.ParseFiles(
-			"static/_base.html",
-			"static/admin/overlay.html",
-			"static/admin/add-learn.html",
-		))
-
-		if err := page.Execute(w, nil); err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
+	groupID := r.URL.Query().Get(":event")
+	l, err := s.backend.LearnEvents(r).Get(groupID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderLearnForm(w, r, l)
+		return
+	}
+
+	g, msg := s.learnEventFromForm(r)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	if _, err := s.updateLearnEvent(r, l, g); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/learn", http.StatusFound)
+}
+
+// Handles requests to /admin/learn/:event/delete
+func (s *site) deleteLearningHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	groupID := r.URL.Query().Get(":event")
+	err := s.backend.LearnEvents(r).Delete(groupID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
+
+	s.unindex(r, "LearnEvent", groupID)
+	if err := s.dropRedirects(r, "LearnEvent", groupID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/learn", http.StatusFound)
 }
 
-// getLearnHandler handles requests for /learning/:event
-func getLearnHandler(w http.ResponseWriter, r *http.Request) {
+// getLearnHandler handles requests for /learning/:event and, for a single
+// meeting of a repeating study group, /learning/:event/:date
+func (s *site) getLearnHandler(w http.ResponseWriter, r *http.Request) {
 	type Content struct {
 		LearnDetails LearnEvent
-		LocDetails   Location
+		// Meeting is the single meeting being shown, if one is
+		Meeting *Occurrence
+		// Upcoming are the next meetings of a repeating study group
+		Upcoming   []Occurrence
+		LocDetails Location
+		Tags       []Tag
 	}
 
 	var context Content
-	c := appengine.NewContext(r)
 	groupID := r.URL.Query().Get(":event")
 	if groupID == "" {
-		errorHandler(w, r, http.StatusInternalServerError, "no group ID found in URL")
+		s.errorHandler(w, r, http.StatusInternalServerError, "no group ID found in URL")
 		return
 	}
 
-	q := datastore.NewQuery("LearnEvent").Filter("ID =", groupID)
-	t := q.Run(c)
-	for {
-		var g LearnEvent
-		_, err := t.Next(&g)
-		if err != nil {
-			c.Errorf("fetching group details failed: %v", err)
-			break
-		}
-
-		context.LearnDetails = g
+	date := r.URL.Query().Get(":date")
+	suffix := ""
+	if date != "" {
+		suffix = "/" + date
 	}
 
-	q = datastore.NewQuery("Locations").Filter("ID =", context.LearnDetails.LocID)
-	t = q.Run(c)
-	for {
-		var l Location
-		_, err := t.Next(&l)
-		if err == datastore.Done {
-			break
+	var err error
+	context.LearnDetails, err = s.backend.LearnEvents(r).Get(groupID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "LearnEvent", groupID, "/learning/", suffix) {
+			s.errorHandler(w, r, http.StatusNotFound, "")
 		}
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	l := context.LearnDetails
+	if date != "" {
+		o, err := l.Occurrence(date)
 		if err != nil {
-			c.Errorf("fetching location details failed: %v", err)
-			break
+			s.errorHandler(w, r, http.StatusNotFound, "")
+			return
+		}
+		context.Meeting = &o
+	} else if l.Repeats() {
+		today := startOfToday()
+		for _, o := range l.Occurrences() {
+			if !o.Datetime.Before(today) && len(context.Upcoming) < listPageSize {
+				context.Upcoming = append(context.Upcoming, o)
+			}
 		}
-
-		context.LocDetails = l
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/view-learn.html",
-	))
+	context.LocDetails, err = s.backend.Locations(r).Get(context.LearnDetails.LocID)
+	if err != nil && err != ErrNotFound {
+		logHandler("ERROR", fmt.Sprintf("fetching location details failed: %v", err))
+	}
 
-	if err := page.Execute(w, context); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	context.Tags, err = s.recordTags(r, context.LearnDetails.TagIDs)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	s.render(w, r, "view-learn", context)
 }
@@ -1,12 +1,10 @@
 package gigcity
 
 import (
-	"html/template"
 	"net/http"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/user"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // Location contains details on locations for GDG Events
@@ -19,110 +17,355 @@ type Location struct {
 	Address string
 	// Details is any additonal details for the location, like how to find
 	// the group
-	Details string
+	Details string `datastore:",noindex"`
+	// TimeZone is the IANA name of the location's time zone, used as the
+	// default for events held there
+	TimeZone string
+	// Capacity is how many people the venue can hold, zero if unknown.  It
+	// is the default capacity of events held there
+	Capacity int
 }
 
-// Fetches the next key out of the datastore for the Locations entity
-func locationList(c appengine.Context) *datastore.Key {
-	return datastore.NewKey(c, "Locations", "default_locationlist", 0, nil)
+// parseCapacity reads a capacity form field.  If it isn't a whole number the
+// returned message says so
+func parseCapacity(v string) (int, string) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, "capacity must be a whole number"
+	}
+
+	return n, ""
 }
 
 // Handles requests for /admin/location
-func locationHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// get user information if one is logged in
-	u := user.Current(c)
-	if u == nil {
-		// the person that made the request is anonymous, redirect them to the login
-		// page
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			// was unable to get a login URL, so die with a 500 error
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
-			return
-		}
-		// set a return URL for when authentication succeeds
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
+func (s *site) locationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
 		return
 	}
 
-	q := datastore.NewQuery("Locations").Ancestor(locationList(c))
-	var locations []Location
-	if _, err := q.GetAll(c, &locations); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	locations, err := s.backend.Locations(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	page := template.Must(template.ParseFiles(
-		"static/_base.html",
-		"static/admin/overlay.html",
-		"static/admin/location.html",
-	))
+	s.render(w, r, "admin/location", locations)
+}
+
+// locationFromForm builds a Location out of the submitted add/edit form.  If
+// a required field is missing the returned message says which
+func locationFromForm(r *http.Request) (Location, string) {
+	return locationFromValues(r.FormValue)
+}
+
+// locationFromValues builds a Location out of the named fields returned by
+// value, which are named after the add/edit form's inputs.  It holds the
+// validation rules shared by the form and the API
+func locationFromValues(value func(string) string) (Location, string) {
+	var loc Location
+	msg := tooLong(value, "location", lineField("name"), lineField("address"), lineField("timezone"),
+		textField("details"))
+	if msg != "" {
+		return loc, msg
+	}
+
+	loc.Name = value("name")
+	if loc.Name == "" {
+		return loc, "location name is required"
+	}
+
+	loc.Address = value("address")
+	if loc.Address == "" {
+		return loc, "location address is required"
+	}
+
+	loc.Details = value("details")
+	if v := value("capacity"); v != "" {
+		if loc.Capacity, msg = parseCapacity(v); msg != "" {
+			return loc, "location " + msg
+		}
+	}
+
+	loc.TimeZone = value("timezone")
+	if loc.TimeZone != "" {
+		if _, err := loadZone(loc.TimeZone); err != nil {
+			return loc, "unknown time zone " + loc.TimeZone
+		}
+	}
+
+	return loc, ""
+}
+
+// renderLocationForm shows the add/edit location form pre-filled with l.  A
+// blank l gives an empty form for a new location
+func (s *site) renderLocationForm(w http.ResponseWriter, r *http.Request, l Location) {
+	s.render(w, r, "admin/add-location", l)
+}
+
+// Handles requests for /locations/:location, showing where it is and what has
+// been held there
+func (s *site) viewLocationHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Location Location
+		Refs     locationRefs
+	}
+
+	l, err := s.backend.Locations(r).Get(r.URL.Query().Get(":location"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-	if err := page.Execute(w, locations); err != nil {
-		errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	refs, err := s.locationReferences(r, l.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	sort.Sort(byDatetime(refs.Events))
+	sort.Sort(sort.Reverse(learnByDatetime(refs.Learn)))
+
+	s.render(w, r, "location", Content{Location: l, Refs: refs})
+}
+
+// createLocation gives a validated new location its ID, then stores it
+func (s *site) createLocation(r *http.Request, loc Location) (Location, error) {
+	var err error
+	loc.ID, err = claimSlug(func() (string, error) {
+		return s.locationSlug(r, loc)
+	}, func(slug string) error {
+		loc.ID = slug
+		return s.backend.Locations(r).Add(loc)
+	})
+	if err != nil {
+		return loc, err
+	}
+
+	s.index(r, locationDoc(loc))
+	return loc, nil
 }
 
-func addLocationHandler(w http.ResponseWriter, r *http.Request) {
-	// use the request information to determine if this is a new session
-	c := appengine.NewContext(r)
-	// get user information if one is logged in
-	u := user.Current(c)
-	if u == nil {
-		// the person that made the request is anonymous, redirect them to the login
-		// page
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			// was unable to get a login URL, so die with a 500 error
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
+func (s *site) addLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method == "GET" {
+		s.renderLocationForm(w, r, Location{})
+	} else {
+		loc, msg := locationFromForm(r)
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, msg)
 			return
 		}
-		// set a return URL for when authentication succeeds
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
+
+		if _, err := s.createLocation(r, loc); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/admin/location", http.StatusFound)
+	}
+}
+
+// Handles requests to /admin/location/:location/edit.  GET shows the location
+// form pre-filled with the stored location, POST writes the changes back to it
+func (s *site) editLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
 		return
 	}
 
-	if r.Method == "GET" {
-		page := template.Must(template.ParseFiles(
-			"static/_base.html",
-			"static/admin/overlay.html",
-			"static/admin/add-location.html",
-		))
-
-		if err := page.Execute(w, nil); err != nil {
-			errorHandler(w, r, http.StatusInternalServerError,
-				err.Error())
+	locID := r.URL.Query().Get(":location")
+	store := s.backend.Locations(r)
+	l, err := store.Get(locID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderLocationForm(w, r, l)
+		return
+	}
+
+	loc, msg := locationFromForm(r)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	// keep the ID, events and study groups refer to the location by it
+	loc.ID = l.ID
+	if err := store.Update(locID, loc); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.index(r, locationDoc(loc))
+	http.Redirect(w, r, "/admin/location", http.StatusFound)
+}
+
+// locationRefs lists everything that refers to a location
+type locationRefs struct {
+	Events []Event
+	Learn  []LearnEvent
+}
+
+// InUse reports whether anything still refers to the location
+func (l locationRefs) InUse() bool {
+	return len(l.Events) > 0 || len(l.Learn) > 0
+}
+
+// locationReferences finds every event and study group held at the location
+// with the given ID
+func (s *site) locationReferences(r *http.Request, locID string) (locationRefs, error) {
+	var refs locationRefs
+	var err error
+	refs.Events, err = s.backend.Events(r).ByLocation(locID)
+	if err != nil {
+		return refs, err
+	}
+
+	refs.Learn, err = s.backend.LearnEvents(r).ByLocation(locID)
+	return refs, err
+}
+
+// Handles requests to /admin/location/:location/delete.  GET shows what still
+// refers to the location, offering to merge it into another location when it
+// is in use.  POST deletes the location, refusing if it is still in use
+func (s *site) deleteLocationHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Location Location
+		Refs     locationRefs
+		// Others are the locations references can be merged into
+		Others []Location
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	locID := r.URL.Query().Get(":location")
+	store := s.backend.Locations(r)
+	l, err := store.Get(locID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	refs, err := s.locationReferences(r, locID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method == "POST" {
+		// deleting a location that is in use would leave event pages without
+		// a "Where", those have to be merged instead
+		if refs.InUse() {
+			s.errorHandler(w, r, http.StatusConflict, "location is still in use")
 			return
 		}
-	} else {
-		var loc Location
-		loc.Name = r.FormValue("name")
-		if loc.Name == "" {
-			errorHandler(w, r, http.StatusBadRequest, "location name is required")
+
+		if err := store.Delete(locID); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		loc.Address = r.FormValue("address")
-		if loc.Address == "" {
-			errorHandler(w, r, http.StatusBadRequest, "location address is required")
+		s.unindex(r, "Locations", locID)
+		http.Redirect(w, r, "/admin/location", http.StatusFound)
+		return
+	}
+
+	context := Content{Location: l, Refs: refs}
+	all, err := store.List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, other := range all {
+		if other.ID != l.ID {
+			context.Others = append(context.Others, other)
+		}
+	}
+
+	s.render(w, r, "admin/delete-location", context)
+}
+
+// Handles requests to /admin/location/:location/merge.  Every event and study
+// group held at the location is moved to the location named by the "into"
+// form value, then the location is deleted
+func (s *site) mergeLocationHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	locID := r.URL.Query().Get(":location")
+	into := r.FormValue("into")
+	if into == "" || into == locID {
+		s.errorHandler(w, r, http.StatusBadRequest, "a different location to merge into is required")
+		return
+	}
+
+	store := s.backend.Locations(r)
+	for _, id := range []string{locID, into} {
+		if _, err := store.Get(id); err == ErrNotFound {
+			s.errorHandler(w, r, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
+	}
+
+	refs, err := s.locationReferences(r, locID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		loc.Details = r.FormValue("details")
-		loc.ID = getID(loc.Name)
+	// rewrite the references before deleting, if anything fails part way the
+	// old location is still there and the merge can simply be retried
+	now := time.Now().UTC()
+	events := s.backend.Events(r)
+	for _, e := range refs.Events {
+		e.LocID = into
+		e.Updated = now
+		if err := events.Update(e.ID, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.index(r, eventDoc(e))
+	}
 
-		key := datastore.NewIncompleteKey(c, "Locations", locationList(c))
-		_, err := datastore.Put(c, key, &loc)
-		if err != nil {
-			errorHandler(w, r, http.StatusInternalServerError, err.Error())
+	learn := s.backend.LearnEvents(r)
+	for _, l := range refs.Learn {
+		l.LocID = into
+		l.Updated = now
+		if err := learn.Update(l.ID, l); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
+		s.index(r, learnEventDoc(l))
+	}
 
-		http.Redirect(w, r, "/admin/location", http.StatusFound)
+	if err := store.Delete(locID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
 	}
+
+	s.unindex(r, "Locations", locID)
+	http.Redirect(w, r, "/admin/location", http.StatusFound)
 }
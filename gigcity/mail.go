@@ -0,0 +1,60 @@
+package gigcity
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends the site's emails to visitors, like RSVP confirmations
+type Mailer interface {
+	// Send emails a plain text message to a single address
+	Send(r *http.Request, to, subject, body string) error
+}
+
+// LogMailer returns a Mailer that only logs the messages it is given, for
+// development or when no mail server is configured
+func LogMailer() Mailer {
+	return logMailer{}
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(r *http.Request, to, subject, body string) error {
+	logHandler("INFO", fmt.Sprintf("email to %s: %s\n%s", to, subject, body))
+	return nil
+}
+
+// SMTPMailer returns a Mailer that sends messages from the address from
+// through the SMTP server at addr (host:port).  auth may be nil if the server
+// doesn't need it
+func SMTPMailer(addr, from string, auth smtp.Auth) Mailer {
+	return smtpMailer{addr, from, auth}
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// headerEscaper keeps header values on a single line, so a visitor supplied
+// value can't add headers of its own
+var headerEscaper = strings.NewReplacer("\r", "", "\n", "")
+
+func (m smtpMailer) Send(r *http.Request, to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerEscaper.Replace(m.from))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerEscaper.Replace(to))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerEscaper.Replace(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg.Bytes())
+}
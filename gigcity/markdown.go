@@ -0,0 +1,40 @@
+package gigcity
+
+import (
+	"html"
+	"html/template"
+	"net/http"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+// markdownPolicy is what HTML rendered Markdown may contain.  Organizers write
+// the Markdown, but anything a browser could run is still stripped out, and
+// links get rel="nofollow"
+var markdownPolicy = bluemonday.UGCPolicy()
+
+// renderMarkdown renders organizer written Markdown, like event details, to
+// sanitised HTML
+func renderMarkdown(src string) template.HTML {
+	unsafe := blackfriday.Run([]byte(src))
+	return template.HTML(markdownPolicy.SanitizeBytes(unsafe))
+}
+
+// plainText strips the formatting from organizer written Markdown, leaving
+// the words, for the search index
+func plainText(src string) string {
+	rendered := blackfriday.Run([]byte(src))
+	return html.UnescapeString(string(bluemonday.StrictPolicy().SanitizeBytes(rendered)))
+}
+
+// Handles POST requests to /admin/markdown, rendering the text field for the
+// live preview on the admin forms
+func (s *site) markdownPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(renderMarkdown(r.FormValue("text"))))
+}
@@ -0,0 +1,48 @@
+package gigcity
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, tt := range []struct {
+		src      string
+		want     []string
+		stripped []string
+	}{
+		{"**Bring** a laptop", []string{"<strong>Bring</strong>"}, nil},
+		{"[slides](https://example.com/)", []string{`href="https://example.com/"`, `rel="nofollow"`}, nil},
+		{"<script>alert(1)</script>hi", []string{"hi"}, []string{"<script", "alert"}},
+		{`<a href="javascript:alert(1)">x</a>`, nil, []string{"javascript:"}},
+		{`<img src="/x.png" onerror="alert(1)">`, nil, []string{"onerror"}},
+	} {
+		got := string(renderMarkdown(tt.src))
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("renderMarkdown(%q) = %q, missing %q", tt.src, got, w)
+			}
+		}
+		for _, s := range tt.stripped {
+			if strings.Contains(got, s) {
+				t.Errorf("renderMarkdown(%q) = %q, kept %q", tt.src, got, s)
+			}
+		}
+	}
+}
+
+func TestMarkdownPreview(t *testing.T) {
+	ts := newTestServer(t)
+	form := url.Values{"text": {"*hi*"}}
+	if resp, _ := ts.request(t, "POST", "/admin/markdown", form, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("signed out preview = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	form.Set(csrfParam, ts.token(t, "/admin/events/add", "/admin/markdown"))
+	resp, body := ts.request(t, "POST", "/admin/markdown", form, true)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(body) != "<p><em>hi</em></p>" {
+		t.Errorf("preview = %d %q", resp.StatusCode, body)
+	}
+}
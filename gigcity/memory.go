@@ -0,0 +1,90 @@
+package gigcity
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryKV is a kv held entirely in process memory.  It is meant for unit
+// tests and local experiments, everything is lost when the process exits
+type memoryKV struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// newMemoryBackend returns a Backend with no records in it
+func newMemoryBackend() Backend {
+	return kvBackend{&memoryKV{buckets: make(map[string]map[string][]byte)}, new(sync.Mutex)}
+}
+
+func (m *memoryKV) Get(bucket, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return value, nil
+}
+
+func (m *memoryKV) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryKV) PutNew(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+
+	if _, ok := b[key]; ok {
+		return ErrExists
+	}
+
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryKV) Delete(bucket, key string) error {
+	m.mu.Lock()
+	delete(m.buckets[bucket], key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryKV) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	// copy the bucket first so fn is free to write back to the store
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	values := make(map[string][]byte, len(m.buckets[bucket]))
+	for k, v := range m.buckets[bucket] {
+		keys = append(keys, k)
+		values[k] = v
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, values[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
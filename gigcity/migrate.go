@@ -0,0 +1,160 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// datetimeMigrator is implemented by backends that may still hold Event and
+// LearnEvent records saved when Datetime was a YYYY-MM-DDTHH:MM string
+type datetimeMigrator interface {
+	// MigrateDatetimes converts every old string Datetime to a UTC time.Time,
+	// leaving records that are already converted alone
+	MigrateDatetimes(r *http.Request) (migrationResult, error)
+}
+
+// migrationResult reports what a datetime migration changed
+type migrationResult struct {
+	// Converted counts records whose Datetime was converted
+	Converted int
+	// Unparsed counts records whose old Datetime was free text (study groups
+	// used to take things like "Second Tuesday of the month").  The text is
+	// kept at the end of their Details and the Datetime left unset
+	Unparsed int
+	// Meetings counts study groups whose meetings were stored for listing,
+	// which the datastore backend needs for groups saved before they could
+	// repeat
+	Meetings int
+}
+
+// convertLegacyDatetime turns a Datetime string saved by the old forms into a
+// UTC time.  The old pages always showed times as Eastern, so that is the zone
+// they are read in.  If old can't be parsed it is appended to details instead
+// and ok is false
+func convertLegacyDatetime(old, details string) (t time.Time, zone, newDetails string, ok bool) {
+	zone = defaultTimeZone
+	t, err := time.ParseInLocation(formTimeLayout, old, zoneOrDefault(zone))
+	if err != nil {
+		if old != "" {
+			details += "\n\nWhen: " + old
+		}
+		return time.Time{}, zone, details, false
+	}
+
+	return t.UTC(), zone, details, true
+}
+
+// Handles requests to /admin/migrate/datetimes.  GET explains the migration,
+// POST runs it and shows what changed
+func (s *site) migrateDatetimesHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Ran    bool
+		Result migrationResult
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var context Content
+	if r.Method == "POST" {
+		m, ok := s.backend.(datetimeMigrator)
+		if ok {
+			var err error
+			context.Result, err = m.MigrateDatetimes(r)
+			if err != nil {
+				s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		context.Ran = true
+	}
+
+	s.render(w, r, "admin/migrate", context)
+}
+
+// slugMigrator is implemented by backends that may hold events, study groups
+// or locations saved before IDs were claimed in a transaction, when two
+// records could end up with the same ID
+type slugMigrator interface {
+	// MigrateSlugs calls reslug with a pointer to every record sharing its ID
+	// with another but one, which keeps it, saves the new ID reslug set and
+	// returns the records it renamed
+	MigrateSlugs(r *http.Request, reslug func(v interface{}) error) ([]interface{}, error)
+}
+
+// reslug gives v, an *Event, *LearnEvent or *Location sharing its ID with
+// another record, an ID of its own
+func (s *site) reslug(r *http.Request, v interface{}) error {
+	var err error
+	switch v := v.(type) {
+	case *Event:
+		v.ID, err = s.eventSlug(r, *v, "")
+	case *LearnEvent:
+		v.ID, err = s.learnEventSlug(r, *v, "")
+	case *Location:
+		v.ID, err = s.locationSlug(r, *v)
+	default:
+		err = fmt.Errorf("can't pick a slug for a %T", v)
+	}
+
+	return err
+}
+
+// renamedRecord is a record the slug migration gave a new ID
+type renamedRecord struct {
+	Kind  string
+	Title string
+	// Old is the ID it shared, URL is where it is shown now
+	Old string
+	URL string
+}
+
+// Handles requests to /admin/migrate/slugs.  GET explains the migration, POST
+// gives every record sharing its ID with another a new one and lists them
+func (s *site) migrateSlugsHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Ran     bool
+		Renamed []renamedRecord
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var context Content
+	if r.Method == "POST" {
+		if m, ok := s.backend.(slugMigrator); ok {
+			olds := make(map[interface{}]string)
+			renamed, err := m.MigrateSlugs(r, func(v interface{}) error {
+				olds[v] = recordDoc(v).ID
+				return s.reslug(r, v)
+			})
+			if err != nil {
+				s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			for _, v := range renamed {
+				doc := recordDoc(v)
+				kind := searchKinds[doc.Kind]
+				context.Renamed = append(context.Renamed, renamedRecord{kind.Label, doc.Title, olds[v], kind.Path + doc.ID})
+			}
+
+			// a shared ID's search document may hold any of the records
+			// that had it
+			if len(renamed) > 0 {
+				if _, err := s.reindex(r); err != nil {
+					s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+		}
+
+		context.Ran = true
+	}
+
+	s.render(w, r, "admin/migrate-slugs", context)
+}
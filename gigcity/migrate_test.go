@@ -0,0 +1,141 @@
+package gigcity
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDatetimes(t *testing.T) {
+	b := newMemoryBackend().(kvBackend)
+	for _, old := range []struct {
+		bucket string
+		record map[string]interface{}
+	}{
+		{"Events", map[string]interface{}{"ID": "go-night", "Title": "Go Night", "Datetime": "2015-03-04T18:30"}},
+		{"LearnEvent", map[string]interface{}{"ID": "go-study", "Title": "Go Study", "Datetime": "Second Tuesday of the month", "Details": "Bring a laptop"}},
+	} {
+		if err := b.put(old.bucket, old.record["ID"].(string), old.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Events(nil).Add(Event{ID: "new", Title: "New", Datetime: at("2015-05-06T22:30"), TimeZone: "Europe/London"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := b.MigrateDatetimes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Converted != 1 || res.Unparsed != 1 {
+		t.Errorf("migration = %+v, want one converted and one unparsed", res)
+	}
+
+	// the old forms' times were Eastern
+	e, err := b.Events(nil).Get("go-night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Datetime.Equal(at("2015-03-04T23:30")) || e.TimeZone != defaultTimeZone {
+		t.Errorf("converted event is at %s in %q", e.Datetime, e.TimeZone)
+	}
+
+	l, err := b.LearnEvents(nil).Get("go-study")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Datetime.IsZero() || !strings.HasSuffix(l.Details, "When: Second Tuesday of the month") {
+		t.Errorf("unparsed study group = %+v, want its old time kept in the details", l)
+	}
+
+	if e, _ := b.Events(nil).Get("new"); !e.Datetime.Equal(at("2015-05-06T22:30")) || e.TimeZone != "Europe/London" {
+		t.Errorf("an already converted event was changed to %+v", e)
+	}
+
+	res, err = b.MigrateDatetimes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Converted != 0 || res.Unparsed != 0 {
+		t.Errorf("running the migration again = %+v, want nothing to do", res)
+	}
+}
+
+// dupBackend is the memory backend holding a legacy event that shares the ID
+// of one already stored
+type dupBackend struct {
+	Backend
+	legacy Event
+}
+
+func (b dupBackend) Events(r *http.Request) EventStore {
+	return dupEvents{b.Backend.Events(r), b.legacy.ID}
+}
+
+// MigrateSlugs renames the legacy event and stores it under its new ID
+func (b *dupBackend) MigrateSlugs(r *http.Request, reslug func(v interface{}) error) ([]interface{}, error) {
+	if b.legacy.ID == "" {
+		return nil, nil
+	}
+
+	e := b.legacy
+	if err := reslug(&e); err != nil {
+		return nil, err
+	}
+	if err := b.Backend.Events(r).Add(e); err != nil {
+		return nil, err
+	}
+
+	b.legacy = Event{}
+	return []interface{}{&e}, nil
+}
+
+// dupEvents reports dup as shared by more than one event
+type dupEvents struct {
+	EventStore
+	dup string
+}
+
+func (s dupEvents) Get(id string) (Event, error) {
+	if id == s.dup {
+		return Event{}, ErrDuplicateID
+	}
+
+	return s.EventStore.Get(id)
+}
+
+func TestMigrateSlugs(t *testing.T) {
+	b := &dupBackend{Backend: newMemoryBackend(), legacy: Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-03-04T23:30"), Details: "The legacy one"}}
+	if err := b.Backend.Events(nil).Add(Event{ID: "go-night", Title: "Go Night", Datetime: at("2015-04-01T22:30")}); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerOn(t, b)
+
+	if resp, _ := ts.request(t, "GET", "/events/go-night", nil, false); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("shared ID = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+
+	if resp := ts.submit(t, "/admin/migrate/slugs", "/admin/migrate/slugs", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("migration = %d", resp.StatusCode)
+	}
+
+	e, err := b.Backend.Events(nil).Get("go-night-2015-03-04")
+	if err != nil || e.Details != "The legacy one" {
+		t.Fatalf("renamed event = %+v, %v", e, err)
+	}
+	if docs, _ := b.Search(nil).Search([]string{"legacy"}, 0); len(docs) != 1 || docs[0].ID != e.ID {
+		t.Errorf("search found %+v, want the renamed event", docs)
+	}
+
+	if resp, _ := ts.request(t, "GET", "/events/go-night", nil, false); resp.StatusCode != http.StatusOK {
+		t.Errorf("kept ID = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// there is nothing left to rename
+	if resp := ts.submit(t, "/admin/migrate/slugs", "/admin/migrate/slugs", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("running the migration again = %d", resp.StatusCode)
+	}
+	if all, _ := b.Backend.Events(nil).List(0); len(all) != 2 {
+		t.Errorf("%d events after running the migration again, want 2", len(all))
+	}
+}
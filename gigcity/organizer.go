@@ -0,0 +1,477 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Organizer is someone who runs the chapter
+type Organizer struct {
+	// ID is the unique ID for the organizer, it is kept when they are renamed
+	ID string
+	// Name is the organizer's full name
+	Name string
+	// Role is what they do for the chapter, like "Lead Community Organizer"
+	Role string
+	// Email is how to reach them, and the account they sign in to the admin
+	// area with
+	Email string
+	// Phone, Website, Twitter and IRC are other ways to reach them, each is
+	// optional
+	Phone   string
+	Website string
+	Twitter string
+	// IRC is their nick on Freenode
+	IRC string
+	// Order is where they are listed, lowest first
+	Order int
+	// CoCContact lists them on /coc as someone to report code of conduct
+	// violations to
+	CoCContact bool
+	// CoCResponder lets them read and handle code of conduct reports
+	CoCResponder bool
+	// Admin lets them into the admin area
+	Admin bool
+	// Created is when the organizer was first saved
+	Created time.Time
+	// Updated is when the organizer was last changed
+	Updated time.Time
+}
+
+// organizersByOrder sorts organizers by their display order, then by name
+type organizersByOrder []Organizer
+
+func (o organizersByOrder) Len() int      { return len(o) }
+func (o organizersByOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o organizersByOrder) Less(i, j int) bool {
+	if o[i].Order != o[j].Order {
+		return o[i].Order < o[j].Order
+	}
+
+	return strings.ToLower(o[i].Name) < strings.ToLower(o[j].Name)
+}
+
+// organizerFromValues builds an Organizer out of the named fields returned by
+// value, which are named after the add/edit form's inputs
+func organizerFromValues(value func(string) string) (Organizer, string) {
+	var o Organizer
+	msg := tooLong(value, "organizer", lineField("name"), lineField("role"), lineField("email"),
+		lineField("phone"), lineField("website"), lineField("twitter"), lineField("irc"))
+	if msg != "" {
+		return o, msg
+	}
+
+	o.Name = strings.TrimSpace(value("name"))
+	if o.Name == "" {
+		return o, "organizer name is required"
+	}
+
+	o.Role = strings.TrimSpace(value("role"))
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(value("email")))
+	if err != nil {
+		return o, "organizer needs a valid email address"
+	}
+	o.Email = addr.Address
+
+	o.Phone = strings.TrimSpace(value("phone"))
+	o.IRC = strings.TrimSpace(value("irc"))
+	for _, link := range []struct {
+		field, label string
+		dst          *string
+	}{
+		{"website", "website", &o.Website},
+		{"twitter", "Twitter", &o.Twitter},
+	} {
+		*link.dst = strings.TrimSpace(value(link.field))
+		if *link.dst != "" && !validLink(*link.dst) {
+			return o, "organizer " + link.label + " must be an http or https link"
+		}
+	}
+
+	if v := value("order"); v != "" {
+		if o.Order, err = strconv.Atoi(v); err != nil {
+			return o, "organizer display order must be a whole number"
+		}
+	}
+
+	o.CoCContact = value("coc") != ""
+	o.CoCResponder = value("responder") != ""
+	o.Admin = value("admin") != ""
+	return o, ""
+}
+
+// listOrganizers returns every organizer in display order
+func (s *site) listOrganizers(r *http.Request) ([]Organizer, error) {
+	organizers, err := s.backend.Organizers(r).List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(organizersByOrder(organizers))
+	return organizers, nil
+}
+
+// publicOrganizers returns the organizers the public pages list.  Until any
+// have been added these are the built in ones, so /coc always names someone
+// to contact.  They don't get admin access or reports until they are added
+func (s *site) publicOrganizers(r *http.Request) ([]Organizer, error) {
+	organizers, err := s.listOrganizers(r)
+	if err != nil || len(organizers) > 0 {
+		return organizers, err
+	}
+
+	return builtinOrganizers, nil
+}
+
+// organizerByEmail finds the organizer whose email address is email, or
+// returns ErrNotFound
+func (s *site) organizerByEmail(r *http.Request, email string) (Organizer, error) {
+	organizers, err := s.backend.Organizers(r).List(0)
+	if err != nil {
+		return Organizer{}, err
+	}
+
+	for _, o := range organizers {
+		if strings.EqualFold(o.Email, email) {
+			return o, nil
+		}
+	}
+
+	return Organizer{}, ErrNotFound
+}
+
+// adminOrganizer reports whether email belongs to an organizer with admin
+// access
+func (s *site) adminOrganizer(r *http.Request, email string) (bool, error) {
+	o, err := s.organizerByEmail(r, email)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return o.Admin, nil
+}
+
+// lockout returns a message if saving o in place of old would take the
+// signed in user's own admin access away, since only an owner could give it
+// back
+func (s *site) lockout(r *http.Request, old Organizer, o *Organizer) string {
+	if s.auth.Owner(r) || !strings.EqualFold(old.Email, s.auth.User(r)) {
+		return ""
+	}
+
+	if o == nil || !o.Admin || !strings.EqualFold(o.Email, old.Email) {
+		return "you can't take away your own admin access"
+	}
+
+	return ""
+}
+
+// responderChanges lists how saving o in place of old changes who can read
+// code of conduct reports, as audit trail actions.  old is blank for a new
+// organizer and o is nil when old is deleted
+func responderChanges(old Organizer, o *Organizer) []string {
+	var actions []string
+	kept := o != nil && o.CoCResponder && strings.EqualFold(o.Email, old.Email)
+	if old.CoCResponder && !kept {
+		actions = append(actions, "took responder access away from "+old.Email)
+	}
+	if o != nil && o.CoCResponder && !(old.CoCResponder && kept) {
+		actions = append(actions, "gave responder access to "+o.Email)
+	}
+
+	return actions
+}
+
+// auditResponders checks that saving o in place of old, see responderChanges,
+// is allowed and records any change to who is a responder before it is
+// saved.  Only owners and responders themselves can change who reads reports.
+// If it fails the error has already been written to w
+func (s *site) auditResponders(w http.ResponseWriter, r *http.Request, old Organizer, o *Organizer) bool {
+	actions := responderChanges(old, o)
+	if len(actions) == 0 {
+		return true
+	}
+
+	user := s.auth.User(r)
+	if !s.auth.Owner(r) {
+		me, err := s.organizerByEmail(r, user)
+		if err != nil && err != ErrNotFound {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return false
+		}
+		if err == ErrNotFound || !me.CoCResponder {
+			logHandler("WARN", fmt.Sprintf("%s is not a code of conduct responder, refused to change who is", user))
+			http.Error(w, "Only code of conduct responders can change who is a responder.", http.StatusForbidden)
+			return false
+		}
+	}
+
+	store := s.backend.Audit(r)
+	for _, action := range actions {
+		if err := store.Add(AuditEntry{Who: user, Action: action, At: time.Now().UTC()}); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handles requests to /coc
+func (s *site) cocHandler(w http.ResponseWriter, r *http.Request) {
+	organizers, err := s.publicOrganizers(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var contacts []Organizer
+	for _, o := range organizers {
+		if o.CoCContact {
+			contacts = append(contacts, o)
+		}
+	}
+
+	s.render(w, r, "coc", contacts)
+}
+
+// Handles requests for /admin/organizers
+func (s *site) adminOrganizersHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	organizers, err := s.listOrganizers(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "admin/organizers", organizers)
+}
+
+// renderOrganizerForm shows the add/edit organizer form pre-filled with o.  A
+// blank o gives an empty form for a new organizer
+func (s *site) renderOrganizerForm(w http.ResponseWriter, r *http.Request, o Organizer) {
+	s.render(w, r, "admin/add-organizer", o)
+}
+
+// emailTaken reports whether an organizer other than the one with the given
+// ID already uses email.  Addresses must be unique, since they decide who the
+// signed in admin is
+func (s *site) emailTaken(r *http.Request, email, id string) (bool, error) {
+	o, err := s.organizerByEmail(r, email)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return o.ID != id, nil
+}
+
+// createOrganizer gives a validated new organizer their ID and timestamps,
+// then stores them
+func (s *site) createOrganizer(r *http.Request, o Organizer) error {
+	o.Created = time.Now().UTC()
+	o.Updated = o.Created
+	_, err := claimSlug(func() (string, error) {
+		return s.organizerSlug(r, o)
+	}, func(slug string) error {
+		o.ID = slug
+		return s.backend.Organizers(r).Add(o)
+	})
+	return err
+}
+
+// Handles requests to /admin/organizers/add
+func (s *site) addOrganizerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderOrganizerForm(w, r, Organizer{CoCContact: true})
+		return
+	}
+
+	o, msg := organizerFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	taken, err := s.emailTaken(r, o.Email, "")
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if taken {
+		s.errorHandler(w, r, http.StatusBadRequest, "there is already an organizer with the email address "+o.Email)
+		return
+	}
+
+	if !s.auditResponders(w, r, Organizer{}, &o) {
+		return
+	}
+
+	if err := s.createOrganizer(r, o); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/organizers", http.StatusFound)
+}
+
+// Handles requests to /admin/organizers/:organizer/edit.  GET shows the
+// organizer form pre-filled with the stored organizer, POST writes the
+// changes back
+func (s *site) editOrganizerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	organizerID := r.URL.Query().Get(":organizer")
+	store := s.backend.Organizers(r)
+	old, err := store.Get(organizerID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderOrganizerForm(w, r, old)
+		return
+	}
+
+	o, msg := organizerFromValues(r.FormValue)
+	if msg == "" {
+		msg = s.lockout(r, old, &o)
+	}
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	taken, err := s.emailTaken(r, o.Email, old.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if taken {
+		s.errorHandler(w, r, http.StatusBadRequest, "there is already an organizer with the email address "+o.Email)
+		return
+	}
+
+	if !s.auditResponders(w, r, old, &o) {
+		return
+	}
+
+	o.ID = old.ID
+	o.Created = old.Created
+	o.Updated = time.Now().UTC()
+	if err := store.Update(organizerID, o); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the old address no longer has admin access, so neither do its tokens
+	if old.Admin && (!o.Admin || !strings.EqualFold(o.Email, old.Email)) {
+		if err := s.revokeTokens(r, old.Email); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/organizers", http.StatusFound)
+}
+
+// Handles requests to /admin/organizers/:organizer/delete
+func (s *site) deleteOrganizerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	organizerID := r.URL.Query().Get(":organizer")
+	store := s.backend.Organizers(r)
+	old, err := store.Get(organizerID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if msg := s.lockout(r, old, nil); msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	if !s.auditResponders(w, r, old, nil) {
+		return
+	}
+
+	if err := store.Delete(organizerID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := s.revokeTokens(r, old.Email); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/organizers", http.StatusFound)
+}
+
+// builtinOrganizers are the organizers /coc used to list by hand
+var builtinOrganizers = []Organizer{
+	{Name: "Adam Jimerson", Role: "Lead Community Organizer", Email: "vendion@gmail.com", Website: "https://google.com/+AdamJimerson", IRC: "vendion", CoCContact: true, CoCResponder: true, Admin: true},
+}
+
+// Handles POST requests to /admin/organizers/builtin, which adds the
+// organizers the site shipped with.  Ones already added are skipped, so it is
+// safe to run more than once
+func (s *site) builtinOrganizersHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	for _, o := range builtinOrganizers {
+		taken, err := s.emailTaken(r, o.Email, "")
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if taken {
+			continue
+		}
+
+		if !s.auditResponders(w, r, Organizer{}, &o) {
+			return
+		}
+
+		if err := s.createOrganizer(r, o); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/organizers", http.StatusFound)
+}
@@ -0,0 +1,179 @@
+package gigcity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testAuth signs requests in as the address in their X-Test-User header,
+// testOwner being the owner
+type testAuth struct{}
+
+func (testAuth) User(r *http.Request) string { return r.Header.Get("X-Test-User") }
+func (testAuth) Owner(r *http.Request) bool  { return r.Header.Get("X-Test-User") == testOwner }
+
+func (testAuth) Challenge(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// testOrganizers is a site with an organizer who has admin access and one
+// who doesn't
+func testOrganizers(t *testing.T) *site {
+	s := &site{backend: newMemoryBackend(), auth: testAuth{}}
+	for _, o := range []Organizer{
+		{ID: "ada", Name: "Ada", Email: "ada@example.com", Admin: true, CoCContact: true},
+		{ID: "bob", Name: "Bob", Email: "bob@example.com"},
+	} {
+		if err := s.backend.Organizers(nil).Add(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s
+}
+
+// as returns a request signed in as user, anonymous if it is ""
+func as(user string) *http.Request {
+	r := httptest.NewRequest("GET", "/admin", nil)
+	if user != "" {
+		r.Header.Set("X-Test-User", user)
+	}
+
+	return r
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s := testOrganizers(t)
+	for _, tt := range []struct {
+		user   string
+		ok     bool
+		status int
+	}{
+		{"", false, http.StatusUnauthorized},
+		{testOwner, true, http.StatusOK},
+		{"ADA@example.com", true, http.StatusOK},
+		{"bob@example.com", false, http.StatusForbidden},
+		{"eve@example.com", false, http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		if ok := s.requireAdmin(w, as(tt.user)); ok != tt.ok || w.Code != tt.status {
+			t.Errorf("requireAdmin as %q = %v with status %d, want %v %d", tt.user, ok, w.Code, tt.ok, tt.status)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	s := testOrganizers(t)
+	ada, err := s.backend.Organizers(nil).Get("ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	demoted := ada
+	demoted.Admin = false
+	moved := ada
+	moved.Email = "ada@example.org"
+
+	for _, tt := range []struct {
+		user   string
+		o      *Organizer
+		locked bool
+	}{
+		{"ada@example.com", &ada, false},
+		{"ada@example.com", &demoted, true},
+		{"ada@example.com", &moved, true},
+		// deleting
+		{"ada@example.com", nil, true},
+		{testOwner, nil, false},
+		{"bob@example.com", &demoted, false},
+	} {
+		if msg := s.lockout(as(tt.user), ada, tt.o); (msg != "") != tt.locked {
+			t.Errorf("%s saving %+v: lockout %q, want locked %v", tt.user, tt.o, msg, tt.locked)
+		}
+	}
+}
+
+func TestResponderChanges(t *testing.T) {
+	responder := Organizer{Email: "cat@example.com", CoCResponder: true}
+	plain := Organizer{Email: "cat@example.com"}
+	moved := Organizer{Email: "kit@example.com", CoCResponder: true}
+
+	for _, test := range []struct {
+		name string
+		old  Organizer
+		o    *Organizer
+		want string
+	}{
+		{"new responder", Organizer{}, &responder, "gave responder access to cat@example.com"},
+		{"new organizer", Organizer{}, &plain, ""},
+		{"unchanged", responder, &responder, ""},
+		{"taken away", responder, &plain, "took responder access away from cat@example.com"},
+		{"deleted", responder, nil, "took responder access away from cat@example.com"},
+		{"new address", responder, &moved, "took responder access away from cat@example.com, gave responder access to kit@example.com"},
+	} {
+		if got := strings.Join(responderChanges(test.old, test.o), ", "); got != test.want {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAuditResponders(t *testing.T) {
+	s := testOrganizers(t)
+	bob, err := s.backend.Organizers(nil).Get("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := bob
+	o.CoCResponder = true
+
+	// ada has admin access but isn't a responder
+	w := httptest.NewRecorder()
+	if s.auditResponders(w, as("ada@example.com"), bob, &o) || w.Code != http.StatusForbidden {
+		t.Errorf("admin made a responder: %d", w.Code)
+	}
+
+	if !s.auditResponders(httptest.NewRecorder(), as(testOwner), bob, &o) {
+		t.Fatal("owner couldn't make a responder")
+	}
+	entries, err := s.backend.Audit(nil).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Who != testOwner || entries[0].Action != "gave responder access to bob@example.com" {
+		t.Errorf("audit trail %+v", entries)
+	}
+}
+
+func TestCoC(t *testing.T) {
+	ts := newTestServer(t)
+
+	// the built in organizers are contacts until any are added, without
+	// getting admin access
+	for _, path := range []string{"/", "/coc"} {
+		if _, body := ts.request(t, "GET", path, nil, false); !strings.Contains(body, builtinOrganizers[0].Name) {
+			t.Errorf("%s doesn't list the built in organizers before any are added", path)
+		}
+	}
+	if admin, err := (&site{backend: ts.Backend}).adminOrganizer(nil, builtinOrganizers[0].Email); admin || err != nil {
+		t.Errorf("built in organizer not yet added has admin access: %v, %v", admin, err)
+	}
+
+	for _, o := range []Organizer{
+		{ID: "ada", Name: "Ada Contact", Email: "ada@example.com", CoCContact: true},
+		{ID: "bob", Name: "Bob Helper", Email: "bob@example.com"},
+	} {
+		if err := ts.Backend.Organizers(nil).Add(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := ts.request(t, "GET", "/coc", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /coc = %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "Ada Contact") || strings.Contains(body, "Bob Helper") {
+		t.Error("/coc doesn't list just the code of conduct contacts")
+	}
+}
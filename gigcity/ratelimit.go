@@ -0,0 +1,63 @@
+package gigcity
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter lets each client make up to max requests per window.  Counts
+// are kept in process memory, on App Engine every instance counts on its own,
+// which still stops a single client flooding a public form
+type rateLimiter struct {
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*clientWindow
+}
+
+// clientWindow counts one client's requests since start
+type clientWindow struct {
+	start time.Time
+	n     int
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{max: max, window: window, clients: make(map[string]*clientWindow)}
+}
+
+// allow counts a request from client made at now, and reports whether it is
+// within the limit
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// forget clients whose window is over, so the map doesn't grow forever
+	for c, w := range l.clients {
+		if now.Sub(w.start) >= l.window {
+			delete(l.clients, c)
+		}
+	}
+
+	w, ok := l.clients[client]
+	if !ok {
+		w = &clientWindow{start: now}
+		l.clients[client] = w
+	}
+
+	w.n++
+	return w.n <= l.max
+}
+
+// clientAddr is the IP address r came from, without the port
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// App Engine gives the bare address
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,33 @@
+package gigcity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Minute)
+	now := at("2015-03-04T18:30")
+	for i, tt := range []struct {
+		client string
+		after  time.Duration
+		want   bool
+	}{
+		{"a", 0, true},
+		{"a", time.Second, true},
+		{"a", 2 * time.Second, false},
+		// clients are counted separately
+		{"b", 2 * time.Second, true},
+		// and start over once their window is up
+		{"a", time.Minute, true},
+	} {
+		if got := l.allow(tt.client, now.Add(tt.after)); got != tt.want {
+			t.Errorf("request %d from %s: allow = %v, want %v", i, tt.client, got, tt.want)
+		}
+	}
+
+	l.allow("c", now.Add(2*time.Minute))
+	if len(l.clients) != 1 {
+		t.Errorf("limiter remembers %d clients, want only the 1 still in its window", len(l.clients))
+	}
+}
@@ -0,0 +1,514 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxInterval is the most weeks apart a study group's meetings may be
+	maxInterval = 52
+	// maxOccurrences caps how many meetings a recurrence expands to, about
+	// two a week for maxRecurrenceYears.  Schedules with more are refused
+	maxOccurrences = 520
+	// maxRecurrenceYears is how long after its first meeting a study group
+	// may keep repeating
+	maxRecurrenceYears = 5
+)
+
+// dateLayout is how the until and exception dates of a recurrence are
+// entered, and how a single meeting is named in its URL
+const dateLayout = "2006-01-02"
+
+// weekdayCodes are the iCalendar BYDAY codes, indexed by time.Weekday
+var weekdayCodes = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// formDay is a weekday the study group form offers
+type formDay struct {
+	Code string
+	Name string
+}
+
+// formDays lists the weekdays for the study group form, Monday first
+func formDays() []formDay {
+	var days []formDay
+	for i := 1; i <= 7; i++ {
+		d := time.Weekday(i % 7)
+		days = append(days, formDay{weekdayCodes[d], d.String()[:3]})
+	}
+
+	return days
+}
+
+// Recurrence repeats a study group weekly, like an iCalendar RRULE with
+// FREQ=WEEKLY, INTERVAL, BYDAY and UNTIL plus EXDATEs.  Dates are stored as
+// midnight UTC and compared with the meetings' dates in the study group's
+// time zone
+type Recurrence struct {
+	// Interval is how many weeks apart the meetings are, zero if the study
+	// group meets just once
+	Interval int
+	// Weekdays are the days of the week it meets on, as time.Weekday values.
+	// Empty means the weekday of its first meeting
+	Weekdays []int
+	// Until is the last date it may meet on
+	Until time.Time
+	// Except are the dates of cancelled meetings
+	Except []time.Time
+}
+
+// OccurrenceMove moves one meeting of a repeating study group
+type OccurrenceMove struct {
+	// Original is the date the recurrence puts the meeting on
+	Original time.Time
+	// Datetime is when the meeting now starts, in UTC
+	Datetime time.Time
+}
+
+// Occurrence is one meeting of a study group.  Its Datetime is when that
+// meeting starts
+type Occurrence struct {
+	LearnEvent
+	// Date is the date the recurrence puts the meeting on, which names it
+	// even if it was moved.  It is "" for a study group that meets once
+	Date string
+	// Moved reports whether the meeting was moved off its usual time
+	Moved bool
+	// Cancelled reports whether the meeting was called off
+	Cancelled bool
+}
+
+// Link is the path of the meeting's page
+func (o Occurrence) Link() string {
+	if o.Date == "" {
+		return "/learning/" + o.ID
+	}
+
+	return "/learning/" + o.ID + "/" + o.Date
+}
+
+// CalendarUID returns the meeting's iCalendar UID, derived from the study
+// group's so it survives edits
+func (o Occurrence) CalendarUID() string {
+	if o.Date == "" {
+		return o.LearnEvent.CalendarUID()
+	}
+
+	return strings.Replace(o.Date, "-", "", -1) + "-" + o.LearnEvent.CalendarUID()
+}
+
+// occurrencesByDatetime sorts meetings soonest first
+type occurrencesByDatetime []Occurrence
+
+func (o occurrencesByDatetime) Len() int           { return len(o) }
+func (o occurrencesByDatetime) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o occurrencesByDatetime) Less(i, j int) bool { return o[i].Datetime.Before(o[j].Datetime) }
+
+// Repeats reports whether the study group meets more than once
+func (l LearnEvent) Repeats() bool {
+	return l.Recurrence.Interval > 0
+}
+
+// weekdays returns the days of the week the study group meets on
+func (l LearnEvent) weekdays() []int {
+	if len(l.Recurrence.Weekdays) > 0 {
+		return l.Recurrence.Weekdays
+	}
+
+	return []int{int(l.Datetime.In(zoneOrDefault(l.TimeZone)).Weekday())}
+}
+
+// civilDate is the date t falls on in its own location, as midnight UTC
+func civilDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// hasDate reports whether dates contains d
+func hasDate(dates []time.Time, d time.Time) bool {
+	for _, other := range dates {
+		if other.Equal(d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Occurrences expands the study group into its meetings, cancelled ones
+// included, soonest first.  A study group that meets once has one
+func (l LearnEvent) Occurrences() []Occurrence {
+	if !l.Repeats() {
+		return []Occurrence{{LearnEvent: l}}
+	}
+
+	zone := zoneOrDefault(l.TimeZone)
+	start := l.Datetime.In(zone)
+	first := civilDate(start)
+	days := append([]int(nil), l.weekdays()...)
+	sort.Ints(days)
+
+	// step through the weeks it meets in, from the Sunday before the first
+	// meeting, and through the chosen days of each
+	var occurrences []Occurrence
+	until := l.Recurrence.Until
+	for week := first.AddDate(0, 0, -int(first.Weekday())); !week.After(until) && len(occurrences) < maxOccurrences; week = week.AddDate(0, 0, 7*l.Recurrence.Interval) {
+		for _, wd := range days {
+			d := week.AddDate(0, 0, wd)
+			if d.Before(first) || d.After(until) || len(occurrences) == maxOccurrences {
+				continue
+			}
+
+			occurrences = append(occurrences, l.occurrenceOn(d, start))
+		}
+	}
+
+	sort.Stable(occurrencesByDatetime(occurrences))
+	return occurrences
+}
+
+// meetingCount is how many meetings the recurrence schedules, cancelled ones
+// included, without Occurrences' cap
+func (l LearnEvent) meetingCount() int {
+	first := civilDate(l.Datetime.In(zoneOrDefault(l.TimeZone)))
+	until := l.Recurrence.Until
+	n := 0
+	for week := first.AddDate(0, 0, -int(first.Weekday())); !week.After(until); week = week.AddDate(0, 0, 7*l.Recurrence.Interval) {
+		for _, wd := range l.weekdays() {
+			if d := week.AddDate(0, 0, wd); !d.Before(first) && !d.After(until) {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// occurrenceOn returns the meeting the recurrence puts on date d, at the
+// same time of day as start unless it was moved
+func (l LearnEvent) occurrenceOn(d, start time.Time) Occurrence {
+	zone := start.Location()
+	o := Occurrence{LearnEvent: l, Date: d.Format(dateLayout)}
+	o.Datetime = time.Date(d.Year(), d.Month(), d.Day(), start.Hour(), start.Minute(), 0, 0, zone).UTC()
+	o.Cancelled = hasDate(l.Recurrence.Except, d)
+	for _, m := range l.Moves {
+		if m.Original.Equal(d) {
+			o.Datetime, o.Moved = m.Datetime, true
+		}
+	}
+
+	return o
+}
+
+// Occurrence returns the meeting the recurrence puts on date, which is in
+// dateLayout, or ErrNotFound
+func (l LearnEvent) Occurrence(date string) (Occurrence, error) {
+	if l.Repeats() {
+		for _, o := range l.Occurrences() {
+			if o.Date == date {
+				return o, nil
+			}
+		}
+	}
+
+	return Occurrence{}, ErrNotFound
+}
+
+// Last is when the study group's final meeting starts
+func (l LearnEvent) Last() time.Time {
+	last := l.Datetime
+	for _, o := range l.Occurrences() {
+		if o.Datetime.After(last) {
+			last = o.Datetime
+		}
+	}
+
+	return last
+}
+
+// Schedule describes when a repeating study group meets, like "Every week
+// on Tuesday at 6:00 PM EST until 2016-05-31", and is "" for one that meets
+// once
+func (l LearnEvent) Schedule() string {
+	if !l.Repeats() {
+		return ""
+	}
+
+	var days []string
+	for _, d := range l.weekdays() {
+		days = append(days, time.Weekday(d).String())
+	}
+
+	every := "Every week"
+	if l.Recurrence.Interval > 1 {
+		every = fmt.Sprintf("Every %d weeks", l.Recurrence.Interval)
+	}
+
+	at := l.Datetime.In(zoneOrDefault(l.TimeZone)).Format(clockLayout + " MST")
+	on := days[len(days)-1]
+	if len(days) > 1 {
+		on = strings.Join(days[:len(days)-1], ", ") + " and " + on
+	}
+
+	return fmt.Sprintf("%s on %s at %s until %s", every, on, at, l.Recurrence.Until.Format(dateLayout))
+}
+
+// FormWeekday reports whether the study group form should tick the weekday
+// with the given iCalendar code
+func (l LearnEvent) FormWeekday(code string) bool {
+	for _, d := range l.Recurrence.Weekdays {
+		if weekdayCodes[d] == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FormUntil formats the until date for the study group form
+func (l LearnEvent) FormUntil() string {
+	if l.Recurrence.Until.IsZero() {
+		return ""
+	}
+
+	return l.Recurrence.Until.Format(dateLayout)
+}
+
+// FormExcept formats the exception dates for the study group form, one per
+// line
+func (l LearnEvent) FormExcept() string {
+	var dates []string
+	for _, d := range l.Recurrence.Except {
+		dates = append(dates, d.Format(dateLayout))
+	}
+
+	return strings.Join(dates, "\n")
+}
+
+// parseDates reads a list of dates in dateLayout separated by commas or
+// white space
+func parseDates(v string) ([]time.Time, error) {
+	var dates []time.Time
+	fields := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	for _, f := range fields {
+		d, err := time.Parse(dateLayout, f)
+		if err != nil {
+			return nil, err
+		}
+		if !hasDate(dates, d) {
+			dates = append(dates, d)
+		}
+	}
+
+	return dates, nil
+}
+
+// recurrenceFromValues reads the repeat, weekdays, until and except fields
+// of the study group form.  start is the first meeting.  If a field is
+// invalid the returned message says which
+func recurrenceFromValues(value func(string) string, start time.Time, zone string) (Recurrence, string) {
+	var rr Recurrence
+	if v := value("repeat"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxInterval {
+			return rr, fmt.Sprintf("repeat must be a number of weeks from 1 to %d", maxInterval)
+		}
+		rr.Interval = n
+	}
+	if rr.Interval == 0 {
+		return rr, ""
+	}
+
+	seen := make(map[int]bool)
+	for _, code := range strings.Split(value("weekdays"), ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" {
+			continue
+		}
+
+		d := -1
+		for i, c := range weekdayCodes {
+			if c == code {
+				d = i
+			}
+		}
+		if d < 0 {
+			return rr, "unknown weekday " + code + ", use one of " + strings.Join(weekdayCodes, ", ")
+		}
+		if !seen[d] {
+			seen[d] = true
+			rr.Weekdays = append(rr.Weekdays, d)
+		}
+	}
+	sort.Ints(rr.Weekdays)
+
+	v := value("until")
+	if v == "" {
+		return rr, "a repeating study group needs an until date"
+	}
+
+	var err error
+	if rr.Until, err = time.Parse(dateLayout, v); err != nil {
+		return rr, "until must be a date in YYYY-MM-DD format"
+	}
+	first := civilDate(start.In(zoneOrDefault(zone)))
+	if rr.Until.Before(first) {
+		return rr, "until can't be before the first meeting"
+	}
+	if rr.Until.After(first.AddDate(maxRecurrenceYears, 0, 0)) {
+		return rr, fmt.Sprintf("until can't be more than %d years after the first meeting", maxRecurrenceYears)
+	}
+
+	// Occurrences would cut the schedule short, drop meetings instead of
+	// losing the last ones without a word
+	l := LearnEvent{Datetime: start, TimeZone: zone, Recurrence: rr}
+	if n := l.meetingCount(); n > maxOccurrences {
+		return rr, fmt.Sprintf("that schedule has %d meetings, a study group can have at most %d", n, maxOccurrences)
+	}
+
+	if rr.Except, err = parseDates(value("except")); err != nil {
+		return rr, "exception dates must be in YYYY-MM-DD format"
+	}
+
+	return rr, ""
+}
+
+// occurrenceRange expands learn into the meetings q selects, leaving out
+// cancelled ones, and returns the page of them q asks for.  Study groups are
+// few, so the kv stores expand every one in memory rather than query for
+// meetings, and page through them with kvPage's offset cursors
+func occurrenceRange(learn []LearnEvent, q RangeQuery) ([]Occurrence, string, error) {
+	var matched []Occurrence
+	for _, l := range learn {
+		if !q.tagged(l.TagIDs) {
+			continue
+		}
+
+		for _, o := range l.Occurrences() {
+			if !o.Cancelled && q.contains(o.Datetime) {
+				matched = append(matched, o)
+			}
+		}
+	}
+
+	if q.Desc {
+		sort.Stable(sort.Reverse(occurrencesByDatetime(matched)))
+	} else {
+		sort.Stable(occurrencesByDatetime(matched))
+	}
+
+	start, end, next, err := kvPage(len(matched), q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return matched[start:end], next, nil
+}
+
+// Handles requests for /admin/learn/:event/meetings, listing the meetings of
+// a study group so single ones can be cancelled or moved
+func (s *site) adminMeetingsHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Group    LearnEvent
+		Meetings []Occurrence
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	l, err := s.backend.LearnEvents(r).Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "admin/meetings", Content{l, l.Occurrences()})
+}
+
+// Handles POST requests to /admin/learn/:event/meetings/:date.  The action
+// field cancels the meeting, moves it to the time in the datetime field, or
+// restores it to its usual time
+func (s *site) meetingHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	store := s.backend.LearnEvents(r)
+	l, err := store.Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	o, err := l.Occurrence(r.URL.Query().Get(":date"))
+	if err != nil {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+
+	date, _ := time.Parse(dateLayout, o.Date)
+	switch r.FormValue("action") {
+	case "cancel":
+		if !o.Cancelled {
+			l.Recurrence.Except = append(l.Recurrence.Except, date)
+		}
+	case "move":
+		t, _, msg := s.parseFormTime(r, r.FormValue("datetime"), l.TimeZone, l.LocID)
+		if msg != "" {
+			s.errorHandler(w, r, http.StatusBadRequest, "meeting "+msg)
+			return
+		}
+		l.Moves = append(withoutMove(l.Moves, date), OccurrenceMove{Original: date, Datetime: t})
+	case "restore":
+		l.Recurrence.Except = withoutDate(l.Recurrence.Except, date)
+		l.Moves = withoutMove(l.Moves, date)
+	default:
+		s.errorHandler(w, r, http.StatusBadRequest, "action must be cancel, move or restore")
+		return
+	}
+
+	l.Updated = time.Now().UTC()
+	if err := store.Update(l.ID, l); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/learn/"+l.ID+"/meetings", http.StatusFound)
+}
+
+// withoutDate returns dates minus d
+func withoutDate(dates []time.Time, d time.Time) []time.Time {
+	var kept []time.Time
+	for _, other := range dates {
+		if !other.Equal(d) {
+			kept = append(kept, other)
+		}
+	}
+
+	return kept
+}
+
+// withoutMove returns moves minus any of the meeting on date
+func withoutMove(moves []OccurrenceMove, date time.Time) []OccurrenceMove {
+	var kept []OccurrenceMove
+	for _, m := range moves {
+		if !m.Original.Equal(date) {
+			kept = append(kept, m)
+		}
+	}
+
+	return kept
+}
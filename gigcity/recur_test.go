@@ -0,0 +1,182 @@
+package gigcity
+
+import (
+	"testing"
+	"time"
+)
+
+// testGroup meets every other Tuesday and Thursday at 6:30 PM in London from
+// 3 March 2015, across the clocks going forward on 29 March
+func testGroup() LearnEvent {
+	return LearnEvent{
+		ID:       "go-study",
+		Datetime: time.Date(2015, 3, 3, 18, 30, 0, 0, time.UTC),
+		TimeZone: "Europe/London",
+		Recurrence: Recurrence{
+			Interval: 2,
+			Weekdays: []int{int(time.Thursday), int(time.Tuesday)},
+			Until:    time.Date(2015, 4, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	l := testGroup()
+	l.Recurrence.Except = []time.Time{time.Date(2015, 3, 17, 0, 0, 0, 0, time.UTC)}
+	l.Moves = []OccurrenceMove{{
+		Original: time.Date(2015, 3, 19, 0, 0, 0, 0, time.UTC),
+		Datetime: time.Date(2015, 3, 20, 19, 0, 0, 0, time.UTC),
+	}}
+
+	want := []struct {
+		date      string
+		start     time.Time
+		moved     bool
+		cancelled bool
+	}{
+		{"2015-03-03", time.Date(2015, 3, 3, 18, 30, 0, 0, time.UTC), false, false},
+		{"2015-03-05", time.Date(2015, 3, 5, 18, 30, 0, 0, time.UTC), false, false},
+		{"2015-03-17", time.Date(2015, 3, 17, 18, 30, 0, 0, time.UTC), false, true},
+		{"2015-03-19", time.Date(2015, 3, 20, 19, 0, 0, 0, time.UTC), true, false},
+		// British Summer Time, an hour ahead of UTC
+		{"2015-03-31", time.Date(2015, 3, 31, 17, 30, 0, 0, time.UTC), false, false},
+		{"2015-04-02", time.Date(2015, 4, 2, 17, 30, 0, 0, time.UTC), false, false},
+	}
+
+	got := l.Occurrences()
+	if len(got) != len(want) {
+		t.Fatalf("got %d meetings, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		o := got[i]
+		if o.Date != w.date || !o.Datetime.Equal(w.start) || o.Moved != w.moved || o.Cancelled != w.cancelled {
+			t.Errorf("meeting %d = %s at %s moved %v cancelled %v, want %s at %s moved %v cancelled %v",
+				i, o.Date, o.Datetime, o.Moved, o.Cancelled, w.date, w.start, w.moved, w.cancelled)
+		}
+	}
+
+	if last := l.Last(); !last.Equal(want[len(want)-1].start) {
+		t.Errorf("Last() = %s, want %s", last, want[len(want)-1].start)
+	}
+}
+
+func TestOccurrencesOnce(t *testing.T) {
+	l := testGroup()
+	l.Recurrence = Recurrence{}
+
+	got := l.Occurrences()
+	if len(got) != 1 || got[0].Date != "" || !got[0].Datetime.Equal(l.Datetime) {
+		t.Fatalf("a single meeting expanded to %+v", got)
+	}
+	if _, err := l.Occurrence("2015-03-03"); err != ErrNotFound {
+		t.Errorf("Occurrence of a single meeting = %v, want ErrNotFound", err)
+	}
+}
+
+func TestOccurrencesDefaultWeekday(t *testing.T) {
+	l := testGroup()
+	l.Recurrence.Interval = 1
+	l.Recurrence.Weekdays = nil
+
+	var dates []string
+	for _, o := range l.Occurrences() {
+		dates = append(dates, o.Date)
+	}
+
+	want := []string{"2015-03-03", "2015-03-10", "2015-03-17", "2015-03-24", "2015-03-31"}
+	if len(dates) != len(want) {
+		t.Fatalf("got %v, want %v", dates, want)
+	}
+	for i := range want {
+		if dates[i] != want[i] {
+			t.Fatalf("got %v, want %v", dates, want)
+		}
+	}
+}
+
+func TestOccurrencesCapped(t *testing.T) {
+	l := testGroup()
+	l.Recurrence.Interval = 1
+	l.Recurrence.Weekdays = []int{0, 1, 2, 3, 4, 5, 6}
+	l.Recurrence.Until = l.Datetime.AddDate(maxRecurrenceYears, 0, 0)
+
+	if n := len(l.Occurrences()); n != maxOccurrences {
+		t.Errorf("daily meetings for %d years expanded to %d, want %d", maxRecurrenceYears, n, maxOccurrences)
+	}
+	if n := l.meetingCount(); n < 365*maxRecurrenceYears {
+		t.Errorf("daily meetings for %d years counted %d", maxRecurrenceYears, n)
+	}
+
+	l.Recurrence.Weekdays = []int{2}
+	if n, want := l.meetingCount(), len(l.Occurrences()); n != want {
+		t.Errorf("weekly meetings counted %d, expanded to %d", n, want)
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	l := testGroup()
+
+	o, err := l.Occurrence("2015-03-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Link() != "/learning/go-study/2015-03-31" {
+		t.Errorf("Link() = %q", o.Link())
+	}
+
+	// a Wednesday, and a Tuesday in a week it doesn't meet
+	for _, date := range []string{"2015-03-04", "2015-03-10"} {
+		if _, err := l.Occurrence(date); err != ErrNotFound {
+			t.Errorf("Occurrence(%s) = %v, want ErrNotFound", date, err)
+		}
+	}
+}
+
+func TestMoves(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2015, 3, d, 0, 0, 0, 0, time.UTC) }
+	moves := []OccurrenceMove{{Original: day(5)}, {Original: day(19)}}
+
+	kept := withoutMove(moves, day(5))
+	if len(kept) != 1 || !kept[0].Original.Equal(day(19)) {
+		t.Errorf("withoutMove left %+v", kept)
+	}
+	if kept := withoutMove(moves, day(6)); len(kept) != 2 {
+		t.Errorf("withoutMove of an unmoved meeting left %+v", kept)
+	}
+}
+
+func TestRecurrenceFromValues(t *testing.T) {
+	start := time.Date(2015, 3, 3, 18, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		values map[string]string
+		ok     bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"repeat": "1", "until": "2015-06-30"}, true},
+		{map[string]string{"repeat": "2", "weekdays": "tu, TH,TU", "until": "2015-06-30", "except": "2015-03-17 2015-03-19"}, true},
+		{map[string]string{"repeat": "1"}, false},
+		{map[string]string{"repeat": "53", "until": "2015-06-30"}, false},
+		{map[string]string{"repeat": "1", "weekdays": "XX", "until": "2015-06-30"}, false},
+		{map[string]string{"repeat": "1", "until": "2015-03-02"}, false},
+		{map[string]string{"repeat": "1", "until": "2020-03-03"}, true},
+		{map[string]string{"repeat": "1", "until": "2020-03-04"}, false},
+		// too many meetings to expand, rather than cut short
+		{map[string]string{"repeat": "1", "weekdays": "su,mo,tu,we,th,fr,sa", "until": "2016-03-02"}, true},
+		{map[string]string{"repeat": "1", "weekdays": "su,mo,tu,we,th,fr,sa", "until": "2017-03-03"}, false},
+		{map[string]string{"repeat": "1", "until": "2015-06-30", "except": "17/03/2015"}, false},
+	} {
+		value := func(name string) string { return tt.values[name] }
+		_, msg := recurrenceFromValues(value, start, "Europe/London")
+		if (msg == "") != tt.ok {
+			t.Errorf("recurrenceFromValues(%v) = %q, want ok %v", tt.values, msg, tt.ok)
+		}
+	}
+
+	value := func(name string) string {
+		return map[string]string{"repeat": "2", "weekdays": "th,tu,th", "until": "2015-06-30"}[name]
+	}
+	rr, _ := recurrenceFromValues(value, start, "Europe/London")
+	if len(rr.Weekdays) != 2 || rr.Weekdays[0] != int(time.Tuesday) || rr.Weekdays[1] != int(time.Thursday) {
+		t.Errorf("weekdays = %v, want Tuesday and Thursday once each", rr.Weekdays)
+	}
+}
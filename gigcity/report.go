@@ -0,0 +1,489 @@
+package gigcity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errNoReportKey is returned when reports are handled without a report key
+var errNoReportKey = errors.New("no code of conduct report key is configured")
+
+// ParseReportKey reads the key code of conduct reports are encrypted with,
+// 32 bytes base64 encoded.  An empty string gives a nil key, which turns
+// reports off
+func ParseReportKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("report key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("report key is %d bytes, it must be 32", len(key))
+	}
+
+	return key, nil
+}
+
+// Report statuses, a report moves through them as responders handle it
+const (
+	reportNew           = "new"
+	reportInvestigating = "investigating"
+	reportResolved      = "resolved"
+)
+
+var reportStatuses = []string{reportNew, reportInvestigating, reportResolved}
+
+// Report is a code of conduct incident report.  What the reporter wrote and
+// the responders' notes are kept in Sealed, encrypted, so only the status and
+// audit trail can be read from the stored record
+type Report struct {
+	// ID is the random ID of the report
+	ID string
+	// EventID is the event the report is about, it may be blank
+	EventID string
+	// Status is one of reportStatuses
+	Status string
+	// Sealed is the encrypted reportContent
+	Sealed []byte
+	// Audit records everyone who has read or changed the report
+	Audit []AuditEntry
+	// Created is when the report was filed
+	Created time.Time
+	// Updated is when the report was last changed
+	Updated time.Time
+}
+
+// AuditEntry is a line in a report's audit trail
+type AuditEntry struct {
+	// Who is the signed in responder, or "reporter" for the person who filed
+	// the report
+	Who string
+	// Action is what they did, like "viewed"
+	Action string
+	// At is when they did it
+	At time.Time
+}
+
+// reportContent is the confidential part of a report.  The contact details
+// are all optional, so reports can be made anonymously
+type reportContent struct {
+	Name  string
+	Email string
+	Phone string
+	// When and Involved are in the reporter's own words
+	When        string
+	Involved    string
+	Description string
+	Notes       []reportNote
+}
+
+// reportNote is a responder's internal note on a report
+type reportNote struct {
+	Who  string
+	Text string
+	At   time.Time
+}
+
+// Anonymous reports whether the reporter left no way to contact them
+func (c reportContent) Anonymous() bool {
+	return c.Name == "" && c.Email == "" && c.Phone == ""
+}
+
+// reportsByCreated sorts reports newest first
+type reportsByCreated []Report
+
+func (rs reportsByCreated) Len() int           { return len(rs) }
+func (rs reportsByCreated) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs reportsByCreated) Less(i, j int) bool { return rs[i].Created.After(rs[j].Created) }
+
+// reportCipher returns the AEAD reports are sealed with
+func (s *site) reportCipher() (cipher.AEAD, error) {
+	if s.reportKey == nil {
+		return nil, errNoReportKey
+	}
+
+	block, err := aes.NewCipher(s.reportKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts c into rep.Sealed.  The report's ID is authenticated along
+// with it, so sealed content can't be moved to another report
+func seal(aead cipher.AEAD, rep *Report, c reportContent) error {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	rep.Sealed = aead.Seal(nonce, nonce, plain, []byte(rep.ID))
+	return nil
+}
+
+// unseal decrypts the content of rep
+func unseal(aead cipher.AEAD, rep Report) (reportContent, error) {
+	var c reportContent
+	n := aead.NonceSize()
+	if len(rep.Sealed) < n {
+		return c, errors.New("sealed report is too short")
+	}
+
+	plain, err := aead.Open(nil, rep.Sealed[:n], rep.Sealed[n:], []byte(rep.ID))
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(plain, &c)
+	return c, err
+}
+
+// audit appends an entry to the report's audit trail
+func (rep *Report) audit(who, action string) {
+	rep.Updated = time.Now().UTC()
+	rep.Audit = append(rep.Audit, AuditEntry{Who: who, Action: action, At: rep.Updated})
+}
+
+// responders returns the organizers who handle code of conduct reports
+func (s *site) responders(r *http.Request) ([]Organizer, error) {
+	organizers, err := s.listOrganizers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var responders []Organizer
+	for _, o := range organizers {
+		if o.CoCResponder {
+			responders = append(responders, o)
+		}
+	}
+
+	return responders, nil
+}
+
+// requireResponder returns the signed in user if they are a code of conduct
+// responder.  If not, the visitor is asked to sign in, or turned away if they
+// already have, and ok is false.  Owners are not let in unless they are also
+// responders, reports are for responders' eyes only.  Like requireAdmin it
+// refuses changes that fail checkCSRF
+func (s *site) requireResponder(w http.ResponseWriter, r *http.Request) (user string, ok bool) {
+	user = s.auth.User(r)
+	if user == "" {
+		s.auth.Challenge(w, r)
+		return "", false
+	}
+
+	o, err := s.organizerByEmail(r, user)
+	if err != nil && err != ErrNotFound {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+	if err == nil && o.CoCResponder {
+		if !checkCSRF(w, r) {
+			return "", false
+		}
+		return user, true
+	}
+
+	logHandler("WARN", fmt.Sprintf("%s is not a code of conduct responder, refused %s", user, r.URL.Path))
+	http.Error(w, "You are signed in as "+user+", who is not a code of conduct responder.", http.StatusForbidden)
+	return "", false
+}
+
+// notifyResponders lets every responder know a report was filed.  The email
+// only links to it, the report itself stays encrypted on the site
+func (s *site) notifyResponders(r *http.Request, rep Report) {
+	responders, err := s.responders(r)
+	if err != nil {
+		logHandler("ERROR", fmt.Sprintf("looking up code of conduct responders failed: %v", err))
+		return
+	}
+
+	body := fmt.Sprintf(`A code of conduct report has been filed.  Sign in to read it:
+
+%s
+
+GDG Gigcity
+`, baseURL(r)+"/admin/reports/"+rep.ID)
+
+	for _, o := range responders {
+		if err := s.mail.Send(r, o.Email, "New code of conduct report", body); err != nil {
+			logHandler("ERROR", fmt.Sprintf("emailing %s about report %s failed: %v", o.Email, rep.ID, err))
+		}
+	}
+}
+
+// Handles requests to /coc/report.  GET shows the report form, optionally
+// with ?event= picked, POST files the report.  Without a report key the form
+// is closed, reports are never stored unencrypted
+func (s *site) cocReportHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Events  []Event
+		EventID string
+		// Form refills the form when the report couldn't be filed
+		Form  url.Values
+		Error string
+		Sent  bool
+		// Closed is set when the site has no report key to take reports with
+		Closed bool
+	}
+
+	events, err := s.backend.Events(r).List(20)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context := Content{Events: events, EventID: r.FormValue("event"), Closed: s.reportKey == nil}
+	status := http.StatusOK
+	if context.Closed {
+		if r.Method == "POST" {
+			logHandler("WARN", "refused a code of conduct report, no report key is configured")
+			status = http.StatusServiceUnavailable
+		}
+	} else if r.Method == "POST" {
+		status, context.Error = s.fileReport(r)
+		context.Sent = context.Error == ""
+		if !context.Sent {
+			context.Form = r.PostForm
+		}
+	}
+
+	s.renderStatus(w, r, status, "coc-report", context)
+}
+
+// fileReport stores the report submitted in r's form and notifies the
+// responders.  It returns the status to reply with and, if the report
+// couldn't be filed, what the reporter should be told
+func (s *site) fileReport(r *http.Request) (int, string) {
+	c := reportContent{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Phone:       strings.TrimSpace(r.FormValue("phone")),
+		When:        strings.TrimSpace(r.FormValue("when")),
+		Involved:    strings.TrimSpace(r.FormValue("involved")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+	}
+	if c.Description == "" {
+		return http.StatusBadRequest, "Please tell us what happened."
+	}
+
+	if v := strings.TrimSpace(r.FormValue("email")); v != "" {
+		addr, err := mail.ParseAddress(v)
+		if err != nil {
+			return http.StatusBadRequest, "That email address doesn't look right, you can leave it blank to stay anonymous."
+		}
+		c.Email = addr.Address
+	}
+
+	rep := Report{EventID: r.FormValue("event"), Status: reportNew, Created: time.Now().UTC()}
+	if rep.EventID != "" {
+		if _, err := s.backend.Events(r).Get(rep.EventID); err != nil {
+			return http.StatusBadRequest, "Please pick the event from the list."
+		}
+	}
+
+	aead, err := s.reportCipher()
+	if err == nil {
+		rep.ID, err = randomHex(8)
+	}
+	if err == nil {
+		err = seal(aead, &rep, c)
+	}
+	if err == nil {
+		rep.audit("reporter", "filed")
+		err = s.backend.Reports(r).Add(rep)
+	}
+	if err != nil {
+		logHandler("ERROR", fmt.Sprintf("filing code of conduct report failed: %v", err))
+		return http.StatusInternalServerError, "Sorry, your report couldn't be saved.  Please email one of the organizers listed on the code of conduct page instead."
+	}
+
+	s.notifyResponders(r, rep)
+	return http.StatusOK, ""
+}
+
+// Handles requests for /admin/reports, listing reports without decrypting
+// them.  ?status= narrows the list to one status
+func (s *site) adminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Reports  []Report
+		Status   string
+		Statuses []string
+		// Access is the audit trail of who was made or stopped being a
+		// responder, most recent first
+		Access []AuditEntry
+	}
+
+	if _, ok := s.requireResponder(w, r); !ok {
+		return
+	}
+
+	reports, err := s.backend.Reports(r).List()
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(reportsByCreated(reports))
+
+	context := Content{Status: r.URL.Query().Get("status"), Statuses: reportStatuses}
+	for _, rep := range reports {
+		if context.Status == "" || rep.Status == context.Status {
+			context.Reports = append(context.Reports, rep)
+		}
+	}
+
+	access, err := s.backend.Audit(r).List()
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := len(access) - 1; i >= 0; i-- {
+		context.Access = append(context.Access, access[i])
+	}
+
+	s.render(w, r, "admin/reports", context)
+}
+
+// Handles GET requests for /admin/reports/:report.  Every view is recorded in
+// the report's audit trail before it is shown
+func (s *site) viewReportHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Report   Report
+		Content  reportContent
+		Event    Event
+		Statuses []string
+	}
+
+	user, ok := s.requireResponder(w, r)
+	if !ok {
+		return
+	}
+
+	aead, err := s.reportCipher()
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var rep Report
+	err = s.backend.Reports(r).Modify(r.URL.Query().Get(":report"), func(stored *Report) error {
+		stored.audit(user, "viewed")
+		rep = *stored
+		return nil
+	})
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context := Content{Report: rep, Statuses: reportStatuses}
+	context.Content, err = unseal(aead, rep)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, "decrypting report "+rep.ID+" failed: "+err.Error())
+		return
+	}
+
+	if rep.EventID != "" {
+		context.Event, err = s.backend.Events(r).Get(rep.EventID)
+		if err != nil && err != ErrNotFound {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// most recent first
+	for i, j := 0, len(context.Report.Audit)-1; i < j; i, j = i+1, j-1 {
+		context.Report.Audit[i], context.Report.Audit[j] = context.Report.Audit[j], context.Report.Audit[i]
+	}
+
+	s.render(w, r, "admin/report", context)
+}
+
+// Handles POST requests to /admin/reports/:report, which either move the
+// report to the status in the form or add the note in it
+func (s *site) updateReportHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireResponder(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.FormValue("status")
+	note := strings.TrimSpace(r.FormValue("note"))
+	if status == "" && note == "" {
+		s.errorHandler(w, r, http.StatusBadRequest, "a status or a note is required")
+		return
+	}
+
+	if status != "" {
+		known := false
+		for _, st := range reportStatuses {
+			known = known || st == status
+		}
+		if !known {
+			s.errorHandler(w, r, http.StatusBadRequest, "unknown report status "+status)
+			return
+		}
+	}
+
+	aead, err := s.reportCipher()
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	reportID := r.URL.Query().Get(":report")
+	err = s.backend.Reports(r).Modify(reportID, func(rep *Report) error {
+		if status != "" && status != rep.Status {
+			rep.Status = status
+			rep.audit(user, "marked "+status)
+		}
+
+		if note == "" {
+			return nil
+		}
+
+		c, err := unseal(aead, *rep)
+		if err != nil {
+			return err
+		}
+
+		c.Notes = append(c.Notes, reportNote{Who: user, Text: note, At: time.Now().UTC()})
+		rep.audit(user, "added a note")
+		return seal(aead, rep, c)
+	})
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports/"+reportID, http.StatusFound)
+}
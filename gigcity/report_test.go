@@ -0,0 +1,153 @@
+package gigcity
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSealReport(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := Report{ID: "abc"}
+	if err := seal(aead, &rep, reportContent{Email: "ada@example.com", Description: "Something happened"}); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(rep.Sealed, []byte("Something happened")) {
+		t.Fatal("the sealed report can be read")
+	}
+
+	c, err := unseal(aead, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Description != "Something happened" || c.Anonymous() {
+		t.Errorf("unsealed %+v", c)
+	}
+
+	moved := rep
+	moved.ID = "abd"
+	tampered := rep
+	tampered.Sealed = append([]byte(nil), rep.Sealed...)
+	tampered.Sealed[len(tampered.Sealed)-1] ^= 1
+	for name, bad := range map[string]Report{
+		"moved to another report": moved,
+		"tampered":                tampered,
+		"truncated":               {ID: "abc", Sealed: rep.Sealed[:4]},
+	} {
+		if _, err := unseal(aead, bad); err == nil {
+			t.Errorf("a %s report was unsealed", name)
+		}
+	}
+}
+
+func TestParseReportKey(t *testing.T) {
+	if key, err := ParseReportKey(" "); key != nil || err != nil {
+		t.Errorf("no key = %v, %v, want nil", key, err)
+	}
+
+	key, err := ParseReportKey(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil || len(key) != 32 {
+		t.Errorf("32 byte key = %v, %v", key, err)
+	}
+
+	for _, bad := range []string{"not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseReportKey(bad); err == nil {
+			t.Errorf("key %q was accepted", bad)
+		}
+	}
+}
+
+func TestRequireResponder(t *testing.T) {
+	s := testOrganizers(t)
+	if err := s.backend.Organizers(nil).Add(Organizer{ID: "cat", Name: "Cat", Email: "cat@example.com", CoCResponder: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		// reports are for responders only, owners and admins included
+		{testOwner, http.StatusForbidden},
+		{"ada@example.com", http.StatusForbidden},
+		{"Cat@example.com", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		user, ok := s.requireResponder(w, as(tt.user))
+		if ok != (tt.status == http.StatusOK) || w.Code != tt.status || (ok && user != tt.user) {
+			t.Errorf("requireResponder as %q = %q, %v with status %d, want %d", tt.user, user, ok, w.Code, tt.status)
+		}
+	}
+}
+
+func TestFileReport(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.Backend.Organizers(nil).Add(Organizer{ID: "cat", Name: "Cat", Email: "cat@example.com", CoCResponder: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, form := range []url.Values{
+		{"description": {" "}},
+		{"description": {"Something happened"}, "email": {"nope"}},
+		{"description": {"Something happened"}, "event": {"nope"}},
+	} {
+		if resp, _ := ts.request(t, "POST", "/coc/report", form, false); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("report %v: status %d, want %d", form, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	resp, _ := ts.request(t, "POST", "/coc/report", url.Values{"description": {"Something happened"}}, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("filing a report = %d", resp.StatusCode)
+	}
+
+	reports, err := ts.Backend.Reports(nil).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Status != reportNew || bytes.Contains(reports[0].Sealed, []byte("Something happened")) {
+		t.Fatalf("reports %+v, want one sealed new report", reports)
+	}
+	if len(ts.Mail.sent) != 1 || ts.Mail.sent[0].To != "cat@example.com" || bytes.Contains([]byte(ts.Mail.sent[0].Body), []byte("Something happened")) {
+		t.Errorf("sent %+v, want a link to the report for the responder", ts.Mail.sent)
+	}
+
+	// the owner can't read it
+	if resp, _ := ts.request(t, "GET", "/admin/reports/"+reports[0].ID, nil, true); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("owner reading the report = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestReportsClosed(t *testing.T) {
+	b := newMemoryBackend()
+	h, err := NewHandler(b, BasicAuth(testOwner, testPassword), new(testMailer), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/coc/report", strings.NewReader("description=Something+happened"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("report without a key = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if reports, _ := b.Reports(nil).List(); len(reports) != 0 {
+		t.Errorf("%d reports stored without a key", len(reports))
+	}
+}
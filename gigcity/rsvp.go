@@ -0,0 +1,589 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RSVP statuses.  An RSVP starts pending until the visitor follows the link
+// emailed to them, so nobody can sign someone else up
+const (
+	rsvpPending   = "pending"
+	rsvpConfirmed = "confirmed"
+	rsvpCancelled = "cancelled"
+)
+
+// rsvpLapse is how long a pending RSVP holds its seat or waitlist place.  If
+// the visitor hasn't confirmed by then it lapses, so made up addresses can't
+// fill an event
+const rsvpLapse = 48 * time.Hour
+
+// rsvpsPerHour is how many RSVPs one client may submit an hour
+const rsvpsPerHour = 10
+
+// RSVP is a visitor's registration for an Event
+type RSVP struct {
+	// ID is random, it is the secret in the visitor's confirmation link
+	ID string
+	// Name is who is coming
+	Name string
+	// Email is where the confirmation link is sent
+	Email string
+	// Status is one of the rsvp status constants
+	Status string
+	// Waitlisted is set while the RSVP is waiting for a seat at a full event
+	Waitlisted bool
+	// WalkIn is set for people registered at the door on the day
+	WalkIn bool
+	// CheckedIn is when the attendee arrived, zero until they do
+	CheckedIn time.Time
+	// Created is when the visitor registered
+	Created time.Time
+	// Queued is when a lapsed RSVP was confirmed and queued for a seat
+	// again, behind everyone already waiting.  It is zero for RSVPs that
+	// kept the place they registered in
+	Queued time.Time
+	// Updated is when the status last changed
+	Updated time.Time
+}
+
+// Active reports whether the RSVP hasn't been cancelled, cancelled ones are
+// kept so organizers can see who dropped out
+func (v RSVP) Active() bool {
+	return v.Status != rsvpCancelled
+}
+
+// Lapsed reports whether the RSVP went unconfirmed for longer than rsvpLapse.
+// It no longer holds a seat or a waitlist place, but the visitor can still
+// confirm it and queue for a seat again
+func (v RSVP) Lapsed() bool {
+	return v.Status == rsvpPending && time.Since(v.Updated) > rsvpLapse
+}
+
+// Holding reports whether the RSVP holds a seat or a place on the waitlist
+func (v RSVP) Holding() bool {
+	return v.Active() && !v.Lapsed()
+}
+
+// queuedAt is when the RSVP took its place in the queue for seats
+func (v RSVP) queuedAt() time.Time {
+	if v.Queued.IsZero() {
+		return v.Created
+	}
+
+	return v.Queued
+}
+
+// rsvpsByCreated sorts RSVPs oldest first
+type rsvpsByCreated []RSVP
+
+func (v rsvpsByCreated) Len() int           { return len(v) }
+func (v rsvpsByCreated) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v rsvpsByCreated) Less(i, j int) bool { return v[i].Created.Before(v[j].Created) }
+
+// rsvpsByQueued sorts RSVPs by when they queued for a seat, which is
+// waitlist order
+type rsvpsByQueued []RSVP
+
+func (v rsvpsByQueued) Len() int           { return len(v) }
+func (v rsvpsByQueued) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v rsvpsByQueued) Less(i, j int) bool { return v[i].queuedAt().Before(v[j].queuedAt()) }
+
+// rsvpCounts tallies an event's RSVPs.  Confirmed and Pending only count
+// RSVPs holding a seat, everyone waiting for one is counted in Waitlisted
+type rsvpCounts struct {
+	Confirmed  int
+	Pending    int
+	Waitlisted int
+	Lapsed     int
+	Cancelled  int
+}
+
+func countRSVPs(rsvps []RSVP) rsvpCounts {
+	var c rsvpCounts
+	for _, v := range rsvps {
+		switch {
+		case !v.Active():
+			c.Cancelled++
+		case v.Lapsed():
+			c.Lapsed++
+		case v.Waitlisted:
+			c.Waitlisted++
+		case v.Status == rsvpConfirmed:
+			c.Confirmed++
+		default:
+			c.Pending++
+		}
+	}
+
+	return c
+}
+
+// seats describes how full an event is
+type seats struct {
+	// Capacity is the event's capacity, zero if it has no limit
+	Capacity int
+	// Taken counts the RSVPs holding a seat
+	Taken int
+	// Waitlist counts the RSVPs waiting for a seat
+	Waitlist int
+}
+
+func countSeats(e Event, rsvps []RSVP) seats {
+	c := countRSVPs(rsvps)
+	return seats{e.Capacity, c.Confirmed + c.Pending, c.Waitlisted}
+}
+
+// Full reports whether new RSVPs go on the waitlist
+func (s seats) Full() bool {
+	return s.Capacity > 0 && s.Taken >= s.Capacity
+}
+
+// Left is how many seats are still free
+func (s seats) Left() int {
+	if s.Full() {
+		return 0
+	}
+
+	return s.Capacity - s.Taken
+}
+
+// waitlist returns the RSVPs waiting for a seat, in waitlist order
+func waitlist(rsvps []RSVP) []RSVP {
+	var waiting []RSVP
+	for _, v := range rsvps {
+		if v.Holding() && v.Waitlisted {
+			waiting = append(waiting, v)
+		}
+	}
+
+	sort.Stable(rsvpsByQueued(waiting))
+	return waiting
+}
+
+// waitlistPosition returns where the RSVP with the given ID is on the
+// waitlist, counting from 1, or 0 if it isn't waiting
+func waitlistPosition(rsvps []RSVP, id string) int {
+	for i, v := range waitlist(rsvps) {
+		if v.ID == id {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// promotions returns the waitlisted RSVPs that now have a seat, in waitlist
+// order, with Waitlisted cleared
+func promotions(e Event, rsvps []RSVP) []RSVP {
+	free := countSeats(e, rsvps).Left()
+	var promoted []RSVP
+	for _, v := range waitlist(rsvps) {
+		// with no capacity everyone gets a seat
+		if e.Capacity > 0 && len(promoted) >= free {
+			break
+		}
+
+		v.Waitlisted = false
+		v.Updated = time.Now().UTC()
+		promoted = append(promoted, v)
+	}
+
+	return promoted
+}
+
+// promote saves the promotions of e's waitlist through store, returning the
+// promoted RSVPs.  rsvps are updated to match.  It must be
+// called inside Atomically
+func promote(store RSVPStore, e Event, rsvps []RSVP) ([]RSVP, error) {
+	promoted := promotions(e, rsvps)
+	for _, v := range promoted {
+		if err := store.Update(e.ID, v); err != nil {
+			return nil, err
+		}
+
+		for i := range rsvps {
+			if rsvps[i].ID == v.ID {
+				rsvps[i] = v
+			}
+		}
+	}
+
+	return promoted, nil
+}
+
+// fillSeats hands any free seats at e to the front of its waitlist and lets
+// those visitors know.  It is called whenever a seat is given up or the
+// capacity changes, and when a waitlisted visitor checks on their RSVP since
+// seats also free up as pending RSVPs lapse
+func (s *site) fillSeats(r *http.Request, e Event) error {
+	var promoted []RSVP
+	err := s.backend.RSVPs(r).Atomically(e.ID, func(store RSVPStore) error {
+		rsvps, err := store.List(e.ID)
+		if err != nil {
+			return err
+		}
+
+		promoted, err = promote(store, e, rsvps)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notifyPromoted(r, e, promoted)
+	return nil
+}
+
+// notifyPromoted emails the visitors whose RSVPs came off the waitlist
+func (s *site) notifyPromoted(r *http.Request, e Event, promoted []RSVP) {
+	// a failed email shouldn't undo the promotion, the visitor can still see
+	// it on their RSVP page
+	for _, v := range promoted {
+		if err := s.sendPromotion(r, e, v); err != nil {
+			logHandler("ERROR", fmt.Sprintf("emailing %s about their seat failed: %v", v.Email, err))
+		}
+	}
+}
+
+// RSVPOpen reports whether visitors can still register for the event, which
+// they can until it starts
+func (e Event) RSVPOpen() bool {
+	return e.Datetime.IsZero() || time.Now().Before(e.Datetime)
+}
+
+// rsvpURL is the absolute link a visitor uses to confirm or cancel their RSVP
+func rsvpURL(r *http.Request, eventID, rsvpID string) string {
+	return baseURL(r) + "/events/" + eventID + "/rsvp/" + rsvpID
+}
+
+// sendRSVPLink emails the visitor the link to manage their RSVP
+func (s *site) sendRSVPLink(r *http.Request, e Event, v RSVP) error {
+	waitlist := ""
+	if v.Waitlisted {
+		waitlist = "\nThe event is full, so you are on the waitlist.  We'll email you if a\nseat opens up.\n"
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Thanks for registering for %s on %s.
+%s
+Please confirm your place within 48 hours by following this link:
+
+%s
+
+You can use the same link to cancel if you can no longer make it.
+
+GDG Gigcity
+`, v.Name, e.Title, e.When(), waitlist, rsvpURL(r, e.ID, v.ID))
+
+	return s.mail.Send(r, v.Email, "Confirm your RSVP for "+e.Title, body)
+}
+
+// sendPromotion lets a visitor know they have come off the waitlist
+func (s *site) sendPromotion(r *http.Request, e Event, v RSVP) error {
+	next := fmt.Sprintf("Please confirm you can still make it by following this link:\n\n%s", rsvpURL(r, e.ID, v.ID))
+	if v.Status == rsvpConfirmed {
+		next = fmt.Sprintf("Your ticket for the door is at:\n\n%s\n\nIf you can no longer make it, please give the seat up here:\n\n%s",
+			ticketURL(r, e.ID, v.ID), rsvpURL(r, e.ID, v.ID))
+	}
+
+	body := fmt.Sprintf(`Hi %s,
+
+Good news, a seat has opened up at %s on %s and it is yours.
+
+%s
+
+GDG Gigcity
+`, v.Name, e.Title, e.When(), next)
+
+	return s.mail.Send(r, v.Email, "You have a seat at "+e.Title, body)
+}
+
+// rsvpEvent fetches the event named in the URL.  If it can't, a not found
+// page or a redirect to its new slug is sent (with suffix appended) and ok is
+// false
+func (s *site) rsvpEvent(w http.ResponseWriter, r *http.Request, suffix string) (e Event, ok bool) {
+	eventID := r.URL.Query().Get(":event")
+	e, err := s.backend.Events(r).Get(eventID)
+	if err == ErrNotFound {
+		if !s.redirectOldSlug(w, r, "Events", eventID, "/events/", suffix) {
+			s.errorHandler(w, r, http.StatusNotFound, "")
+		}
+		return e, false
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return e, false
+	}
+
+	return e, true
+}
+
+// rsvpPage is what static/rsvp.html is rendered with
+type rsvpPage struct {
+	Event Event
+	RSVP  RSVP
+	// Sent is set once the confirmation link has been emailed
+	Sent bool
+	// Position is where the RSVP is on the waitlist, 0 if it isn't waiting
+	Position int
+	// Error says what was wrong with the submitted form
+	Error string
+}
+
+// renderRSVP shows the RSVP page with the given status
+func (s *site) renderRSVP(w http.ResponseWriter, r *http.Request, status int, context rsvpPage) {
+	s.renderStatus(w, r, status, "rsvp", context)
+}
+
+// Handles POST requests to /events/:event/rsvp from the form on the event page
+func (s *site) rsvpHandler(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.rsvpEvent(w, r, "")
+	if !ok {
+		return
+	}
+
+	context := rsvpPage{Event: e}
+	if !e.RSVPOpen() {
+		context.Error = "Registration for this event has closed."
+		s.renderRSVP(w, r, http.StatusConflict, context)
+		return
+	}
+
+	if !s.rsvpLimit.allow(clientAddr(r), time.Now()) {
+		context.Error = "There have been too many registrations from your connection, please try again later."
+		s.renderRSVP(w, r, http.StatusTooManyRequests, context)
+		return
+	}
+
+	if tooLong(r.FormValue, "RSVP", lineField("name"), lineField("email")) != "" {
+		context.Error = fmt.Sprintf("Your name and email address can be at most %d characters each.", maxLineLen)
+		s.renderRSVP(w, r, http.StatusBadRequest, context)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	addr, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+	if name == "" || err != nil {
+		context.Error = "Please give your name and a valid email address."
+		s.renderRSVP(w, r, http.StatusBadRequest, context)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the seat count and the new RSVP have to be written together, or two
+	// visitors could both take the last seat
+	var v RSVP
+	var promoted []RSVP
+	err = s.backend.RSVPs(r).Atomically(e.ID, func(store RSVPStore) error {
+		rsvps, err := store.List(e.ID)
+		if err != nil {
+			return err
+		}
+
+		// registering again just resends the link to the existing RSVP
+		for _, existing := range rsvps {
+			if existing.Holding() && strings.EqualFold(existing.Email, addr.Address) {
+				v = existing
+				return nil
+			}
+		}
+
+		// seats freed by lapsed RSVPs go to the waitlist before anyone new
+		promoted, err = promote(store, e, rsvps)
+		if err != nil {
+			return err
+		}
+
+		v = RSVP{
+			ID:         id,
+			Name:       name,
+			Email:      addr.Address,
+			Status:     rsvpPending,
+			Waitlisted: countSeats(e, rsvps).Full(),
+			Created:    time.Now().UTC(),
+		}
+		v.Updated = v.Created
+		return store.Add(e.ID, v)
+	})
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.notifyPromoted(r, e, promoted)
+
+	if err := s.sendRSVPLink(r, e, v); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context.RSVP = v
+	context.Sent = true
+	s.renderRSVP(w, r, http.StatusOK, context)
+}
+
+// Handles requests to /events/:event/rsvp/:rsvp, the page the emailed link
+// leads to
+func (s *site) manageRSVPHandler(w http.ResponseWriter, r *http.Request) {
+	rsvpID := r.URL.Query().Get(":rsvp")
+	e, ok := s.rsvpEvent(w, r, "/rsvp/"+rsvpID)
+	if !ok {
+		return
+	}
+
+	v, err := s.backend.RSVPs(r).Get(e.ID, rsvpID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context := rsvpPage{Event: e, RSVP: v}
+	if v.Holding() && v.Waitlisted {
+		// the seat the visitor is waiting for may be one a lapsed RSVP gave
+		// up, so hand those out before saying where they stand
+		if err := s.fillSeats(r, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rsvps, err := s.backend.RSVPs(r).List(e.ID)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		for _, other := range rsvps {
+			if other.ID == v.ID {
+				context.RSVP = other
+			}
+		}
+		context.Position = waitlistPosition(rsvps, v.ID)
+	}
+
+	s.renderRSVP(w, r, http.StatusOK, context)
+}
+
+// setRSVPStatus moves the RSVP named in the URL from one of the statuses in
+// from to status, then shows the visitor their RSVP page.  A seat given up by
+// cancelling goes to the front of the waitlist
+func (s *site) setRSVPStatus(w http.ResponseWriter, r *http.Request, status string, from ...string) {
+	rsvpID := r.URL.Query().Get(":rsvp")
+	e, ok := s.rsvpEvent(w, r, "/rsvp/"+rsvpID)
+	if !ok {
+		return
+	}
+
+	// read and write together so a promotion happening at the same time
+	// isn't overwritten
+	var v RSVP
+	var changed bool
+	err := s.backend.RSVPs(r).Atomically(e.ID, func(store RSVPStore) error {
+		var err error
+		v, err = store.Get(e.ID, rsvpID)
+		if err != nil {
+			return err
+		}
+
+		// anything else is a stale page being resubmitted, just show where
+		// the RSVP stands now
+		changed = false
+		for _, f := range from {
+			if v.Status == f {
+				// a lapsed RSVP lost its seat, confirming it queues for one
+				// again behind everyone already waiting
+				now := time.Now().UTC()
+				if v.Lapsed() && status == rsvpConfirmed {
+					v.Waitlisted = true
+					v.Queued = now
+				}
+				v.Status = status
+				v.Updated = now
+				changed = true
+				return store.Update(e.ID, v)
+			}
+		}
+
+		return nil
+	})
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if changed && (!v.Active() || v.Waitlisted) {
+		if err := s.fillSeats(r, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// a confirmed seat comes with a ticket for the door
+	if changed && v.Status == rsvpConfirmed && !v.Waitlisted {
+		if err := s.sendTicket(r, e, v); err != nil {
+			logHandler("ERROR", fmt.Sprintf("emailing %s their ticket failed: %v", v.Email, err))
+		}
+	}
+
+	http.Redirect(w, r, "/events/"+e.ID+"/rsvp/"+v.ID, http.StatusFound)
+}
+
+// Handles requests to /events/:event/rsvp/:rsvp/confirm
+func (s *site) confirmRSVPHandler(w http.ResponseWriter, r *http.Request) {
+	s.setRSVPStatus(w, r, rsvpConfirmed, rsvpPending)
+}
+
+// Handles requests to /events/:event/rsvp/:rsvp/cancel
+func (s *site) cancelRSVPHandler(w http.ResponseWriter, r *http.Request) {
+	s.setRSVPStatus(w, r, rsvpCancelled, rsvpPending, rsvpConfirmed)
+}
+
+// Handles requests to /admin/events/:event/rsvps, the attendee list
+func (s *site) adminRSVPsHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Event  Event
+		RSVPs  []RSVP
+		Counts rsvpCounts
+		Seats  seats
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	e, err := s.backend.Events(r).Get(r.URL.Query().Get(":event"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rsvps, err := s.backend.RSVPs(r).List(e.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "admin/rsvps", Content{e, rsvps, countRSVPs(rsvps), countSeats(e, rsvps)})
+}
@@ -0,0 +1,245 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRSVPs returns RSVPs oldest first, one per status given, each created a
+// minute after the last.  "waitlisted" is a pending RSVP on the waitlist and
+// "lapsed" a pending one left unconfirmed for too long
+func testRSVPs(statuses ...string) []RSVP {
+	now := time.Now().UTC()
+	var rsvps []RSVP
+	for i, status := range statuses {
+		v := RSVP{
+			ID:      fmt.Sprintf("r%d", i),
+			Email:   fmt.Sprintf("r%d@example.com", i),
+			Status:  status,
+			Created: now.Add(time.Duration(i-len(statuses)) * time.Minute),
+			Updated: now,
+		}
+		switch status {
+		case "waitlisted":
+			v.Status, v.Waitlisted = rsvpPending, true
+		case "lapsed":
+			v.Status, v.Updated = rsvpPending, now.Add(-rsvpLapse-time.Minute)
+		}
+
+		rsvps = append(rsvps, v)
+	}
+
+	return rsvps
+}
+
+func TestLapsed(t *testing.T) {
+	for _, tt := range []struct {
+		v               RSVP
+		lapsed, holding bool
+	}{
+		{RSVP{Status: rsvpPending, Updated: time.Now()}, false, true},
+		{RSVP{Status: rsvpPending, Updated: time.Now().Add(-rsvpLapse + time.Minute)}, false, true},
+		{RSVP{Status: rsvpPending, Updated: time.Now().Add(-rsvpLapse - time.Minute)}, true, false},
+		{RSVP{Status: rsvpConfirmed, Updated: time.Now().Add(-rsvpLapse - time.Minute)}, false, true},
+		{RSVP{Status: rsvpCancelled, Updated: time.Now()}, false, false},
+	} {
+		if tt.v.Lapsed() != tt.lapsed || tt.v.Holding() != tt.holding {
+			t.Errorf("%s RSVP updated %s ago: Lapsed %v Holding %v, want %v %v", tt.v.Status,
+				time.Since(tt.v.Updated).Round(time.Minute), tt.v.Lapsed(), tt.v.Holding(), tt.lapsed, tt.holding)
+		}
+	}
+}
+
+func TestCountRSVPs(t *testing.T) {
+	rsvps := testRSVPs(rsvpConfirmed, rsvpPending, "lapsed", rsvpCancelled, "waitlisted", "waitlisted")
+	want := rsvpCounts{Confirmed: 1, Pending: 1, Waitlisted: 2, Lapsed: 1, Cancelled: 1}
+	if got := countRSVPs(rsvps); got != want {
+		t.Errorf("countRSVPs = %+v, want %+v", got, want)
+	}
+
+	s := countSeats(Event{Capacity: 3}, rsvps)
+	if s.Full() || s.Left() != 1 {
+		t.Errorf("3 seats with 2 taken: Full %v Left %d, want a seat left", s.Full(), s.Left())
+	}
+	if n := waitlistPosition(rsvps, "r5"); n != 2 {
+		t.Errorf("waitlistPosition = %d, want 2", n)
+	}
+}
+
+func TestPromotions(t *testing.T) {
+	for _, tt := range []struct {
+		capacity int
+		rsvps    []RSVP
+		want     string
+	}{
+		// seats freed by a cancellation and a lapse go to the front of the
+		// waitlist, skipping lapsed waitlisted RSVPs
+		{3, testRSVPs(rsvpConfirmed, rsvpCancelled, "lapsed", "waitlisted", "waitlisted", "waitlisted"), "[r3 r4]"},
+		{2, testRSVPs(rsvpConfirmed, rsvpPending, "waitlisted"), "[]"},
+		// over capacity after it was lowered
+		{1, testRSVPs(rsvpConfirmed, rsvpConfirmed, "waitlisted"), "[]"},
+		// no capacity at all seats everyone
+		{0, testRSVPs(rsvpConfirmed, "waitlisted", "waitlisted"), "[r1 r2]"},
+	} {
+		var ids []string
+		for _, v := range promotions(Event{Capacity: tt.capacity}, tt.rsvps) {
+			if v.Waitlisted {
+				t.Errorf("promoted %s is still waitlisted", v.ID)
+			}
+			ids = append(ids, v.ID)
+		}
+
+		if got := fmt.Sprint(ids); got != tt.want {
+			t.Errorf("capacity %d: promoted %s, want %s", tt.capacity, got, tt.want)
+		}
+	}
+
+	rsvps := testRSVPs(rsvpConfirmed, "waitlisted")
+	rsvps[1].Updated = time.Now().Add(-rsvpLapse - time.Minute)
+	if promoted := promotions(Event{Capacity: 5}, rsvps); len(promoted) != 0 {
+		t.Errorf("a lapsed waitlisted RSVP was promoted: %+v", promoted)
+	}
+}
+
+func TestFillSeats(t *testing.T) {
+	mail := new(testMailer)
+	s := &site{backend: newMemoryBackend(), mail: mail}
+	r := httptest.NewRequest("GET", "/", nil)
+	e := Event{ID: "go-night", Title: "Go Night", Capacity: 2, Datetime: time.Now().Add(24 * time.Hour)}
+
+	if err := s.backend.Events(r).Add(e); err != nil {
+		t.Fatal(err)
+	}
+
+	store := s.backend.RSVPs(r)
+	for _, v := range testRSVPs(rsvpConfirmed, "lapsed", "waitlisted", "waitlisted") {
+		if err := store.Add(e.ID, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.fillSeats(r, e); err != nil {
+		t.Fatal(err)
+	}
+
+	rsvps, err := store.List(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countRSVPs(rsvps), (rsvpCounts{Confirmed: 1, Pending: 1, Waitlisted: 1, Lapsed: 1}); got != want {
+		t.Errorf("after filling seats %+v, want %+v", got, want)
+	}
+	if len(mail.sent) != 1 || mail.sent[0].To != "r2@example.com" {
+		t.Errorf("sent %+v, want one email to r2@example.com", mail.sent)
+	}
+
+	// nothing more to hand out
+	if err := s.fillSeats(r, e); err != nil {
+		t.Fatal(err)
+	}
+	if len(mail.sent) != 1 {
+		t.Errorf("filling a full event sent %d more emails", len(mail.sent)-1)
+	}
+}
+
+func TestLapsedConfirmRequeues(t *testing.T) {
+	ts := newTestServer(t)
+	e := Event{ID: "go-night", Title: "Go Night", Capacity: 1, Datetime: time.Now().Add(24 * time.Hour)}
+	if err := ts.Backend.Events(nil).Add(e); err != nil {
+		t.Fatal(err)
+	}
+
+	store := ts.Backend.RSVPs(nil)
+	for _, v := range testRSVPs(rsvpConfirmed, "lapsed", "waitlisted") {
+		if err := store.Add(e.ID, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// r1 registered before r2 but let its place go, confirming late queues
+	// it behind r2
+	if resp, _ := ts.request(t, "POST", "/events/go-night/rsvp/r1/confirm", nil, false); resp.StatusCode != http.StatusFound {
+		t.Fatalf("confirming the lapsed RSVP = %d", resp.StatusCode)
+	}
+	rsvps, err := store.List(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := waitlistPosition(rsvps, "r1"); got != 2 {
+		t.Errorf("the late confirmation is %d on the waitlist, want 2", got)
+	}
+
+	if resp, _ := ts.request(t, "POST", "/events/go-night/rsvp/r0/cancel", nil, false); resp.StatusCode != http.StatusFound {
+		t.Fatalf("cancelling = %d", resp.StatusCode)
+	}
+	r1, _ := store.Get(e.ID, "r1")
+	r2, _ := store.Get(e.ID, "r2")
+	if r2.Waitlisted || !r1.Waitlisted {
+		t.Errorf("after the cancellation r1 waitlisted %v, r2 waitlisted %v, want the seat to go to r2", r1.Waitlisted, r2.Waitlisted)
+	}
+}
+
+func TestRSVP(t *testing.T) {
+	ts := newTestServer(t)
+	e := Event{ID: "go-night", Title: "Go Night", Datetime: time.Now().Add(24 * time.Hour)}
+	if err := ts.Backend.Events(nil).Add(e); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"name": {"Ada"}, "email": {"nope"}}
+	if resp, _ := ts.request(t, "POST", "/events/go-night/rsvp", form, false); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("RSVP with a bad address: status %d", resp.StatusCode)
+	}
+
+	form.Set("email", "Ada <ada@example.com>")
+	for i := 0; i < 2; i++ {
+		if resp, _ := ts.request(t, "POST", "/events/go-night/rsvp", form, false); resp.StatusCode != http.StatusOK {
+			t.Fatalf("RSVP status %d", resp.StatusCode)
+		}
+	}
+
+	// registering twice resends the link to the same RSVP
+	rsvps, err := ts.Backend.RSVPs(nil).List(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsvps) != 1 || rsvps[0].Status != rsvpPending || rsvps[0].Email != "ada@example.com" {
+		t.Fatalf("RSVPs = %+v, want one pending", rsvps)
+	}
+
+	link := "/events/go-night/rsvp/" + rsvps[0].ID
+	if len(ts.Mail.sent) != 2 || ts.Mail.sent[1].To != "ada@example.com" || !strings.Contains(ts.Mail.sent[1].Body, ts.URL+link) {
+		t.Fatalf("sent %+v, want the link to %s twice", ts.Mail.sent, link)
+	}
+
+	for _, step := range []struct{ action, want string }{
+		{"/confirm", rsvpConfirmed},
+		// confirming a cancelled RSVP from a stale page doesn't bring it back
+		{"/cancel", rsvpCancelled},
+		{"/confirm", rsvpCancelled},
+	} {
+		if resp, _ := ts.request(t, "POST", link+step.action, nil, false); resp.StatusCode != http.StatusFound {
+			t.Fatalf("POST %s: status %d", step.action, resp.StatusCode)
+		}
+		if v, _ := ts.Backend.RSVPs(nil).Get(e.ID, rsvps[0].ID); v.Status != step.want {
+			t.Errorf("after %s the RSVP is %s, want %s", step.action, v.Status, step.want)
+		}
+	}
+
+	if resp, _ := ts.request(t, "GET", "/events/go-night/rsvp/nope", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown RSVP: status %d", resp.StatusCode)
+	}
+
+	e.ID, e.Datetime = "last-year", time.Now().AddDate(-1, 0, 0)
+	if err := ts.Backend.Events(nil).Add(e); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := ts.request(t, "POST", "/events/last-year/rsvp", form, false); resp.StatusCode != http.StatusConflict {
+		t.Errorf("RSVP to a past event: status %d", resp.StatusCode)
+	}
+}
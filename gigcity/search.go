@@ -0,0 +1,392 @@
+package gigcity
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SearchDoc is a record's text as the search index holds it
+type SearchDoc struct {
+	// Kind is the record's entity kind, one of the keys of searchKinds
+	Kind string
+	// ID is the record's ID
+	ID    string
+	Title string
+	// Body is the rest of the record's text, with any Markdown stripped
+	Body string
+	// Datetime is when an event or study group is, zero for locations
+	Datetime time.Time
+}
+
+// searchKind describes a kind of record in the search index
+type searchKind struct {
+	// Label names the kind on the search page
+	Label string
+	// API names the kind in API responses
+	API string
+	// Path is where records of the kind are shown, followed by their ID
+	Path string
+}
+
+// searchKinds are the kinds of record the search index holds, keyed by the
+// same kind names the slug redirects use
+var searchKinds = map[string]searchKind{
+	"Events":     {"Event", "event", "/events/"},
+	"LearnEvent": {"Study group", "learning", "/learning/"},
+	"Locations":  {"Location", "location", "/locations/"},
+}
+
+const (
+	// maxSearchResults caps how many matches a search returns
+	maxSearchResults = maxPageSize
+	// maxSearchTerms caps how many words of a query are searched for
+	maxSearchTerms = 10
+	// snippetWords is how many words of a record's body a result shows
+	snippetWords = 30
+)
+
+// searchKey is the ID a record's document is indexed under
+func searchKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+// searchWord matches the words records are indexed and searched by
+var searchWord = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// searchTerms splits a search query into the distinct lower case words it is
+// made of
+func searchTerms(q string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, w := range searchWord.FindAllString(strings.ToLower(q), -1) {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+
+	return terms
+}
+
+// isTerm reports whether word, in any case, is one of terms
+func isTerm(terms []string, word string) bool {
+	word = strings.ToLower(word)
+	for _, t := range terms {
+		if t == word {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchScore ranks doc against terms for the backends without a search
+// service of their own.  It is zero unless doc contains every one of terms,
+// and matches in the title count for more than ones in the body
+func searchScore(doc SearchDoc, terms []string) int {
+	count := func(text string) map[string]int {
+		n := make(map[string]int)
+		for _, w := range searchWord.FindAllString(strings.ToLower(text), -1) {
+			n[w]++
+		}
+		return n
+	}
+
+	title, body := count(doc.Title), count(doc.Body)
+	score := 0
+	for _, t := range terms {
+		if title[t]+body[t] == 0 {
+			return 0
+		}
+		score += 5*title[t] + body[t]
+	}
+
+	return score
+}
+
+// highlight escapes text for HTML, marking the words that are among terms
+func highlight(text string, terms []string) template.HTML {
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range searchWord.FindAllStringIndex(text, -1) {
+		if !isTerm(terms, text[loc[0]:loc[1]]) {
+			continue
+		}
+
+		buf.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+		buf.WriteString("<mark>")
+		buf.WriteString(template.HTMLEscapeString(text[loc[0]:loc[1]]))
+		buf.WriteString("</mark>")
+		last = loc[1]
+	}
+	buf.WriteString(template.HTMLEscapeString(text[last:]))
+
+	return template.HTML(buf.String())
+}
+
+// snippet picks the words of body around the first one among terms, so a
+// result shows why it matched, and highlights them
+func snippet(body string, terms []string) template.HTML {
+	words := searchWord.FindAllStringIndex(body, -1)
+	if len(words) == 0 {
+		return ""
+	}
+
+	first := 0
+	for i, loc := range words {
+		if isTerm(terms, body[loc[0]:loc[1]]) {
+			first = i
+			break
+		}
+	}
+
+	start := first - snippetWords/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+
+	// cut at word boundaries, unless the snippet runs to the start or end of
+	// body, so its punctuation is kept
+	from, to := words[start][0], words[end-1][1]
+	if start == 0 {
+		from = 0
+	}
+	if end == len(words) {
+		to = len(body)
+	}
+
+	text := strings.Join(strings.Fields(body[from:to]), " ")
+	out := highlight(text, terms)
+	if start > 0 {
+		out = "&hellip; " + out
+	}
+	if end < len(words) {
+		out += " &hellip;"
+	}
+
+	return out
+}
+
+func eventDoc(e Event) SearchDoc {
+	return SearchDoc{Kind: "Events", ID: e.ID, Title: e.Title, Body: plainText(e.Details), Datetime: e.Datetime}
+}
+
+func learnEventDoc(l LearnEvent) SearchDoc {
+	return SearchDoc{Kind: "LearnEvent", ID: l.ID, Title: l.Title, Body: plainText(l.Details), Datetime: l.Datetime}
+}
+
+func locationDoc(l Location) SearchDoc {
+	return SearchDoc{Kind: "Locations", ID: l.ID, Title: l.Name, Body: l.Address + "\n" + plainText(l.Details)}
+}
+
+// recordDoc is the document of v, an *Event, *LearnEvent or *Location
+func recordDoc(v interface{}) SearchDoc {
+	switch v := v.(type) {
+	case *Event:
+		return eventDoc(*v)
+	case *LearnEvent:
+		return learnEventDoc(*v)
+	case *Location:
+		return locationDoc(*v)
+	}
+
+	return SearchDoc{}
+}
+
+// index adds doc to the search index, or refreshes it.  The record itself is
+// already saved by then, so a failure is only logged, rebuilding the index
+// from /admin/search repairs it
+func (s *site) index(r *http.Request, doc SearchDoc) {
+	if err := s.backend.Search(r).Put(doc); err != nil {
+		logHandler("ERROR", fmt.Sprintf("indexing %s %s failed: %v", doc.Kind, doc.ID, err))
+	}
+}
+
+// unindex drops a deleted or renamed record from the search index, failures
+// are only logged like index's
+func (s *site) unindex(r *http.Request, kind, id string) {
+	if err := s.backend.Search(r).Delete(kind, id); err != nil {
+		logHandler("ERROR", fmt.Sprintf("removing %s %s from the search index failed: %v", kind, id, err))
+	}
+}
+
+// search runs the query q, without asking the index if there are no words in
+// it.  It also returns the terms searched for, to highlight them
+func (s *site) search(r *http.Request, q string) ([]SearchDoc, []string, error) {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return nil, nil, nil
+	}
+
+	docs, err := s.backend.Search(r).Search(terms, maxSearchResults)
+	return docs, terms, err
+}
+
+// searchResult is a match as the search page shows it
+type searchResult struct {
+	Kind    string
+	URL     string
+	Title   template.HTML
+	Snippet template.HTML
+	// When is the date of an event or study group, "" for locations
+	When string
+}
+
+// Handles requests for /search
+func (s *site) searchHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Query   string
+		Results []searchResult
+	}
+
+	context := Content{Query: strings.TrimSpace(r.URL.Query().Get("q"))}
+	docs, terms, err := s.search(r, context.Query)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, d := range docs {
+		kind, ok := searchKinds[d.Kind]
+		if !ok {
+			continue
+		}
+
+		result := searchResult{
+			Kind:    kind.Label,
+			URL:     kind.Path + d.ID,
+			Title:   highlight(d.Title, terms),
+			Snippet: snippet(d.Body, terms),
+		}
+		if !d.Datetime.IsZero() {
+			result.When = formatLocal(d.Datetime, "")
+		}
+		context.Results = append(context.Results, result)
+	}
+
+	s.render(w, r, "search", context)
+}
+
+// apiSearchResult is a search match as exposed by the JSON API
+type apiSearchResult struct {
+	Kind  string     `json:"kind"`
+	ID    string     `json:"id"`
+	Title string     `json:"title"`
+	URL   string     `json:"url"`
+	Start *time.Time `json:"start,omitempty"`
+	// Snippet is HTML, with the matched words in <mark> elements
+	Snippet string `json:"snippet"`
+}
+
+// Handles requests for /api/v1/search, best match first
+func (s *site) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, limit, msg := parsePaging(q)
+	if msg == "" && len(searchTerms(q.Get("q"))) == 0 {
+		msg = "q must contain a word to search for"
+	}
+	if msg != "" {
+		apiError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	docs, terms, err := s.search(r, q.Get("q"))
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	start, end, paging := page(r, offset, limit, len(docs))
+	results := make([]apiSearchResult, 0, end-start)
+	for _, d := range docs[start:end] {
+		kind := searchKinds[d.Kind]
+		results = append(results, apiSearchResult{
+			Kind:    kind.API,
+			ID:      d.ID,
+			Title:   d.Title,
+			URL:     baseURL(r) + kind.Path + d.ID,
+			Start:   apiTime(d.Datetime),
+			Snippet: string(snippet(d.Body, terms)),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, apiList{Data: results, Paging: paging})
+}
+
+// reindex indexes every event, study group and location again and returns
+// how many there were
+func (s *site) reindex(r *http.Request) (int, error) {
+	var docs []SearchDoc
+	events, err := s.backend.Events(r).List(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range events {
+		docs = append(docs, eventDoc(e))
+	}
+
+	learn, err := s.backend.LearnEvents(r).List(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range learn {
+		docs = append(docs, learnEventDoc(l))
+	}
+
+	locations, err := s.backend.Locations(r).List(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range locations {
+		docs = append(docs, locationDoc(l))
+	}
+
+	idx := s.backend.Search(r)
+	for _, d := range docs {
+		if err := idx.Put(d); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(docs), nil
+}
+
+// Handles requests to /admin/search.  GET explains rebuilding the search
+// index, POST indexes every event, study group and location again, for
+// records saved before there was an index or whose indexing failed
+func (s *site) adminSearchHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Ran     bool
+		Indexed int
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var context Content
+	if r.Method == "POST" {
+		var err error
+		if context.Indexed, err = s.reindex(r); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		context.Ran = true
+	}
+
+	s.render(w, r, "admin/search", context)
+}
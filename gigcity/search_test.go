@@ -0,0 +1,142 @@
+package gigcity
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := fmt.Sprint(searchTerms("Go, go and GOLANG! café-bar"))
+	if want := "[go and golang café bar]"; got != want {
+		t.Errorf("searchTerms = %s, want %s", got, want)
+	}
+
+	if n := len(searchTerms(strings.Repeat("a b c d e f g h i j ", 5) + "k l m")); n != maxSearchTerms {
+		t.Errorf("got %d terms, want at most %d", n, maxSearchTerms)
+	}
+}
+
+func TestSearchScore(t *testing.T) {
+	doc := SearchDoc{Title: "Go Night", Body: "Lightning talks about Go and gRPC, then pizza."}
+	for _, tt := range []struct {
+		terms []string
+		want  int
+	}{
+		{[]string{"pizza"}, 1},
+		{[]string{"night"}, 5},
+		{[]string{"go"}, 6},
+		{[]string{"go", "pizza"}, 7},
+		// every term must match
+		{[]string{"go", "rust"}, 0},
+		// whole words only
+		{[]string{"light"}, 0},
+		{nil, 0},
+	} {
+		if got := searchScore(doc, tt.terms); got != tt.want {
+			t.Errorf("searchScore(%v) = %d, want %d", tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	for _, tt := range []struct {
+		body  string
+		terms []string
+		want  template.HTML
+	}{
+		{"", []string{"go"}, ""},
+		{"Talks about Go.", []string{"go"}, "Talks about <mark>Go</mark>."},
+		{"Bring <b>snacks</b> & go!", []string{"go", "snacks"}, "Bring &lt;b&gt;<mark>snacks</mark>&lt;/b&gt; &amp; <mark>go</mark>!"},
+		{"Talks   about\n\nGo", []string{"rust"}, "Talks about Go"},
+	} {
+		if got := snippet(tt.body, tt.terms); got != tt.want {
+			t.Errorf("snippet(%q, %v) = %q, want %q", tt.body, tt.terms, got, tt.want)
+		}
+	}
+
+	var words []string
+	for i := 0; i < 100; i++ {
+		words = append(words, fmt.Sprintf("w%d", i))
+	}
+	words[50] = "gopher"
+
+	got := string(snippet(strings.Join(words, " ")+".", []string{"gopher"}))
+	if !strings.HasPrefix(got, "&hellip; w40 ") || !strings.HasSuffix(got, " w69 &hellip;") {
+		t.Errorf("snippet from the middle = %q, want w40 to w69 with ellipses", got)
+	}
+	if !strings.Contains(got, "<mark>gopher</mark>") {
+		t.Errorf("snippet %q doesn't mark the term", got)
+	}
+
+	got = string(snippet(strings.Join(words, " ")+".", []string{"w98"}))
+	if !strings.HasPrefix(got, "&hellip; w88 ") || !strings.HasSuffix(got, "<mark>w98</mark> w99.") {
+		t.Errorf("snippet at the end = %q, want w88 to the end with its full stop", got)
+	}
+}
+
+func TestKVSearch(t *testing.T) {
+	index := newMemoryBackend().Search(nil)
+	for _, doc := range []SearchDoc{
+		{Kind: "Event", ID: "pizza", Title: "Pizza night", Body: "Go talks"},
+		{Kind: "Event", ID: "go", Title: "Go night", Body: "Go talks"},
+		{Kind: "Location", ID: "hall", Title: "Town hall", Body: "Parking"},
+	} {
+		if err := index.Put(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docs, err := index.Search([]string{"go", "night"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0].ID != "go" || docs[1].ID != "pizza" {
+		t.Errorf("search found %+v, want the go then pizza events", docs)
+	}
+
+	if err := index.Delete("Event", "go"); err != nil {
+		t.Fatal(err)
+	}
+	if docs, _ := index.Search([]string{"go"}, 0); len(docs) != 1 || docs[0].ID != "pizza" {
+		t.Errorf("search after delete found %+v", docs)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	ts := newTestServer(t)
+	if err := ts.Backend.Events(nil).Add(Event{ID: "pizza-night", Title: "Pizza Night", Details: "Go talks and *pizza*", Datetime: at("2015-03-04T23:30")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// saved behind the site's back, so not indexed until a rebuild
+	if _, body := ts.request(t, "GET", "/search?q=pizza", nil, false); strings.Contains(body, "/events/pizza-night") {
+		t.Error("found a record that was never indexed")
+	}
+	if resp := ts.submit(t, "/admin/search", "/admin/search", url.Values{}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("rebuilding the index = %d", resp.StatusCode)
+	}
+
+	resp, body := ts.request(t, "GET", "/search?q=pizza", nil, false)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `href="/events/pizza-night"`) || !strings.Contains(body, "<mark>pizza</mark>") {
+		t.Errorf("search page = %d, want a highlighted link to the event", resp.StatusCode)
+	}
+
+	var results struct {
+		Data []apiSearchResult
+	}
+	if status := ts.getJSON(t, "/api/v1/search?q=pizza+talks", &results); status != http.StatusOK {
+		t.Fatalf("API search = %d", status)
+	}
+	if len(results.Data) != 1 || results.Data[0].Kind != "event" || results.Data[0].Snippet != "Go <mark>talks</mark> and <mark>pizza</mark>" {
+		t.Errorf("API search found %+v", results.Data)
+	}
+
+	var apiErr apiErrorBody
+	if status := ts.getJSON(t, "/api/v1/search?q=+!", &apiErr); status != http.StatusBadRequest {
+		t.Errorf("API search without words = %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,328 @@
+package gigcity
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxSlugLen caps how long a generated slug can get before any suffix is
+// added to make it unique
+const maxSlugLen = 60
+
+// transliterations maps common accented letters to plain ASCII so titles like
+// "Café Meetup" give readable URLs
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae",
+	'ç': "c", 'ć': "c", 'č': "c", 'đ': "d", 'ď': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ě': "e", 'ğ': "g",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ı': "i", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'œ': "oe",
+	'ř': "r", 'ß': "ss", 'ś': "s", 'š': "s", 'ş': "s", 'ť': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ů': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// slugify turns a title into a URL-safe ASCII slug: lowercase letters and
+// digits separated by single dashes
+func slugify(title string) string {
+	var b []byte
+	dash := false
+	for _, c := range strings.ToLower(title) {
+		var part string
+		switch {
+		case c <= unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)):
+			part = string(c)
+		case transliterations[c] != "":
+			part = transliterations[c]
+		default:
+			// everything else (spaces, punctuation, unknown scripts)
+			// separates words
+			dash = len(b) > 0
+			continue
+		}
+
+		if dash {
+			b = append(b, '-')
+			dash = false
+		}
+		b = append(b, part...)
+	}
+
+	slug := string(b)
+	if len(slug) > maxSlugLen {
+		slug = slug[:maxSlugLen]
+		// don't leave half a word behind if we can help it
+		if i := strings.LastIndex(slug, "-"); i > 0 {
+			slug = slug[:i]
+		}
+	}
+
+	if slug == "" {
+		slug = "untitled"
+	}
+
+	return slug
+}
+
+// exists turns the error from a repository Get into whether the record was
+// found.  An ID more than one record has is certainly taken
+func exists(err error) (bool, error) {
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err == ErrDuplicateID {
+		return true, nil
+	}
+
+	return err == nil, err
+}
+
+// reservedSlugs are paths under /events and /learning that aren't records
+var reservedSlugs = map[string]bool{
+	"archive": true,
+}
+
+// uniqueSlug returns the first of candidates that no record or redirect of
+// kind is using yet.  If they are all taken the first candidate is tried with
+// a counter appended.  self is the current ID of the record being saved, it
+// never counts as taken
+func (s *site) uniqueSlug(r *http.Request, kind, self string, found func(id string) (bool, error), candidates ...string) (string, error) {
+	taken := func(slug string) (bool, error) {
+		if slug == self {
+			return false, nil
+		}
+
+		if reservedSlugs[slug] {
+			return true, nil
+		}
+
+		if ok, err := found(slug); ok || err != nil {
+			return ok, err
+		}
+
+		// old slugs still redirect to their record, so they can't be handed
+		// out again unless they already point back at this record
+		target, err := s.resolveRedirect(r, kind, slug)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return target != self, nil
+	}
+
+	for _, slug := range candidates {
+		ok, err := taken(slug)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return slug, nil
+		}
+	}
+
+	for i := 2; ; i++ {
+		slug := candidates[0] + "-" + strconv.Itoa(i)
+		ok, err := taken(slug)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return slug, nil
+		}
+	}
+}
+
+// maxSlugRetries bounds how many times claimSlug picks again after losing a
+// slug to another request
+const maxSlugRetries = 5
+
+// claimSlug saves a record under the slug pick chooses for it.  Picking and
+// saving aren't one transaction, so when save reports ErrExists another
+// request took the slug in between and a fresh one is picked
+func claimSlug(pick func() (string, error), save func(slug string) error) (string, error) {
+	for i := 0; ; i++ {
+		slug, err := pick()
+		if err != nil {
+			return "", err
+		}
+
+		err = save(slug)
+		if err != ErrExists || i == maxSlugRetries {
+			return slug, err
+		}
+	}
+}
+
+// maxRedirectHops bounds how many renames resolveRedirect will follow
+const maxRedirectHops = 10
+
+// resolveRedirect follows the redirects recorded for kind starting at old and
+// returns the slug they end at, or ErrNotFound if old was never renamed
+func (s *site) resolveRedirect(r *http.Request, kind, old string) (string, error) {
+	redirects := s.backend.Redirects(r)
+	slug, err := redirects.Lookup(kind, old)
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < maxRedirectHops; i++ {
+		next, err := redirects.Lookup(kind, slug)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		slug = next
+	}
+
+	return slug, nil
+}
+
+// renameSlug records that a record of kind moved from old to slug, so links to
+// the old slug keep working
+func (s *site) renameSlug(r *http.Request, kind, old, slug string) error {
+	if old == slug {
+		return nil
+	}
+
+	redirects := s.backend.Redirects(r)
+	if err := redirects.Add(kind, old, slug); err != nil {
+		return err
+	}
+
+	// the record lives at slug now, so any redirect away from it is stale.
+	// Dropping it also keeps the redirects from ever forming a cycle
+	return redirects.Remove(kind, slug)
+}
+
+// dropRedirects forgets every old slug of kind that leads to slug, directly
+// or through later renames, so none of them ends at a deleted record
+func (s *site) dropRedirects(r *http.Request, kind, slug string) error {
+	redirects := s.backend.Redirects(r)
+	olds, err := redirects.Renamed(kind, slug)
+	if err != nil {
+		return err
+	}
+
+	for _, old := range olds {
+		if err := redirects.Remove(kind, old); err != nil {
+			return err
+		}
+
+		if err := s.dropRedirects(r, kind, old); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// redirectOldSlug sends the visitor on to prefix + slug + suffix, where slug is
+// what a record of kind was renamed to from old.  It returns false, having
+// written nothing, if old was never renamed
+func (s *site) redirectOldSlug(w http.ResponseWriter, r *http.Request, kind, old, prefix, suffix string) bool {
+	slug, err := s.resolveRedirect(r, kind, old)
+	if err != nil {
+		if err != ErrNotFound {
+			logHandler("ERROR", "looking up slug redirect failed: "+err.Error())
+		}
+		return false
+	}
+
+	http.Redirect(w, r, prefix+slug+suffix, http.StatusMovedPermanently)
+	return true
+}
+
+// eventSlug picks the ID for e.  Clashing titles get the event's date
+// appended, then a counter.  self is e's current ID, or "" for a new event
+func (s *site) eventSlug(r *http.Request, e Event, self string) (string, error) {
+	events := s.backend.Events(r)
+	found := func(id string) (bool, error) {
+		_, err := events.Get(id)
+		return exists(err)
+	}
+
+	base := slugify(e.Title)
+	candidates := []string{base}
+	if !e.Datetime.IsZero() {
+		date := e.Datetime.In(zoneOrDefault(e.TimeZone)).Format("2006-01-02")
+		candidates = append(candidates, base+"-"+date)
+	}
+
+	return s.uniqueSlug(r, "Events", self, found, candidates...)
+}
+
+// learnEventSlug picks the ID for l.  self is l's current ID, or "" for a new
+// study group
+func (s *site) learnEventSlug(r *http.Request, l LearnEvent, self string) (string, error) {
+	learn := s.backend.LearnEvents(r)
+	found := func(id string) (bool, error) {
+		_, err := learn.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "LearnEvent", self, found, slugify(l.Title))
+}
+
+// locationSlug picks the ID for a new location
+func (s *site) locationSlug(r *http.Request, l Location) (string, error) {
+	locations := s.backend.Locations(r)
+	found := func(id string) (bool, error) {
+		_, err := locations.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "Locations", "", found, slugify(l.Name))
+}
+
+// speakerSlug picks the ID for a new speaker
+func (s *site) speakerSlug(r *http.Request, sp Speaker) (string, error) {
+	speakers := s.backend.Speakers(r)
+	found := func(id string) (bool, error) {
+		_, err := speakers.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "Speakers", "", found, slugify(sp.Name))
+}
+
+// sponsorSlug picks the ID for a new sponsor
+func (s *site) sponsorSlug(r *http.Request, sp Sponsor) (string, error) {
+	sponsors := s.backend.Sponsors(r)
+	found := func(id string) (bool, error) {
+		_, err := sponsors.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "Sponsors", "", found, slugify(sp.Name))
+}
+
+// tagSlug picks the ID for a new tag
+func (s *site) tagSlug(r *http.Request, t Tag) (string, error) {
+	tags := s.backend.Tags(r)
+	found := func(id string) (bool, error) {
+		_, err := tags.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "Tags", "", found, slugify(t.Name))
+}
+
+// organizerSlug picks the ID for a new organizer
+func (s *site) organizerSlug(r *http.Request, o Organizer) (string, error) {
+	organizers := s.backend.Organizers(r)
+	found := func(id string) (bool, error) {
+		_, err := organizers.Get(id)
+		return exists(err)
+	}
+
+	return s.uniqueSlug(r, "Organizers", "", found, slugify(o.Name))
+}
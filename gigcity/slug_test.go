@@ -0,0 +1,116 @@
+package gigcity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, tt := range []struct {
+		title, want string
+	}{
+		{"Go Night", "go-night"},
+		{"  Go --- Night!  ", "go-night"},
+		{"Café Meetup", "cafe-meetup"},
+		{"Straße & Œuvre", "strasse-oeuvre"},
+		{"C++ 2015", "c-2015"},
+		{"日本語", "untitled"},
+		{"", "untitled"},
+		{strings.Repeat("word ", 20), strings.TrimSuffix(strings.Repeat("word-", 12), "-")},
+	} {
+		if got := slugify(tt.title); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	s := &site{backend: newMemoryBackend()}
+	used := map[string]bool{"go-night": true, "go-night-2015-03-04": true}
+	found := func(id string) (bool, error) {
+		return used[id], nil
+	}
+
+	for _, tt := range []struct {
+		self       string
+		candidates []string
+		want       string
+	}{
+		{"", []string{"meetup"}, "meetup"},
+		{"", []string{"go-night", "go-night-2015-03-04"}, "go-night-2"},
+		{"", []string{"go-night", "go-night-2015-05-06"}, "go-night-2015-05-06"},
+		{"go-night", []string{"go-night"}, "go-night"},
+		{"", []string{"archive"}, "archive-2"},
+	} {
+		got, err := s.uniqueSlug(nil, "Events", tt.self, found, tt.candidates...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("uniqueSlug(self %q, %v) = %q, want %q", tt.self, tt.candidates, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlugSkipsRedirects(t *testing.T) {
+	s := &site{backend: newMemoryBackend()}
+	found := func(string) (bool, error) { return false, nil }
+
+	// old-name now redirects to new-name, so only new-name may take it back
+	if err := s.renameSlug(nil, "Events", "old-name", "new-name"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.uniqueSlug(nil, "Events", "", found, "old-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "old-name-2" {
+		t.Errorf("new record got %q, want old-name-2", got)
+	}
+
+	got, err = s.uniqueSlug(nil, "Events", "new-name", found, "old-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "old-name" {
+		t.Errorf("renamed record got %q, want its old slug back", got)
+	}
+
+	// other kinds keep their own slugs
+	got, err = s.uniqueSlug(nil, "Locations", "", found, "old-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "old-name" {
+		t.Errorf("location got %q, want old-name", got)
+	}
+}
+
+func TestResolveRedirect(t *testing.T) {
+	s := &site{backend: newMemoryBackend()}
+
+	// renamed a to b to c, then back to a
+	for _, rename := range [][2]string{{"a", "b"}, {"b", "c"}} {
+		if err := s.renameSlug(nil, "Events", rename[0], rename[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, old := range []string{"a", "b"} {
+		if slug, err := s.resolveRedirect(nil, "Events", old); err != nil || slug != "c" {
+			t.Errorf("resolveRedirect(%s) = %q, %v, want c", old, slug, err)
+		}
+	}
+
+	if err := s.renameSlug(nil, "Events", "c", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, old := range []string{"b", "c"} {
+		if slug, err := s.resolveRedirect(nil, "Events", old); err != nil || slug != "a" {
+			t.Errorf("after renaming back, resolveRedirect(%s) = %q, %v, want a", old, slug, err)
+		}
+	}
+	if _, err := s.resolveRedirect(nil, "Events", "a"); err != ErrNotFound {
+		t.Errorf("the current slug redirects: %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Speaker is someone who has given or will give a talk at a chapter event
+type Speaker struct {
+	// ID is the unique ID (URI) for the speaker, it is kept when they are
+	// renamed since events refer to them by it
+	ID string
+	// Name is the speaker's full name
+	Name string
+	// Bio is a short introduction shown on their profile
+	Bio string `datastore:",noindex"`
+	// Photo is the URL of a head shot
+	Photo string
+	// Website, Twitter, GitHub and LinkedIn are links to the speaker's
+	// profiles elsewhere, each is optional
+	Website  string
+	Twitter  string
+	GitHub   string
+	LinkedIn string
+	// Created is when the speaker was first saved
+	Created time.Time
+	// Updated is when the speaker was last changed
+	Updated time.Time
+}
+
+// speakersByName sorts speakers alphabetically
+type speakersByName []Speaker
+
+func (s speakersByName) Len() int      { return len(s) }
+func (s speakersByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s speakersByName) Less(i, j int) bool {
+	return strings.ToLower(s[i].Name) < strings.ToLower(s[j].Name)
+}
+
+// HasSpeaker reports whether the speaker with the given ID is giving a talk
+// at the event
+func (e Event) HasSpeaker(id string) bool {
+	for _, s := range e.SpeakerIDs {
+		if s == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validLink reports whether v is an absolute http or https URL, the only
+// kind of link a speaker's profile may carry
+func validLink(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// speakerFromValues builds a Speaker out of the named fields returned by
+// value, which are named after the add/edit form's inputs
+func speakerFromValues(value func(string) string) (Speaker, string) {
+	var sp Speaker
+	msg := tooLong(value, "speaker", lineField("name"), lineField("photo"), lineField("website"),
+		lineField("twitter"), lineField("github"), lineField("linkedin"), textField("bio"))
+	if msg != "" {
+		return sp, msg
+	}
+
+	sp.Name = strings.TrimSpace(value("name"))
+	if sp.Name == "" {
+		return sp, "speaker name is required"
+	}
+
+	sp.Bio = value("bio")
+	for _, link := range []struct {
+		field, label string
+		dst          *string
+	}{
+		{"photo", "photo", &sp.Photo},
+		{"website", "website", &sp.Website},
+		{"twitter", "Twitter", &sp.Twitter},
+		{"github", "GitHub", &sp.GitHub},
+		{"linkedin", "LinkedIn", &sp.LinkedIn},
+	} {
+		*link.dst = strings.TrimSpace(value(link.field))
+		if *link.dst != "" && !validLink(*link.dst) {
+			return sp, "speaker " + link.label + " must be an http or https link"
+		}
+	}
+
+	return sp, ""
+}
+
+// speakerIDs reads a comma separated list of speaker IDs, dropping repeats.
+// If one doesn't name a speaker the returned message says which
+func (s *site) speakerIDs(r *http.Request, v string) ([]string, string) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(v, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+
+		if _, err := s.backend.Speakers(r).Get(id); err != nil {
+			return ids, "unknown speaker " + id
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids, ""
+}
+
+// eventSpeakers fetches the speakers of e, in the order they were listed.
+// Speakers that have since been deleted are skipped
+func (s *site) eventSpeakers(r *http.Request, e Event) ([]Speaker, error) {
+	store := s.backend.Speakers(r)
+	var speakers []Speaker
+	for _, id := range e.SpeakerIDs {
+		sp, err := store.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		speakers = append(speakers, sp)
+	}
+
+	return speakers, nil
+}
+
+// talk is a speaker's slot at an event, either the event as a whole or one
+// of the sessions on its agenda
+type talk struct {
+	Event Event
+	// Session is zero if the speaker is listed on the event itself
+	Session Session
+}
+
+func (t talk) start() time.Time {
+	if !t.Session.Start.IsZero() {
+		return t.Session.Start
+	}
+
+	return t.Event.Datetime
+}
+
+// When formats when the talk starts in the event's time zone
+func (t talk) When() string {
+	return formatLocal(t.start(), t.Event.TimeZone)
+}
+
+// talksByStart sorts talks newest first
+type talksByStart []talk
+
+func (t talksByStart) Len() int           { return len(t) }
+func (t talksByStart) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t talksByStart) Less(i, j int) bool { return t[i].start().After(t[j].start()) }
+
+// speakerTalks finds every event and session the speaker with the given ID
+// is listed on.  An event is only listed once, by its sessions, if the
+// speaker presents some of them
+func (s *site) speakerTalks(r *http.Request, speakerID string) ([]talk, error) {
+	byEvent, err := s.backend.Sessions(r).BySpeaker(speakerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var talks []talk
+	events := s.backend.Events(r)
+	for eventID, sessions := range byEvent {
+		e, err := events.Get(eventID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ss := range sessions {
+			talks = append(talks, talk{e, ss})
+		}
+	}
+
+	listed, err := events.BySpeaker(speakerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range listed {
+		if _, ok := byEvent[e.ID]; !ok {
+			talks = append(talks, talk{Event: e})
+		}
+	}
+
+	sort.Sort(talksByStart(talks))
+	return talks, nil
+}
+
+// Handles requests for /speakers/:speaker, the speaker's public profile with
+// every talk they have given for the chapter
+func (s *site) speakerHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Speaker  Speaker
+		Upcoming []talk
+		Past     []talk
+	}
+
+	sp, err := s.backend.Speakers(r).Get(r.URL.Query().Get(":speaker"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	talks, err := s.speakerTalks(r, sp.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context := Content{Speaker: sp}
+	now := time.Now()
+	for _, t := range talks {
+		if t.start().After(now) {
+			// soonest first
+			context.Upcoming = append([]talk{t}, context.Upcoming...)
+		} else {
+			context.Past = append(context.Past, t)
+		}
+	}
+
+	s.render(w, r, "speaker", context)
+}
+
+// Handles requests for /admin/speakers
+func (s *site) adminSpeakersHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	speakers, err := s.backend.Speakers(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(speakersByName(speakers))
+
+	s.render(w, r, "admin/speakers", speakers)
+}
+
+// renderSpeakerForm shows the add/edit speaker form pre-filled with sp.  A
+// blank sp gives an empty form for a new speaker
+func (s *site) renderSpeakerForm(w http.ResponseWriter, r *http.Request, sp Speaker) {
+	s.render(w, r, "admin/add-speaker", sp)
+}
+
+// Handles requests to /admin/speakers/add
+func (s *site) addSpeakerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderSpeakerForm(w, r, Speaker{})
+		return
+	}
+
+	sp, msg := speakerFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	sp.Created = time.Now().UTC()
+	sp.Updated = sp.Created
+	_, err := claimSlug(func() (string, error) {
+		return s.speakerSlug(r, sp)
+	}, func(slug string) error {
+		sp.ID = slug
+		return s.backend.Speakers(r).Add(sp)
+	})
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/speakers", http.StatusFound)
+}
+
+// Handles requests to /admin/speakers/:speaker/edit.  GET shows the speaker
+// form pre-filled with the stored speaker, POST writes the changes back
+func (s *site) editSpeakerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	speakerID := r.URL.Query().Get(":speaker")
+	store := s.backend.Speakers(r)
+	old, err := store.Get(speakerID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderSpeakerForm(w, r, old)
+		return
+	}
+
+	sp, msg := speakerFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	sp.ID = old.ID
+	sp.Created = old.Created
+	sp.Updated = time.Now().UTC()
+	if err := store.Update(speakerID, sp); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/speakers/"+sp.ID, http.StatusFound)
+}
+
+// without returns ids less id
+func without(ids []string, id string) []string {
+	var kept []string
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+
+	return kept
+}
+
+// Handles requests to /admin/speakers/:speaker/delete.  The speaker is taken
+// off every event and session they were listed on first, so nothing points
+// at them
+func (s *site) deleteSpeakerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	speakerID := r.URL.Query().Get(":speaker")
+	store := s.backend.Speakers(r)
+	if _, err := store.Get(speakerID); err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events := s.backend.Events(r)
+	talks, err := events.BySpeaker(speakerID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, e := range talks {
+		e.SpeakerIDs = without(e.SpeakerIDs, speakerID)
+		e.Updated = time.Now().UTC()
+		if err := events.Update(e.ID, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("removing speaker from %s failed: %v", e.ID, err))
+			return
+		}
+	}
+
+	sessions := s.backend.Sessions(r)
+	byEvent, err := sessions.BySpeaker(speakerID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for eventID, list := range byEvent {
+		for _, ss := range list {
+			ss.SpeakerIDs = without(ss.SpeakerIDs, speakerID)
+			ss.Updated = time.Now().UTC()
+			if err := sessions.Update(eventID, ss); err != nil {
+				s.errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("removing speaker from %s failed: %v", ss.ID, err))
+				return
+			}
+		}
+	}
+
+	if err := store.Delete(speakerID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/speakers", http.StatusFound)
+}
@@ -0,0 +1,67 @@
+package gigcity
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpeakerFromValues(t *testing.T) {
+	for _, tt := range []struct {
+		form url.Values
+		msg  string
+	}{
+		{url.Values{"name": {" Ada "}, "github": {"https://github.com/ada"}}, ""},
+		{url.Values{"name": {" "}}, "speaker name is required"},
+		{url.Values{"name": {"Ada"}, "twitter": {"javascript:alert(1)"}}, "speaker Twitter must be an http or https link"},
+		{url.Values{"name": {"Ada"}, "photo": {"/ada.png"}}, "speaker photo must be an http or https link"},
+	} {
+		sp, msg := speakerFromValues(tt.form.Get)
+		if msg != tt.msg {
+			t.Errorf("speakerFromValues(%v) = %q, want %q", tt.form, msg, tt.msg)
+		}
+		if msg == "" && sp.Name != "Ada" {
+			t.Errorf("speaker name %q wasn't trimmed", sp.Name)
+		}
+	}
+}
+
+func TestSpeakers(t *testing.T) {
+	ts := newTestServer(t)
+	resp := ts.submit(t, "/admin/speakers/add", "/admin/speakers/add", url.Values{"name": {"Ada Lovelace"}, "bio": {"Wrote the first program"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("adding a speaker = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	events := ts.Backend.Events(nil)
+	for _, e := range []Event{
+		{ID: "past", Title: "Past Talk", Datetime: at("2015-03-04T23:30"), SpeakerIDs: []string{"ada-lovelace"}},
+		{ID: "upcoming", Title: "Upcoming Talk", Datetime: time.Now().Add(24 * time.Hour), SpeakerIDs: []string{"ada-lovelace"}},
+		{ID: "other", Title: "Other Talk", Datetime: at("2015-04-04T23:30")},
+	} {
+		if err := events.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := ts.request(t, "GET", "/speakers/ada-lovelace", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /speakers/ada-lovelace = %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "Past Talk") || !strings.Contains(body, "Upcoming Talk") || strings.Contains(body, "Other Talk") {
+		t.Error("the profile doesn't list exactly the speaker's talks")
+	}
+
+	// deleting the speaker takes them off their events
+	if resp := ts.submit(t, "/admin/speakers", "/admin/speakers/ada-lovelace/delete", nil); resp.StatusCode != http.StatusFound {
+		t.Fatalf("deleting the speaker = %d", resp.StatusCode)
+	}
+	if e, _ := events.Get("past"); len(e.SpeakerIDs) != 0 {
+		t.Errorf("deleted speaker is still on %+v", e)
+	}
+	if resp, _ := ts.request(t, "GET", "/speakers/ada-lovelace", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted speaker's profile = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,449 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sponsor kinds.  Sponsors back particular events, partners are shown across
+// the whole site while they are active
+const (
+	kindSponsor = "sponsor"
+	kindPartner = "partner"
+)
+
+// sponsorTiers lists the tiers a sponsor can be at, most prominent first
+var sponsorTiers = []string{"Platinum", "Gold", "Silver", "Bronze", "Community"}
+
+// sponsorDateLayout is the format of the date inputs on the sponsor form
+const sponsorDateLayout = "2006-01-02"
+
+// Sponsor is an organization that sponsors chapter events or partners with
+// the chapter
+type Sponsor struct {
+	// ID is the unique ID for the sponsor, it is kept when they are renamed
+	// since events refer to them by it
+	ID string
+	// Name is the organization's name, used as the logo's alt text
+	Name string
+	// Kind is kindSponsor or kindPartner
+	Kind string
+	// Logo is the URL of the organization's logo, either absolute or a path
+	// on this site like /static/img/Chadev-logo.svg
+	Logo string
+	// URL is where the logo links to
+	URL string
+	// Tier is one of sponsorTiers
+	Tier string
+	// From and Until are the first and last days the sponsor is active, in
+	// the chapter's time zone.  Either may be zero for no limit
+	From  time.Time
+	Until time.Time
+	// Created is when the sponsor was first saved
+	Created time.Time
+	// Updated is when the sponsor was last changed
+	Updated time.Time
+}
+
+// Active reports whether the sponsor is current at t
+func (sp Sponsor) Active(t time.Time) bool {
+	if !sp.From.IsZero() && t.Before(sp.From) {
+		return false
+	}
+
+	// Until is the last day, so it runs to the start of the next one
+	return sp.Until.IsZero() || t.Before(sp.Until.AddDate(0, 0, 1))
+}
+
+// FormFrom and FormUntil format the active date range for the sponsor form
+func (sp Sponsor) FormFrom() string  { return sponsorDate(sp.From) }
+func (sp Sponsor) FormUntil() string { return sponsorDate(sp.Until) }
+
+func sponsorDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.In(zoneOrDefault(defaultTimeZone)).Format(sponsorDateLayout)
+}
+
+// tierRank orders tiers by prominence, unknown tiers go last
+func tierRank(tier string) int {
+	for i, t := range sponsorTiers {
+		if t == tier {
+			return i
+		}
+	}
+
+	return len(sponsorTiers)
+}
+
+// sponsorsByTier sorts sponsors most prominent tier first, then by name
+type sponsorsByTier []Sponsor
+
+func (s sponsorsByTier) Len() int      { return len(s) }
+func (s sponsorsByTier) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sponsorsByTier) Less(i, j int) bool {
+	if ri, rj := tierRank(s[i].Tier), tierRank(s[j].Tier); ri != rj {
+		return ri < rj
+	}
+
+	return strings.ToLower(s[i].Name) < strings.ToLower(s[j].Name)
+}
+
+// sponsorTier is a tier's sponsors, for rendering them in groups
+type sponsorTier struct {
+	Tier     string
+	Sponsors []Sponsor
+}
+
+// byTier groups sponsors, which must be sorted by sponsorsByTier
+func byTier(sponsors []Sponsor) []sponsorTier {
+	var tiers []sponsorTier
+	for _, sp := range sponsors {
+		if len(tiers) == 0 || tiers[len(tiers)-1].Tier != sp.Tier {
+			tiers = append(tiers, sponsorTier{Tier: sp.Tier})
+		}
+		last := &tiers[len(tiers)-1]
+		last.Sponsors = append(last.Sponsors, sp)
+	}
+
+	return tiers
+}
+
+// HasSponsor reports whether the sponsor with the given ID backs the event
+func (e Event) HasSponsor(id string) bool {
+	for _, s := range e.SponsorIDs {
+		if s == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validLogo reports whether v is an http or https URL or a path on this site
+func validLogo(v string) bool {
+	return validLink(v) || (strings.HasPrefix(v, "/") && !strings.HasPrefix(v, "//"))
+}
+
+// sponsorFromValues builds a Sponsor out of the named fields returned by
+// value, which are named after the add/edit form's inputs
+func sponsorFromValues(value func(string) string) (Sponsor, string) {
+	var sp Sponsor
+	if msg := tooLong(value, "sponsor", lineField("name"), lineField("logo"), lineField("url")); msg != "" {
+		return sp, msg
+	}
+
+	sp.Name = strings.TrimSpace(value("name"))
+	if sp.Name == "" {
+		return sp, "sponsor name is required"
+	}
+
+	sp.Kind = value("kind")
+	if sp.Kind != kindSponsor && sp.Kind != kindPartner {
+		return sp, "sponsor kind must be sponsor or partner"
+	}
+
+	sp.Logo = strings.TrimSpace(value("logo"))
+	if !validLogo(sp.Logo) {
+		return sp, "sponsor logo must be an http or https link or a path on this site"
+	}
+
+	sp.URL = strings.TrimSpace(value("url"))
+	if sp.URL != "" && !validLink(sp.URL) {
+		return sp, "sponsor link must be an http or https link"
+	}
+
+	sp.Tier = value("tier")
+	if tierRank(sp.Tier) == len(sponsorTiers) {
+		return sp, "unknown sponsor tier " + sp.Tier
+	}
+
+	zone := zoneOrDefault(defaultTimeZone)
+	for _, d := range []struct {
+		field string
+		dst   *time.Time
+	}{
+		{"from", &sp.From},
+		{"until", &sp.Until},
+	} {
+		v := value(d.field)
+		if v == "" {
+			continue
+		}
+
+		t, err := time.ParseInLocation(sponsorDateLayout, v, zone)
+		if err != nil {
+			return sp, "sponsor " + d.field + " date must be in YYYY-MM-DD format"
+		}
+		*d.dst = t.UTC()
+	}
+
+	if !sp.From.IsZero() && !sp.Until.IsZero() && sp.Until.Before(sp.From) {
+		return sp, "sponsor must be active until after it starts"
+	}
+
+	return sp, ""
+}
+
+// sponsorIDs reads a comma separated list of sponsor IDs, dropping repeats.
+// If one doesn't name a sponsor the returned message says which
+func (s *site) sponsorIDs(r *http.Request, v string) ([]string, string) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(v, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+
+		if _, err := s.backend.Sponsors(r).Get(id); err != nil {
+			return ids, "unknown sponsor " + id
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids, ""
+}
+
+// eventSponsors fetches the sponsors of e grouped by tier.  Sponsors that
+// have since been deleted are skipped
+func (s *site) eventSponsors(r *http.Request, e Event) ([]sponsorTier, error) {
+	store := s.backend.Sponsors(r)
+	var sponsors []Sponsor
+	for _, id := range e.SponsorIDs {
+		sp, err := store.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sponsors = append(sponsors, sp)
+	}
+
+	sort.Sort(sponsorsByTier(sponsors))
+	return byTier(sponsors), nil
+}
+
+// activePartners returns the partners to show across the site right now,
+// grouped by tier.  Until any sponsor has been added these are the built in
+// partners, so the site doesn't lose the ones it listed by hand
+func (s *site) activePartners(r *http.Request) ([]sponsorTier, error) {
+	all, err := s.backend.Sponsors(r).List(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 {
+		all = builtinPartners
+	}
+
+	var partners []Sponsor
+	now := time.Now()
+	for _, sp := range all {
+		if sp.Kind == kindPartner && sp.Active(now) {
+			partners = append(partners, sp)
+		}
+	}
+
+	sort.Sort(sponsorsByTier(partners))
+	return byTier(partners), nil
+}
+
+// Handles requests for /admin/sponsors
+func (s *site) adminSponsorsHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Sponsors []Sponsor
+		Now      time.Time
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	sponsors, err := s.backend.Sponsors(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(sponsorsByTier(sponsors))
+
+	s.render(w, r, "admin/sponsors", Content{sponsors, time.Now()})
+}
+
+// renderSponsorForm shows the add/edit sponsor form pre-filled with sp.  A
+// blank sp gives an empty form for a new sponsor
+func (s *site) renderSponsorForm(w http.ResponseWriter, r *http.Request, sp Sponsor) {
+	type Content struct {
+		Sponsor
+		Tiers []string
+	}
+
+	s.render(w, r, "admin/add-sponsor", Content{sp, sponsorTiers})
+}
+
+// createSponsor gives a validated new sponsor its ID and timestamps, then
+// stores it
+func (s *site) createSponsor(r *http.Request, sp Sponsor) error {
+	sp.Created = time.Now().UTC()
+	sp.Updated = sp.Created
+	_, err := claimSlug(func() (string, error) {
+		return s.sponsorSlug(r, sp)
+	}, func(slug string) error {
+		sp.ID = slug
+		return s.backend.Sponsors(r).Add(sp)
+	})
+	return err
+}
+
+// Handles requests to /admin/sponsors/add
+func (s *site) addSponsorHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderSponsorForm(w, r, Sponsor{Kind: kindSponsor, Tier: "Community"})
+		return
+	}
+
+	sp, msg := sponsorFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := s.createSponsor(r, sp); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/sponsors", http.StatusFound)
+}
+
+// Handles requests to /admin/sponsors/:sponsor/edit.  GET shows the sponsor
+// form pre-filled with the stored sponsor, POST writes the changes back
+func (s *site) editSponsorHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	sponsorID := r.URL.Query().Get(":sponsor")
+	store := s.backend.Sponsors(r)
+	old, err := store.Get(sponsorID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderSponsorForm(w, r, old)
+		return
+	}
+
+	sp, msg := sponsorFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	sp.ID = old.ID
+	sp.Created = old.Created
+	sp.Updated = time.Now().UTC()
+	if err := store.Update(sponsorID, sp); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/sponsors", http.StatusFound)
+}
+
+// Handles requests to /admin/sponsors/:sponsor/delete.  The sponsor is taken
+// off every event they backed first, so no event points at them
+func (s *site) deleteSponsorHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	sponsorID := r.URL.Query().Get(":sponsor")
+	store := s.backend.Sponsors(r)
+	if _, err := store.Get(sponsorID); err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events := s.backend.Events(r)
+	backed, err := events.BySponsor(sponsorID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, e := range backed {
+		e.SponsorIDs = without(e.SponsorIDs, sponsorID)
+		e.Updated = time.Now().UTC()
+		if err := events.Update(e.ID, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("removing sponsor from %s failed: %v", e.ID, err))
+			return
+		}
+	}
+
+	if err := store.Delete(sponsorID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/sponsors", http.StatusFound)
+}
+
+// builtinPartners are the partners the about page used to list by hand
+var builtinPartners = []Sponsor{
+	{Name: "Code Journeymen", Kind: kindPartner, Logo: "/static/img/codeJourneymen-logo-patch_3.png", URL: "http://www.codejourneymen.com/", Tier: "Community"},
+	{Name: "Chadev", Kind: kindPartner, Logo: "/static/img/Chadev-logo.svg", URL: "http://chadev.github.io/", Tier: "Community"},
+}
+
+// Handles POST requests to /admin/sponsors/builtin, which adds the partners
+// whose logos ship with the site.  Ones already added are skipped, so it is
+// safe to run more than once
+func (s *site) builtinSponsorsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	existing, err := s.backend.Sponsors(r).List(0)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	have := make(map[string]bool)
+	for _, sp := range existing {
+		have[strings.ToLower(sp.Name)] = true
+	}
+
+	for _, sp := range builtinPartners {
+		if have[strings.ToLower(sp.Name)] {
+			continue
+		}
+
+		if err := s.createSponsor(r, sp); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/admin/sponsors", http.StatusFound)
+}
@@ -0,0 +1,132 @@
+package gigcity
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSponsorActive(t *testing.T) {
+	sp := Sponsor{From: at("2015-03-01T05:00"), Until: at("2015-03-31T04:00")}
+	for _, tt := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{at("2015-03-01T04:59"), false},
+		{at("2015-03-01T05:00"), true},
+		// Until is the whole of the last day
+		{at("2015-03-31T23:59"), true},
+		{at("2015-04-01T04:00"), false},
+	} {
+		if got := sp.Active(tt.t); got != tt.want {
+			t.Errorf("Active(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	if !(Sponsor{}).Active(time.Now()) {
+		t.Error("a sponsor without dates isn't active")
+	}
+}
+
+func TestSponsorFromValues(t *testing.T) {
+	form := url.Values{
+		"name":  {"Gophers Inc"},
+		"kind":  {kindSponsor},
+		"logo":  {"/static/img/gophers.png"},
+		"url":   {"https://gophers.example.com/"},
+		"tier":  {"Gold"},
+		"from":  {"2015-03-01"},
+		"until": {"2015-03-31"},
+	}
+	sp, msg := sponsorFromValues(form.Get)
+	if msg != "" {
+		t.Fatal(msg)
+	}
+	if sp.FormFrom() != "2015-03-01" || sp.FormUntil() != "2015-03-31" {
+		t.Errorf("sponsor dates %s to %s", sp.FormFrom(), sp.FormUntil())
+	}
+
+	for field, bad := range map[string]string{
+		"name":  " ",
+		"kind":  "friend",
+		"logo":  "//evil.example.com/logo.png",
+		"url":   "javascript:alert(1)",
+		"tier":  "Diamond",
+		"from":  "March",
+		"until": "2015-02-01",
+	} {
+		v := url.Values{}
+		for k := range form {
+			v.Set(k, form.Get(k))
+		}
+		v.Set(field, bad)
+		if _, msg := sponsorFromValues(v.Get); msg == "" {
+			t.Errorf("%s %q was accepted", field, bad)
+		}
+	}
+}
+
+func TestByTier(t *testing.T) {
+	sponsors := []Sponsor{
+		{Name: "b", Tier: "Silver"},
+		{Name: "Community", Tier: "Community"},
+		{Name: "a", Tier: "Silver"},
+		{Name: "Top", Tier: "Platinum"},
+	}
+	sort.Sort(sponsorsByTier(sponsors))
+
+	var got []string
+	for _, tier := range byTier(sponsors) {
+		var names []string
+		for _, sp := range tier.Sponsors {
+			names = append(names, sp.Name)
+		}
+		got = append(got, tier.Tier+":"+strings.Join(names, ","))
+	}
+	if want := "Platinum:Top Silver:a,b Community:Community"; strings.Join(got, " ") != want {
+		t.Errorf("byTier = %v, want %s", got, want)
+	}
+}
+
+func TestPartners(t *testing.T) {
+	ts := newTestServer(t)
+
+	// the built in partners are listed until the admin area is used
+	if _, body := ts.request(t, "GET", "/about", nil, false); !strings.Contains(body, "Chadev") {
+		t.Error("/about doesn't list the built in partners before any are added")
+	}
+
+	// adding the built in partners twice only adds them once
+	for i := 0; i < 2; i++ {
+		if resp := ts.submit(t, "/admin/sponsors", "/admin/sponsors/builtin", nil); resp.StatusCode != http.StatusFound {
+			t.Fatalf("adding the built in partners = %d", resp.StatusCode)
+		}
+	}
+	if all, _ := ts.Backend.Sponsors(nil).List(0); len(all) != len(builtinPartners) {
+		t.Errorf("%d sponsors after adding the built in partners twice, want %d", len(all), len(builtinPartners))
+	}
+
+	for _, sp := range []Sponsor{
+		{ID: "current", Name: "Current Partner", Kind: kindPartner, Logo: "/current.png", Tier: "Gold"},
+		{ID: "expired", Name: "Expired Partner", Kind: kindPartner, Logo: "/expired.png", Tier: "Gold", Until: at("2015-01-01T05:00")},
+		{ID: "sponsor", Name: "Event Sponsor", Kind: kindSponsor, Logo: "/sponsor.png", Tier: "Gold"},
+	} {
+		if err := ts.Backend.Sponsors(nil).Add(sp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"/", "/about"} {
+		resp, body := ts.request(t, "GET", path, nil, false)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, resp.StatusCode)
+		}
+		if !strings.Contains(body, "Current Partner") || !strings.Contains(body, "Chadev") ||
+			strings.Contains(body, "Expired Partner") || strings.Contains(body, "Event Sponsor") {
+			t.Errorf("%s doesn't list just the current partners", path)
+		}
+	}
+}
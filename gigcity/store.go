@@ -0,0 +1,328 @@
+package gigcity
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrNotFound is returned by a repository when no record matches the
+// requested ID
+var ErrNotFound = errors.New("gigcity: record not found")
+
+// ErrExists is returned by a repository's Add, or by an Update that renames a
+// record, when another record already has the ID
+var ErrExists = errors.New("gigcity: ID already taken")
+
+// ErrDuplicateID is returned by a repository's Get when more than one record
+// has the ID, which records saved before IDs were claimed in a transaction
+// can.  Running the slug migration gives them IDs of their own
+var ErrDuplicateID = errors.New("gigcity: more than one record has this ID, run the migration at /admin/migrate/slugs")
+
+// ErrBadCursor is returned by a repository's Range when the cursor wasn't one
+// it handed out
+var ErrBadCursor = errors.New("gigcity: malformed cursor")
+
+// RangeQuery asks for one page of dated records, like events
+type RangeQuery struct {
+	// From (inclusive) and To (exclusive) bound the records' Datetime,
+	// either may be zero for no bound
+	From, To time.Time
+	// Desc lists the newest records first, otherwise the oldest come first
+	Desc bool
+	// Tag, if set, only selects records filed under the tag with that ID
+	Tag string
+	// Limit is how many records make a page, it must be at least one
+	Limit int
+	// Cursor continues from the end of an earlier page, "" starts from the
+	// first
+	Cursor string
+}
+
+// contains reports whether t is within the query's bounds
+func (q RangeQuery) contains(t time.Time) bool {
+	return (q.From.IsZero() || !t.Before(q.From)) && (q.To.IsZero() || t.Before(q.To))
+}
+
+// tagged reports whether a record filed under tagIDs is one the query's Tag
+// selects
+func (q RangeQuery) tagged(tagIDs []string) bool {
+	return q.Tag == "" || hasID(tagIDs, q.Tag)
+}
+
+// EventStore is the repository for Event records
+type EventStore interface {
+	// List returns up to limit events, newest first.  A limit of zero or less
+	// returns every event
+	List(limit int) ([]Event, error)
+	// Range returns a page of the events q selects, and the cursor of the
+	// next page or "" if this is the last
+	Range(q RangeQuery) ([]Event, string, error)
+	// Get returns the event with the given ID, or ErrNotFound
+	Get(id string) (Event, error)
+	// Add stores a new event, or returns ErrExists if e.ID is taken
+	Add(e Event) error
+	// Update overwrites the event with the given ID, or returns ErrNotFound.
+	// If e.ID differs the event moves to it, unless it is taken (ErrExists)
+	Update(id string, e Event) error
+	// Delete removes the event with the given ID, or returns ErrNotFound
+	Delete(id string) error
+	// ByLocation returns every event held at the location with the given ID
+	ByLocation(locID string) ([]Event, error)
+	// BySpeaker returns every event the speaker with the given ID talks at
+	BySpeaker(speakerID string) ([]Event, error)
+	// BySponsor returns every event the sponsor with the given ID backs
+	BySponsor(sponsorID string) ([]Event, error)
+	// ByTag returns every event filed under the tag with the given ID
+	ByTag(tagID string) ([]Event, error)
+}
+
+// LearnEventStore is the repository for LearnEvent records
+type LearnEventStore interface {
+	// List returns up to limit study groups.  A limit of zero or less returns
+	// every study group
+	List(limit int) ([]LearnEvent, error)
+	// Range returns a page of the meetings q selects, repeating study groups
+	// expanded into theirs and cancelled meetings left out, and the cursor of
+	// the next page or "" if this is the last
+	Range(q RangeQuery) ([]Occurrence, string, error)
+	// Get returns the study group with the given ID, or ErrNotFound
+	Get(id string) (LearnEvent, error)
+	// Add stores a new study group, or returns ErrExists if l.ID is taken
+	Add(l LearnEvent) error
+	// Update overwrites the study group with the given ID, or returns
+	// ErrNotFound.  If l.ID differs the study group moves to it, unless it is
+	// taken (ErrExists)
+	Update(id string, l LearnEvent) error
+	// Delete removes the study group with the given ID, or returns ErrNotFound
+	Delete(id string) error
+	// ByLocation returns every study group meeting at the location with the
+	// given ID
+	ByLocation(locID string) ([]LearnEvent, error)
+	// ByTag returns every study group filed under the tag with the given ID
+	ByTag(tagID string) ([]LearnEvent, error)
+}
+
+// LocationStore is the repository for Location records
+type LocationStore interface {
+	// List returns up to limit locations.  A limit of zero or less returns
+	// every location
+	List(limit int) ([]Location, error)
+	// Get returns the location with the given ID, or ErrNotFound
+	Get(id string) (Location, error)
+	// Add stores a new location, or returns ErrExists if l.ID is taken
+	Add(l Location) error
+	// Update overwrites the location with the given ID, or returns ErrNotFound
+	Update(id string, l Location) error
+	// Delete removes the location with the given ID, or returns ErrNotFound.
+	// Callers are responsible for checking nothing still references it
+	Delete(id string) error
+}
+
+// SpeakerStore is the repository for Speaker records
+type SpeakerStore interface {
+	// List returns up to limit speakers.  A limit of zero or less returns
+	// every speaker
+	List(limit int) ([]Speaker, error)
+	// Get returns the speaker with the given ID, or ErrNotFound
+	Get(id string) (Speaker, error)
+	// Add stores a new speaker, or returns ErrExists if sp.ID is taken
+	Add(sp Speaker) error
+	// Update overwrites the speaker with the given ID, or returns ErrNotFound
+	Update(id string, sp Speaker) error
+	// Delete removes the speaker with the given ID, or returns ErrNotFound.
+	// Callers are responsible for taking them off their events
+	Delete(id string) error
+}
+
+// SponsorStore is the repository for Sponsor records, sponsors and partners
+// alike
+type SponsorStore interface {
+	// List returns up to limit sponsors.  A limit of zero or less returns
+	// every sponsor
+	List(limit int) ([]Sponsor, error)
+	// Get returns the sponsor with the given ID, or ErrNotFound
+	Get(id string) (Sponsor, error)
+	// Add stores a new sponsor, or returns ErrExists if sp.ID is taken
+	Add(sp Sponsor) error
+	// Update overwrites the sponsor with the given ID, or returns ErrNotFound
+	Update(id string, sp Sponsor) error
+	// Delete removes the sponsor with the given ID, or returns ErrNotFound.
+	// Callers are responsible for taking them off their events
+	Delete(id string) error
+}
+
+// TagStore is the repository for Tag records
+type TagStore interface {
+	// List returns up to limit tags.  A limit of zero or less returns every
+	// tag
+	List(limit int) ([]Tag, error)
+	// Get returns the tag with the given ID, or ErrNotFound
+	Get(id string) (Tag, error)
+	// Add stores a new tag, or returns ErrExists if t.ID is taken
+	Add(t Tag) error
+	// Update overwrites the tag with the given ID, or returns ErrNotFound
+	Update(id string, t Tag) error
+	// Delete removes the tag with the given ID, or returns ErrNotFound.
+	// Callers are responsible for taking it off their events and study
+	// groups
+	Delete(id string) error
+}
+
+// OrganizerStore is the repository for Organizer records
+type OrganizerStore interface {
+	// List returns up to limit organizers.  A limit of zero or less returns
+	// every organizer
+	List(limit int) ([]Organizer, error)
+	// Get returns the organizer with the given ID, or ErrNotFound
+	Get(id string) (Organizer, error)
+	// Add stores a new organizer, or returns ErrExists if o.ID is taken
+	Add(o Organizer) error
+	// Update overwrites the organizer with the given ID, or returns
+	// ErrNotFound
+	Update(id string, o Organizer) error
+	// Delete removes the organizer with the given ID, or returns ErrNotFound
+	Delete(id string) error
+}
+
+// RedirectStore remembers the old slugs of renamed records, keyed by entity
+// kind, so links to them keep working
+type RedirectStore interface {
+	// Lookup returns the slug old was renamed to, or ErrNotFound
+	Lookup(kind, old string) (string, error)
+	// Add records that old was renamed to slug
+	Add(kind, old, slug string) error
+	// Remove forgets any redirect from old, it is not an error if there was
+	// none
+	Remove(kind, old string) error
+	// Renamed returns every old slug recorded as renamed straight to slug
+	Renamed(kind, slug string) ([]string, error)
+}
+
+// TokenStore is the repository for APIToken records
+type TokenStore interface {
+	// List returns every token
+	List() ([]APIToken, error)
+	// Get returns the token with the given ID, or ErrNotFound
+	Get(id string) (APIToken, error)
+	// Add stores a new token
+	Add(t APIToken) error
+	// Delete removes the token with the given ID, or returns ErrNotFound
+	Delete(id string) error
+}
+
+// RSVPStore is the repository for RSVP records.  RSVPs belong to an event,
+// they follow it when it is renamed and go with it when it is deleted
+type RSVPStore interface {
+	// List returns every RSVP for the event with the given ID, oldest first
+	List(eventID string) ([]RSVP, error)
+	// Get returns the RSVP with the given ID, or ErrNotFound
+	Get(eventID, id string) (RSVP, error)
+	// Add stores a new RSVP for the event with the given ID
+	Add(eventID string, v RSVP) error
+	// Update overwrites the RSVP with v.ID, or returns ErrNotFound
+	Update(eventID string, v RSVP) error
+	// Atomically runs fn with a store whose reads and writes of the event's
+	// RSVPs don't interleave with any other Atomically call, so seats can be
+	// counted and handed out safely.  fn may be run more than once and must
+	// not call Atomically itself
+	Atomically(eventID string, fn func(RSVPStore) error) error
+}
+
+// SessionStore is the repository for the Session records making up events'
+// agendas.  Like RSVPs, sessions follow their event when it is renamed and go
+// with it when it is deleted
+type SessionStore interface {
+	// List returns every session of the event with the given ID
+	List(eventID string) ([]Session, error)
+	// Get returns the session with the given ID, or ErrNotFound
+	Get(eventID, id string) (Session, error)
+	// Add stores a new session for the event with the given ID
+	Add(eventID string, ss Session) error
+	// Update overwrites the session with ss.ID, or returns ErrNotFound
+	Update(eventID string, ss Session) error
+	// Delete removes the session with the given ID, or returns ErrNotFound
+	Delete(eventID, id string) error
+	// BySpeaker returns every session the speaker with the given ID presents,
+	// keyed by the ID of the session's event
+	BySpeaker(speakerID string) (map[string][]Session, error)
+}
+
+// ReportStore is the repository for code of conduct Report records.  Reports
+// can't be deleted, their audit trail has to be kept
+type ReportStore interface {
+	// List returns every report
+	List() ([]Report, error)
+	// Get returns the report with the given ID, or ErrNotFound
+	Get(id string) (Report, error)
+	// Add stores a new report
+	Add(rep Report) error
+	// Modify runs fn on the report with the given ID and saves the result,
+	// with no other Modify of it in between, or returns ErrNotFound.  fn may be
+	// run more than once
+	Modify(id string, fn func(*Report) error) error
+}
+
+// AuditStore is the audit trail of who was given or lost access to code of
+// conduct reports.  Entries can't be changed or deleted
+type AuditStore interface {
+	// List returns every entry, oldest first
+	List() ([]AuditEntry, error)
+	// Add appends e to the trail
+	Add(e AuditEntry) error
+}
+
+// SearchIndex is the full-text index of events, study groups and locations
+type SearchIndex interface {
+	// Put indexes doc, replacing any earlier copy of the same record
+	Put(doc SearchDoc) error
+	// Delete drops a record from the index, it is not an error if it wasn't
+	// indexed
+	Delete(kind, id string) error
+	// Search returns up to limit documents containing every one of terms,
+	// best match first.  terms are lower case words, see searchTerms
+	Search(terms []string, limit int) ([]SearchDoc, error)
+}
+
+// SecretStore holds the site's secret keys
+type SecretStore interface {
+	// Key returns the named secret key.  The first time a name is asked for a
+	// random 32 byte key is generated and saved
+	Key(name string) ([]byte, error)
+}
+
+// Backend hands out the repositories used while serving a single request.
+// Backends that need request scoped state (like App Engine's context) build
+// it from r
+type Backend interface {
+	Events(r *http.Request) EventStore
+	LearnEvents(r *http.Request) LearnEventStore
+	Locations(r *http.Request) LocationStore
+	Speakers(r *http.Request) SpeakerStore
+	Sponsors(r *http.Request) SponsorStore
+	Tags(r *http.Request) TagStore
+	Organizers(r *http.Request) OrganizerStore
+	Redirects(r *http.Request) RedirectStore
+	Tokens(r *http.Request) TokenStore
+	RSVPs(r *http.Request) RSVPStore
+	Sessions(r *http.Request) SessionStore
+	Reports(r *http.Request) ReportStore
+	Audit(r *http.Request) AuditStore
+	Search(r *http.Request) SearchIndex
+	Secrets(r *http.Request) SecretStore
+}
+
+// site holds the dependencies shared by the HTTP handlers
+type site struct {
+	backend Backend
+	auth    Authenticator
+	mail    Mailer
+	// templates are the parsed pages handlers render
+	templates *templateSet
+	// rsvpLimit throttles the public RSVP form
+	rsvpLimit *rateLimiter
+	// reportKey encrypts code of conduct reports.  It is kept out of the
+	// backend, so the stored reports can't be read with the data alone, and
+	// is nil when none is configured
+	reportKey []byte
+}
@@ -0,0 +1,408 @@
+package gigcity
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tag is a topic events and study groups are filed under, like Android, Go,
+// Cloud or Web
+type Tag struct {
+	// ID is the unique ID for the tag, it is kept when the tag is renamed
+	// since events and study groups refer to it by it
+	ID string
+	// Name is how the topic is shown, like "Cloud"
+	Name string
+	// Description says what the topic covers, in Markdown
+	Description string `datastore:",noindex"`
+	// Created is when the tag was first saved
+	Created time.Time
+	// Updated is when the tag was last changed
+	Updated time.Time
+}
+
+// tagsByName sorts tags alphabetically
+type tagsByName []Tag
+
+func (t tagsByName) Len() int      { return len(t) }
+func (t tagsByName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tagsByName) Less(i, j int) bool {
+	return strings.ToLower(t[i].Name) < strings.ToLower(t[j].Name)
+}
+
+// HasTag reports whether the event is filed under the tag with the given ID
+func (e Event) HasTag(id string) bool {
+	return hasID(e.TagIDs, id)
+}
+
+// HasTag reports whether the study group is filed under the tag with the
+// given ID
+func (l LearnEvent) HasTag(id string) bool {
+	return hasID(l.TagIDs, id)
+}
+
+// hasID reports whether ids contains id
+func hasID(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagFromValues builds a Tag out of the named fields returned by value, which
+// are named after the add/edit form's inputs
+func tagFromValues(value func(string) string) (Tag, string) {
+	var t Tag
+	if msg := tooLong(value, "topic", lineField("name"), textField("description")); msg != "" {
+		return t, msg
+	}
+
+	t.Name = strings.TrimSpace(value("name"))
+	if t.Name == "" {
+		return t, "topic name is required"
+	}
+
+	t.Description = value("description")
+	return t, ""
+}
+
+// tagIDs reads a comma separated list of tag IDs, dropping repeats.  If one
+// doesn't name a tag the returned message says which
+func (s *site) tagIDs(r *http.Request, v string) ([]string, string) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(v, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+
+		if _, err := s.backend.Tags(r).Get(id); err != nil {
+			return ids, "unknown topic " + id
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids, ""
+}
+
+// listTags returns every tag in alphabetical order
+func (s *site) listTags(r *http.Request) ([]Tag, error) {
+	tags, err := s.backend.Tags(r).List(0)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(tagsByName(tags))
+	return tags, nil
+}
+
+// recordTags fetches the tags with the given IDs, for showing on an event or
+// study group.  Tags that have since been deleted are skipped
+func (s *site) recordTags(r *http.Request, ids []string) ([]Tag, error) {
+	store := s.backend.Tags(r)
+	var tags []Tag
+	for _, id := range ids {
+		t, err := store.Get(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, t)
+	}
+
+	sort.Sort(tagsByName(tags))
+	return tags, nil
+}
+
+// listingTags reads the tag parameter the /events and /learning listings are
+// filtered by, and fetches every tag to offer as filters.  If it fails the
+// error has already been written to w
+func (s *site) listingTags(w http.ResponseWriter, r *http.Request) (Tag, []Tag, bool) {
+	var t Tag
+	if id := r.URL.Query().Get("tag"); id != "" {
+		var err error
+		t, err = s.backend.Tags(r).Get(id)
+		if err == ErrNotFound {
+			s.errorHandler(w, r, http.StatusNotFound, "")
+			return t, nil, false
+		}
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return t, nil, false
+		}
+	}
+
+	tags, err := s.listTags(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return t, nil, false
+	}
+
+	return t, tags, true
+}
+
+// Handles requests for /topics
+func (s *site) topicsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.listTags(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "topics", tags)
+}
+
+// topicRecords fetches the events and study groups filed under the tag with
+// the given ID, newest first
+func (s *site) topicRecords(r *http.Request, tagID string) ([]Event, []LearnEvent, error) {
+	events, err := s.backend.Events(r).ByTag(tagID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(byDatetime(events))
+
+	learn, err := s.backend.LearnEvents(r).ByTag(tagID)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(sort.Reverse(learnByDatetime(learn)))
+
+	return events, learn, nil
+}
+
+// Handles requests for /topics/:tag, listing the topic's upcoming and past
+// events and study groups
+func (s *site) topicHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Tag            Tag
+		UpcomingEvents []Event
+		PastEvents     []Event
+		UpcomingLearn  []LearnEvent
+		PastLearn      []LearnEvent
+	}
+
+	t, err := s.backend.Tags(r).Get(r.URL.Query().Get(":tag"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events, learn, err := s.topicRecords(r, t.ID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the records come newest first, upcoming ones are listed soonest first
+	context := Content{Tag: t}
+	today := startOfToday()
+	for _, e := range events {
+		if e.Datetime.Before(today) {
+			context.PastEvents = append(context.PastEvents, e)
+		} else {
+			context.UpcomingEvents = append([]Event{e}, context.UpcomingEvents...)
+		}
+	}
+	for _, l := range learn {
+		// a repeating study group is upcoming until its last meeting
+		if l.Last().Before(today) {
+			context.PastLearn = append(context.PastLearn, l)
+		} else {
+			context.UpcomingLearn = append([]LearnEvent{l}, context.UpcomingLearn...)
+		}
+	}
+
+	s.render(w, r, "topic", context)
+}
+
+// Handles requests to /topics/:tag/feed.atom and /topics/:tag/feed.rss, the
+// topic's events and study groups in one feed
+func (s *site) topicFeedHandler(write func(http.ResponseWriter, *http.Request, feed)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := s.backend.Tags(r).Get(r.URL.Query().Get(":tag"))
+		if err == ErrNotFound {
+			s.errorHandler(w, r, http.StatusNotFound, "")
+			return
+		}
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		events, learn, err := s.topicRecords(r, t.ID)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		addresses, err := s.locationAddresses(r)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		f := feed{Title: "GDG Gigcity " + t.Name, Path: "/topics/" + t.ID}
+		f.Items = append(eventItems(events, addresses), learnItems(learn, addresses)...)
+		write(w, r, f)
+	}
+}
+
+// Handles requests for /admin/tags
+func (s *site) adminTagsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	tags, err := s.listTags(r)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.render(w, r, "admin/tags", tags)
+}
+
+// renderTagForm shows the add/edit topic form pre-filled with t.  A blank t
+// gives an empty form for a new topic
+func (s *site) renderTagForm(w http.ResponseWriter, r *http.Request, t Tag) {
+	s.render(w, r, "admin/add-tag", t)
+}
+
+// Handles requests to /admin/tags/add
+func (s *site) addTagHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderTagForm(w, r, Tag{})
+		return
+	}
+
+	t, msg := tagFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	t.Created = time.Now().UTC()
+	t.Updated = t.Created
+	_, err := claimSlug(func() (string, error) {
+		return s.tagSlug(r, t)
+	}, func(slug string) error {
+		t.ID = slug
+		return s.backend.Tags(r).Add(t)
+	})
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/tags", http.StatusFound)
+}
+
+// Handles requests to /admin/tags/:tag/edit.  GET shows the topic form
+// pre-filled with the stored tag, POST writes the changes back
+func (s *site) editTagHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	tagID := r.URL.Query().Get(":tag")
+	store := s.backend.Tags(r)
+	old, err := store.Get(tagID)
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if r.Method != "POST" {
+		s.renderTagForm(w, r, old)
+		return
+	}
+
+	t, msg := tagFromValues(r.FormValue)
+	if msg != "" {
+		s.errorHandler(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	t.ID = old.ID
+	t.Created = old.Created
+	t.Updated = time.Now().UTC()
+	if err := store.Update(tagID, t); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/tags", http.StatusFound)
+}
+
+// Handles requests to /admin/tags/:tag/delete.  The tag is taken off every
+// event and study group filed under it first, so nothing points at it
+func (s *site) deleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	tagID := r.URL.Query().Get(":tag")
+	store := s.backend.Tags(r)
+	if _, err := store.Get(tagID); err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	events, learn, err := s.topicRecords(r, tagID)
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, e := range events {
+		e.TagIDs = without(e.TagIDs, tagID)
+		e.Updated = now
+		if err := s.backend.Events(r).Update(e.ID, e); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("removing topic from %s failed: %v", e.ID, err))
+			return
+		}
+	}
+
+	for _, l := range learn {
+		l.TagIDs = without(l.TagIDs, tagID)
+		l.Updated = now
+		if err := s.backend.LearnEvents(r).Update(l.ID, l); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, fmt.Sprintf("removing topic from %s failed: %v", l.ID, err))
+			return
+		}
+	}
+
+	if err := store.Delete(tagID); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/tags", http.StatusFound)
+}
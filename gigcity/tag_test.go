@@ -0,0 +1,58 @@
+package gigcity
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopics(t *testing.T) {
+	ts := newTestServer(t)
+	if resp := ts.submit(t, "/admin/tags/add", "/admin/tags/add", url.Values{"name": {"Cloud"}}); resp.StatusCode != http.StatusFound {
+		t.Fatalf("adding a topic = %d", resp.StatusCode)
+	}
+
+	soon := time.Now().AddDate(0, 0, 7)
+	for _, e := range []Event{
+		{ID: "cloud-night", Title: "Cloud Night", Datetime: soon, TagIDs: []string{"cloud"}},
+		{ID: "go-night", Title: "Go Night", Datetime: soon},
+	} {
+		if err := ts.Backend.Events(nil).Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path      string
+		status    int
+		has, lack string
+	}{
+		{"/topics", http.StatusOK, "/topics/cloud", ""},
+		{"/topics/cloud", http.StatusOK, "/events/cloud-night", "/events/go-night"},
+		{"/events?tag=cloud", http.StatusOK, "/events/cloud-night", "/events/go-night"},
+		{"/topics/nope", http.StatusNotFound, "", ""},
+		{"/events?tag=nope", http.StatusNotFound, "", ""},
+	} {
+		resp, body := ts.request(t, "GET", tt.path, nil, false)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.has != "" && !strings.Contains(body, `href="`+tt.has+`"`) {
+			t.Errorf("%s doesn't link to %s", tt.path, tt.has)
+		}
+		if tt.lack != "" && strings.Contains(body, `href="`+tt.lack+`"`) {
+			t.Errorf("%s links to %s", tt.path, tt.lack)
+		}
+	}
+
+	// deleting the topic takes it off the events filed under it
+	if resp := ts.submit(t, "/admin/tags", "/admin/tags/cloud/delete", nil); resp.StatusCode != http.StatusFound {
+		t.Fatalf("deleting the topic = %d", resp.StatusCode)
+	}
+	if e, _ := ts.Backend.Events(nil).Get("cloud-night"); len(e.TagIDs) != 0 {
+		t.Errorf("deleted topic is still on %+v", e)
+	}
+}
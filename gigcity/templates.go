@@ -0,0 +1,226 @@
+package gigcity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// templateFuncs are the functions available to every page template
+var templateFuncs = template.FuncMap{
+	"markdown": renderMarkdown,
+	// csrfField is only set when an admin page is rendered, see renderStatus
+	"csrfField": func() (template.HTML, error) {
+		return "", errors.New("csrfField used outside the admin area")
+	},
+}
+
+// sitePage lists the files making up a public page, the named files under
+// static/ wrapped in the site layout
+func sitePage(names ...string) []string {
+	files := []string{"static/_base.html"}
+	for _, name := range names {
+		files = append(files, "static/"+name+".html")
+	}
+	return files
+}
+
+// adminPage lists the files making up an admin page, the named files under
+// static/admin/ wrapped in the site layout and the admin overlay
+func adminPage(names ...string) []string {
+	files := []string{"static/_base.html", "static/admin/overlay.html"}
+	for _, name := range names {
+		files = append(files, "static/admin/"+name+".html")
+	}
+	return files
+}
+
+// pages lists the files making up every page, keyed by the name handlers
+// render it by.  The first file is the layout the page is executed through
+var pages = map[string][]string{
+	"404":                   sitePage("404"),
+	"500":                   sitePage("500"),
+	"about":                 sitePage("about", "sponsors"),
+	"admin/add-event":       adminPage("add-event", "timezones", "markdown"),
+	"admin/add-learn":       adminPage("add-learn", "timezones", "markdown"),
+	"admin/add-location":    adminPage("add-location", "timezones", "markdown"),
+	"admin/add-organizer":   adminPage("add-organizer"),
+	"admin/add-speaker":     adminPage("add-speaker"),
+	"admin/add-sponsor":     adminPage("add-sponsor"),
+	"admin/add-tag":         adminPage("add-tag", "markdown"),
+	"admin/agenda":          adminPage("agenda", "add-session"),
+	"admin/checkin":         adminPage("checkin"),
+	"admin/delete-location": adminPage("delete-location"),
+	"admin/edit-session":    adminPage("edit-session", "add-session"),
+	"admin/events":          adminPage("events"),
+	"admin/index":           adminPage("index"),
+	"admin/learn":           adminPage("learn"),
+	"admin/location":        adminPage("location"),
+	"admin/meetings":        adminPage("meetings"),
+	"admin/migrate":         adminPage("migrate"),
+	"admin/migrate-slugs":   adminPage("migrate-slugs"),
+	"admin/organizers":      adminPage("organizers"),
+	"admin/report":          adminPage("report"),
+	"admin/reports":         adminPage("reports"),
+	"admin/rsvps":           adminPage("rsvps"),
+	"admin/search":          adminPage("search"),
+	"admin/speakers":        adminPage("speakers"),
+	"admin/sponsors":        adminPage("sponsors"),
+	"admin/tags":            adminPage("tags"),
+	"admin/tokens":          adminPage("tokens"),
+	"archive":               sitePage("archive"),
+	"coc":                   sitePage("coc"),
+	"coc-report":            sitePage("coc-report"),
+	"events":                sitePage("events"),
+	"index":                 sitePage("index", "sponsors"),
+	"learn":                 sitePage("learn"),
+	"location":              sitePage("location"),
+	"rsvp":                  sitePage("rsvp"),
+	"search":                sitePage("search"),
+	"speaker":               sitePage("speaker"),
+	"ticket":                sitePage("ticket"),
+	"topic":                 sitePage("topic"),
+	"topics":                sitePage("topics"),
+	"view-event":            sitePage("view-event", "sponsors"),
+	"view-learn":            sitePage("view-learn"),
+}
+
+// templateSet holds every page parsed and ready to execute
+type templateSet struct {
+	// dev reparses a page whenever one of its files changes on disk
+	dev bool
+
+	mu     sync.Mutex
+	parsed map[string]*template.Template
+	loaded map[string]time.Time
+}
+
+// loadTemplates parses every page, returning the first error found so broken
+// templates stop the site starting rather than failing requests
+func loadTemplates(dev bool) (*templateSet, error) {
+	t := &templateSet{
+		dev:    dev,
+		parsed: make(map[string]*template.Template),
+		loaded: make(map[string]time.Time),
+	}
+
+	for name := range pages {
+		if err := t.load(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// load parses the files of the named page
+func (t *templateSet) load(name string) error {
+	files := pages[name]
+	loaded := time.Now()
+	page, err := template.New(path.Base(files[0])).Funcs(templateFuncs).ParseFiles(files...)
+	if err != nil {
+		return fmt.Errorf("page %s: %v", name, err)
+	}
+
+	t.parsed[name] = page
+	t.loaded[name] = loaded
+	return nil
+}
+
+// stale reports whether any file of the named page changed since it was
+// parsed
+func (t *templateSet) stale(name string) bool {
+	for _, file := range pages[name] {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().After(t.loaded[name]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup finds the named page, reparsing it first in dev mode if it changed
+func (t *templateSet) lookup(name string) (*template.Template, error) {
+	if _, ok := pages[name]; !ok {
+		return nil, fmt.Errorf("no page named %s", name)
+	}
+
+	if !t.dev {
+		return t.parsed[name], nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale(name) {
+		if err := t.load(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.parsed[name], nil
+}
+
+// executePage writes the named page executed with data to w.  Nothing is
+// written if it fails, so an error page can be sent instead.  funcs replace
+// template functions for this execution only
+func (s *site) executePage(w io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	page, err := s.templates.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if funcs != nil {
+		// the parsed page is shared, so bind the functions on a copy
+		if page, err = page.Clone(); err != nil {
+			return err
+		}
+		page.Funcs(funcs)
+	}
+
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// render replies with the named page executed with data
+func (s *site) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	s.renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus replies with the named page executed with data, sent with the
+// given status code.  Admin pages get the visitor's CSRF token for their forms
+func (s *site) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	var funcs template.FuncMap
+	if strings.HasPrefix(name, "admin/") {
+		// the token is looked up once, a browser without one yet is given a
+		// single cookie that every form on the page matches
+		token, err := csrfToken(w, r)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		funcs = template.FuncMap{"csrfField": csrfField(token)}
+	}
+
+	var buf bytes.Buffer
+	if err := s.executePage(&buf, name, data, funcs); err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
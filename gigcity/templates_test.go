@@ -0,0 +1,22 @@
+package gigcity
+
+import (
+	"testing"
+)
+
+func TestLoadTemplates(t *testing.T) {
+	set, err := loadTemplates(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range pages {
+		if page, err := set.lookup(name); err != nil || page == nil {
+			t.Errorf("lookup(%q) = %v, %v", name, page, err)
+		}
+	}
+
+	if _, err := set.lookup("nope"); err == nil {
+		t.Error("looked up a page that doesn't exist")
+	}
+}
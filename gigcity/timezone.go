@@ -0,0 +1,112 @@
+package gigcity
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultTimeZone is the chapter's home time zone.  It is used when neither
+// the admin form nor the location names one, and for records saved before
+// time zones were tracked
+const defaultTimeZone = "America/New_York"
+
+// formTimeLayout is the format datetime-local inputs send and expect
+const formTimeLayout = "2006-01-02T15:04"
+
+// displayTimeLayout is how dates and times are shown to visitors
+const displayTimeLayout = "2006-01-02 3:04 PM MST"
+
+// clockLayout shows just the time of day, where the date is already clear
+const clockLayout = "3:04 PM"
+
+var (
+	zonesMu sync.Mutex
+	zones   = make(map[string]*time.Location)
+)
+
+// loadZone returns the named IANA time zone, caching it since LoadLocation
+// reads the zone database from disk on every call
+func loadZone(name string) (*time.Location, error) {
+	zonesMu.Lock()
+	defer zonesMu.Unlock()
+
+	if loc, ok := zones[name]; ok {
+		return loc, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	zones[name] = loc
+	return loc, nil
+}
+
+// zoneOrDefault returns the named time zone, or the chapter's default zone if
+// name is empty or unknown
+func zoneOrDefault(name string) *time.Location {
+	if name != "" {
+		if loc, err := loadZone(name); err == nil {
+			return loc
+		}
+	}
+
+	loc, err := loadZone(defaultTimeZone)
+	if err != nil {
+		// no zone database available, UTC is better than nothing
+		return time.UTC
+	}
+
+	return loc
+}
+
+// formatLocal shows t in the named time zone, or "TBA" if t was never set
+func formatLocal(t time.Time, zone string) string {
+	if t.IsZero() {
+		return "TBA"
+	}
+
+	return t.In(zoneOrDefault(zone)).Format(displayTimeLayout)
+}
+
+// formValueLocal formats t in the named time zone for a datetime-local input
+func formValueLocal(t time.Time, zone string) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.In(zoneOrDefault(zone)).Format(formTimeLayout)
+}
+
+// parseFormTime reads the date and time (in formTimeLayout) and time zone
+// fields of an admin form.  A blank zone falls back to the zone of the
+// location with ID locID, then to defaultTimeZone.  API clients may send an
+// RFC 3339 time instead, which carries its own offset.  The time is returned
+// in UTC along with the name of the zone used.  If the fields are invalid the
+// returned message says why
+func (s *site) parseFormTime(r *http.Request, value, zone, locID string) (time.Time, string, string) {
+	if zone == "" {
+		if l, err := s.backend.Locations(r).Get(locID); err == nil {
+			zone = l.TimeZone
+		}
+	}
+	if zone == "" {
+		zone = defaultTimeZone
+	}
+
+	loc, err := loadZone(zone)
+	if err != nil {
+		return time.Time{}, zone, "unknown time zone " + zone
+	}
+
+	t, err := time.ParseInLocation(formTimeLayout, value, loc)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return time.Time{}, zone, "date and time must be in YYYY-MM-DDTHH:MM format"
+		}
+	}
+
+	return t.UTC(), zone, ""
+}
@@ -0,0 +1,56 @@
+package gigcity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFormTime(t *testing.T) {
+	s := &site{backend: newMemoryBackend()}
+	if err := s.backend.Locations(nil).Add(Location{ID: "hall", Name: "Hall", TimeZone: "Europe/London"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		value, zone, locID string
+		want               string
+		wantZone           string
+		ok                 bool
+	}{
+		{"2015-07-04T18:30", "America/Chicago", "hall", "2015-07-04T23:30", "America/Chicago", true},
+		// a blank zone is taken from the location, then the chapter's default
+		{"2015-07-04T18:30", "", "hall", "2015-07-04T17:30", "Europe/London", true},
+		{"2015-07-04T18:30", "", "nope", "2015-07-04T22:30", defaultTimeZone, true},
+		{"2015-01-04T18:30", "", "nope", "2015-01-04T23:30", defaultTimeZone, true},
+		{"2015-07-04T18:30", "Mars/Olympus", "hall", "", "", false},
+		{"4 July 2015", "", "hall", "", "", false},
+	} {
+		got, zone, msg := s.parseFormTime(nil, tt.value, tt.zone, tt.locID)
+		if (msg == "") != tt.ok {
+			t.Errorf("parseFormTime(%q, %q, %q) = %q, want ok %v", tt.value, tt.zone, tt.locID, msg, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !got.Equal(at(tt.want)) || zone != tt.wantZone || got.Location() != time.UTC {
+			t.Errorf("parseFormTime(%q, %q, %q) = %s in %q, want %s UTC in %q", tt.value, tt.zone, tt.locID, got, zone, tt.want, tt.wantZone)
+		}
+	}
+}
+
+func TestFormatLocal(t *testing.T) {
+	when := at("2015-07-04T23:30")
+	if got := formatLocal(when, "America/Chicago"); got != "2015-07-04 6:30 PM CDT" {
+		t.Errorf("formatLocal = %q", got)
+	}
+	if got := formatLocal(when, ""); got != "2015-07-04 7:30 PM EDT" {
+		t.Errorf("formatLocal in the default zone = %q", got)
+	}
+	if got := formatLocal(time.Time{}, "America/Chicago"); got != "TBA" {
+		t.Errorf("formatLocal of an unset time = %q, want TBA", got)
+	}
+	if got := formValueLocal(when, "Europe/London"); got != "2015-07-05T00:30" {
+		t.Errorf("formValueLocal = %q", got)
+	}
+}
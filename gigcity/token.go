@@ -0,0 +1,235 @@
+package gigcity
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// APIToken lets an organizer's scripts use the write API.  Only a hash of the
+// secret half is stored, the full token is shown once when it is created
+type APIToken struct {
+	// ID is the public half of the token, used to look it up
+	ID string
+	// Name says what the token is for, like "meetup sync script"
+	Name string
+	// Owner is the admin who created the token, API writes act as them
+	Owner string
+	// Hash is the hex encoded SHA-256 of the secret half of the token
+	Hash string
+	// Created is when the token was issued
+	Created time.Time
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// newSecretKey returns a random key for a SecretStore
+func newSecretKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// hashSecret hashes the secret half of a token for storage
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken issues a token for owner.  It returns the record to store and
+// the full token, ID and secret joined by a dot, to hand to the owner
+func newAPIToken(name, owner string) (APIToken, string, error) {
+	t := APIToken{Name: name, Owner: owner, Created: time.Now().UTC()}
+	var err error
+	t.ID, err = randomHex(8)
+	if err != nil {
+		return t, "", err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return t, "", err
+	}
+
+	t.Hash = hashSecret(secret)
+	return t, t.ID + "." + secret, nil
+}
+
+// apiUser returns the owner of the bearer token the request was sent with, or
+// "" if it has none, the token is unknown or revoked, or its owner is no
+// longer an organizer with admin access
+func (s *site) apiUser(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(header[len(prefix):]), ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	t, err := s.backend.Tokens(r).Get(parts[0])
+	if err != nil {
+		if err != ErrNotFound {
+			logHandler("ERROR", "looking up API token failed: "+err.Error())
+		}
+		return ""
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(t.Hash)) != 1 {
+		return ""
+	}
+
+	admin, err := s.adminOrganizer(r, t.Owner)
+	if err != nil {
+		logHandler("ERROR", "looking up API token owner failed: "+err.Error())
+		return ""
+	}
+	if !admin {
+		logHandler("WARN", fmt.Sprintf("refused API token %s, %s is not an organizer with admin access", t.ID, t.Owner))
+		return ""
+	}
+
+	return t.Owner
+}
+
+// revokeTokens deletes every token owned by email, for when they lose admin
+// access
+func (s *site) revokeTokens(r *http.Request, email string) error {
+	store := s.backend.Tokens(r)
+	tokens, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		if !strings.EqualFold(t.Owner, email) {
+			continue
+		}
+
+		if err := store.Delete(t.ID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requireToken reports whether the request carries a valid API token.  If not,
+// a JSON error is sent and the caller should stop handling the request
+func (s *site) requireToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.apiUser(r) != "" {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="GDG Gigcity API"`)
+	apiError(w, r, http.StatusUnauthorized, "a valid API token is required")
+	return false
+}
+
+// byCreated sorts tokens oldest first
+type byCreated []APIToken
+
+func (t byCreated) Len() int           { return len(t) }
+func (t byCreated) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byCreated) Less(i, j int) bool { return t[i].Created.Before(t[j].Created) }
+
+// Handles requests to /admin/tokens.  GET lists the issued tokens, POST issues
+// a new one for the signed in admin and shows it this one time
+func (s *site) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	type Content struct {
+		Tokens []APIToken
+		// NewToken is the full token just issued, it can't be shown again
+		NewToken string
+		NewName  string
+	}
+
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	var context Content
+	store := s.backend.Tokens(r)
+	if r.Method == "POST" {
+		name := r.FormValue("name")
+		if name == "" {
+			s.errorHandler(w, r, http.StatusBadRequest, "token name is required")
+			return
+		}
+
+		// tokens only work while their owner is an admin organizer, an owner
+		// who isn't one would be handed a token that is refused straight away
+		user := s.auth.User(r)
+		admin, err := s.adminOrganizer(r, user)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !admin {
+			http.Error(w, "Add "+user+" as an organizer with admin access before creating API tokens.", http.StatusBadRequest)
+			return
+		}
+
+		t, token, err := newAPIToken(name, user)
+		if err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if err := store.Add(t); err != nil {
+			s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		context.NewToken = token
+		context.NewName = name
+	}
+
+	var err error
+	context.Tokens, err = store.List()
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Sort(byCreated(context.Tokens))
+
+	s.render(w, r, "admin/tokens", context)
+}
+
+// Handles requests to /admin/tokens/:token/revoke
+func (s *site) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	err := s.backend.Tokens(r).Delete(r.URL.Query().Get(":token"))
+	if err == ErrNotFound {
+		s.errorHandler(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err != nil {
+		s.errorHandler(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	http.Redirect(w, r, "/admin/tokens", http.StatusFound)
+}